@@ -0,0 +1,227 @@
+package chestnut
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/archive"
+)
+
+const (
+	// backupPrefix and the extensions name the archives of scheduled backups,
+	// the timestamp between them is used to order and to retain them.
+	backupPrefix     = "chestnut-"
+	backupExt        = ".tar.gz"
+	backupArchiveExt = ".arc"
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+// BackupRetention is the policy which decides the backups kept in the backup
+// directory. A backup is kept if any rule keeps it, and a zero BackupRetention
+// keeps every backup.
+type BackupRetention struct {
+	// Last keeps the most recent backups.
+	Last int
+	// Daily keeps the most recent backup of each of the most recent days.
+	Daily int
+	// Weekly keeps the most recent backup of each of the most recent ISO weeks.
+	Weekly int
+}
+
+// keepsAll reports whether the policy keeps every backup.
+func (r BackupRetention) keepsAll() bool {
+	return r.Last == 0 && r.Daily == 0 && r.Weekly == 0
+}
+
+func (r BackupRetention) valid() error {
+	if r.Last < 0 || r.Daily < 0 || r.Weekly < 0 {
+		return errors.New("backup retention cannot be negative")
+	}
+	return nil
+}
+
+// BackupHook is called after every backup written by the storage chest with
+// the path of the archive, and the error of the backup if it failed.
+type BackupHook func(path string, err error)
+
+// backup is an archive of a scheduled backup in the backup directory.
+type backup struct {
+	path string
+	time time.Time
+}
+
+// Backup writes a timestamped export archive of the storage chest to the
+// backup directory, verifies it, and removes the backups which are not kept
+// by the retention policy. The archive is encrypted if an export secret is
+// set. It returns the path of the archive. SEE: WithBackupSchedule.
+func (cn *Chestnut) Backup() (string, error) {
+	if cn.opts.backupDir == "" {
+		return "", cn.logError("backup", errors.New("backup directory required"))
+	}
+	path, err := cn.writeBackup(time.Now().UTC())
+	if err == nil {
+		err = cn.pruneBackups()
+	}
+	for _, hook := range cn.opts.backupHooks {
+		hook(path, err)
+	}
+	return path, cn.logError("backup", err)
+}
+
+// writeBackup writes and verifies the archive of a backup taken at t. The
+// archive is written to a temporary file which is renamed once it has been
+// verified, so the backup directory only holds complete backups.
+func (cn *Chestnut) writeBackup(t time.Time) (string, error) {
+	dir := cn.opts.backupDir
+	ext := backupExt
+	if cn.opts.exportSecret != nil {
+		ext = backupArchiveExt
+	}
+	path := filepath.Join(dir, backupPrefix+t.Format(backupTimeFormat)+ext)
+	cn.log.Debugf("backup: to path: %s", path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return path, err
+	}
+	f, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return path, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	err = cn.ExportTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return path, err
+	}
+	if cn.opts.exportSecret != nil {
+		err = archive.Verify(tmp, cn.opts.exportSecret)
+	} else {
+		err = storage.VerifyArchive(tmp)
+	}
+	if err != nil {
+		return path, fmt.Errorf("verify: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return path, err
+	}
+	cn.log.Infof("backup: wrote %s", path)
+	return path, nil
+}
+
+// pruneBackups removes the backups in the backup directory which are not
+// kept by the retention policy.
+func (cn *Chestnut) pruneBackups() error {
+	retention := cn.opts.backupRetention
+	if retention.keepsAll() {
+		return nil
+	}
+	backups, err := listBackups(cn.opts.backupDir)
+	if err != nil {
+		return err
+	}
+	keep := retainBackups(backups, retention)
+	for _, b := range backups {
+		if keep[b.path] {
+			continue
+		}
+		cn.log.Debugf("backup: removing %s", b.path)
+		if err = os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackups returns the backups in dir, most recent first.
+func listBackups(dir string) ([]backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, backupPrefix)
+		if s := strings.TrimSuffix(stamp, backupExt); s != stamp {
+			stamp = s
+		} else if s = strings.TrimSuffix(stamp, backupArchiveExt); s != stamp {
+			stamp = s
+		} else {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups, nil
+}
+
+// retainBackups returns the paths of the backups kept by retention. The
+// backups must be sorted most recent first.
+func retainBackups(backups []backup, retention BackupRetention) map[string]bool {
+	keep := make(map[string]bool)
+	for i := 0; i < retention.Last && i < len(backups); i++ {
+		keep[backups[i].path] = true
+	}
+	day := func(t time.Time) string {
+		return t.Format("2006-01-02")
+	}
+	week := func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	for _, rule := range []struct {
+		n      int
+		period func(time.Time) string
+	}{
+		{retention.Daily, day},
+		{retention.Weekly, week},
+	} {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) == rule.n {
+				break
+			}
+			if p := rule.period(b.time); !seen[p] {
+				seen[p] = true
+				keep[b.path] = true
+			}
+		}
+	}
+	return keep
+}
+
+// scheduleBackups writes a backup every backup interval until stop is closed.
+func (cn *Chestnut) scheduleBackups(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(cn.opts.backupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// Backup logs and reports its own errors
+		_, _ = cn.Backup()
+	}
+}
@@ -1,16 +1,22 @@
 package chestnut
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"time"
 
 	"git.tcp.direct/kayos/chestnut/encoding/compress"
 	"git.tcp.direct/kayos/chestnut/encoding/compress/zstd"
 	"git.tcp.direct/kayos/chestnut/encoding/json"
 	"git.tcp.direct/kayos/chestnut/encoding/json/encoders/secure"
+	"git.tcp.direct/kayos/chestnut/encoding/tags"
 	"git.tcp.direct/kayos/chestnut/log"
 	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/archive"
 	"git.tcp.direct/kayos/chestnut/value"
 )
 
@@ -21,6 +27,12 @@ type Chestnut struct {
 	opts  ChestOptions
 	store storage.Storage
 	log   log.Logger
+	// stopCompaction stops auto-compaction, which closes compactionDone.
+	stopCompaction chan struct{}
+	compactionDone chan struct{}
+	// stopBackups stops scheduled backups, which closes backupsDone.
+	stopBackups chan struct{}
+	backupsDone chan struct{}
 }
 
 // NewChestnut is used to create a new chestnut encrypted store.
@@ -29,7 +41,7 @@ func NewChestnut(store storage.Storage, opt ...ChestOption) *Chestnut {
 	// logger := storage.LoggerFromStore(store, logName)
 	opts := applyOptions(DefaultChestOptions, opt...)
 	logger := log.Named(opts.log, logName)
-	cn := &Chestnut{opts, store, logger}
+	cn := &Chestnut{opts: opts, store: store, log: logger}
 	if err := cn.validConfig(); err != nil {
 		logger.Panic(err)
 		return nil
@@ -56,6 +68,18 @@ func (cn *Chestnut) validConfig() error {
 	if !cn.opts.compression.Valid() {
 		return errors.New("invalid compression format")
 	}
+	if t := cn.opts.compactThreshold; cn.opts.compactInterval > 0 && !(t >= 0 && t <= 1) {
+		return fmt.Errorf("auto compaction: threshold %v is not between 0 and 1", t)
+	}
+	if _, ok := cn.store.(storage.Compactor); cn.opts.compactInterval > 0 && !ok {
+		return fmt.Errorf("auto compaction: %w: store cannot be compacted", storage.ErrNotSupported)
+	}
+	if cn.opts.backupInterval > 0 && cn.opts.backupDir == "" {
+		return errors.New("backup directory required")
+	}
+	if err := cn.opts.backupRetention.valid(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -80,6 +104,19 @@ func (cn *Chestnut) Open() error {
 	if !cn.opts.overwrites {
 		cn.log.Info("overwrites are disabled")
 	}
+	if cn.opts.compactInterval > 0 && cn.stopCompaction == nil {
+		cn.log.Infof("auto compaction every %s at %.0f%% dead space",
+			cn.opts.compactInterval, cn.opts.compactThreshold*100)
+		cn.stopCompaction = make(chan struct{})
+		cn.compactionDone = make(chan struct{})
+		go cn.autoCompact(cn.store.(storage.Compactor), cn.stopCompaction, cn.compactionDone)
+	}
+	if cn.opts.backupInterval > 0 && cn.stopBackups == nil {
+		cn.log.Infof("backups every %s to %s", cn.opts.backupInterval, cn.opts.backupDir)
+		cn.stopBackups = make(chan struct{})
+		cn.backupsDone = make(chan struct{})
+		go cn.scheduleBackups(cn.stopBackups, cn.backupsDone)
+	}
 	return nil
 }
 
@@ -239,13 +276,13 @@ func (cn *Chestnut) CanPut(name string, key []byte) error {
 		cn.log.Debug("can put: overwrites enabled")
 		return nil
 	}
-	// if overwrites are disabled check to see if we have the key. if
-	// the key does not exist, has will return an error. technically,
-	// this could get confused because an error would also be returned
-	// if the key was invalid, but since we already check that above
-	// we can safely assume that's not the error. since we expect an error
-	// when the key is not found has Has will log it, we can ignore it.
-	if has, _ := cn.Has(name, key); has {
+	// if overwrites are disabled check to see if we have the key.
+	// a missing key or namespace is not an error, so any error
+	// here means the store itself is failing.
+	has, err := cn.Has(name, key)
+	if err != nil {
+		return cn.logError("can put", err)
+	} else if has {
 		return cn.logError("can put", ErrForbidden)
 	}
 	// we didn't find the key and there is no error, this is not an overwrite.
@@ -267,15 +304,126 @@ func (cn *Chestnut) List(namespace string) ([][]byte, error) {
 	return keys, cn.logError("", err)
 }
 
-// Export saves a copy of the storage chest to directory at path.
+// ListNamespaces returns the sorted names of the namespaces in the storage chest.
+func (cn *Chestnut) ListNamespaces() ([]string, error) {
+	cn.log.Debug("list: all namespaces")
+	names, err := cn.store.ListNamespaces()
+	cn.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, cn.logError("", err)
+}
+
+// DropNamespace removes a namespace and every key in it from the storage chest.
+func (cn *Chestnut) DropNamespace(namespace string) error {
+	cn.log.Debugf("drop: namespace: %s", namespace)
+	return cn.logError("", cn.store.DropNamespace(namespace))
+}
+
+// RenameNamespace moves every key in namespace from to namespace to. If
+// namespace to exists the error wraps storage.ErrNamespaceExists.
+func (cn *Chestnut) RenameNamespace(from, to string) error {
+	cn.log.Debugf("rename: namespace: %s to: %s", from, to)
+	return cn.logError("", cn.store.RenameNamespace(from, to))
+}
+
+// CopyNamespace copies every key in namespace from to namespace to. If
+// namespace to exists the error wraps storage.ErrNamespaceExists.
+func (cn *Chestnut) CopyNamespace(from, to string) error {
+	cn.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return cn.logError("", cn.store.CopyNamespace(from, to))
+}
+
+// Export saves a copy of the storage chest to directory at path. If an export
+// secret is set, the copy is written to an encrypted archive at path instead.
 func (cn *Chestnut) Export(path string) error {
 	cn.log.Debugf("export: to path: %s", path)
+	if cn.opts.exportSecret != nil {
+		cn.log.Debugf("export: encrypting archive with secret: %s", cn.opts.exportSecret.ID())
+		return cn.logError("", archive.Export(cn.store, path, cn.opts.exportSecret))
+	}
 	return cn.logError("", cn.store.Export(path))
 }
 
+// ExportTo streams an export archive of the storage chest to w. If an export
+// secret is set, the archive is encrypted. The archive is restored with the
+// Restore of the store's package, or archive.Restore if it is encrypted.
+func (cn *Chestnut) ExportTo(w io.Writer) error {
+	cn.log.Debug("export: to writer")
+	if cn.opts.exportSecret != nil {
+		cn.log.Debugf("export: encrypting archive with secret: %s", cn.opts.exportSecret.ID())
+		return cn.logError("", archive.ExportTo(cn.store, w, cn.opts.exportSecret))
+	}
+	return cn.logError("", storage.ExportTo(cn.store, w))
+}
+
+// Stats returns the statistics of the storage chest. The value sizes are
+// the sizes of the stored values, after compression and encryption. If the
+// store is not a storage.StatsStorage every value is read to collect them.
+func (cn *Chestnut) Stats() (storage.Stats, error) {
+	cn.log.Debug("stats: storage chest")
+	stats, err := storage.CollectStats(cn.store)
+	return stats, cn.logError("stats", err)
+}
+
+// Count returns the number of keys in the namespace. If the store is not a
+// storage.StatsStorage the keys in the namespace are listed to count them.
+func (cn *Chestnut) Count(namespace string) (int64, error) {
+	cn.log.Debugf("count: keys in namespace: %s", namespace)
+	count, err := storage.CountKeys(cn.store, namespace)
+	return count, cn.logError("count", err)
+}
+
+// Compact reclaims the space used by deleted and overwritten entries in the
+// store. The store must implement storage.Compactor, otherwise the error
+// wraps storage.ErrNotSupported.
+func (cn *Chestnut) Compact() error {
+	cn.log.Debug("compact: storage chest")
+	c, ok := cn.store.(storage.Compactor)
+	if !ok {
+		err := fmt.Errorf("%w: store cannot be compacted", storage.ErrNotSupported)
+		return cn.logError("compact", err)
+	}
+	return cn.logError("compact", c.Compact())
+}
+
+// autoCompact compacts the store every compaction interval, if its dead
+// space is at least the compaction threshold, until stop is closed.
+func (cn *Chestnut) autoCompact(c storage.Compactor, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(cn.opts.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		dead, err := c.DeadSpace()
+		if err != nil {
+			_ = cn.logError("auto compact", err)
+			continue
+		}
+		if dead < cn.opts.compactThreshold {
+			cn.log.Debugf("auto compact: %.1f%% dead space", dead*100)
+			continue
+		}
+		cn.log.Infof("auto compact: compacting %.1f%% dead space", dead*100)
+		_ = cn.logError("auto compact", c.Compact())
+	}
+}
+
 // Close the storage chest
 func (cn *Chestnut) Close() error {
 	cn.log.Info("closing storage chest")
+	if cn.stopBackups != nil {
+		close(cn.stopBackups)
+		<-cn.backupsDone
+		cn.stopBackups = nil
+	}
+	if cn.stopCompaction != nil {
+		close(cn.stopCompaction)
+		<-cn.compactionDone
+		cn.stopCompaction = nil
+	}
 	if err := cn.store.Close(); err != nil {
 		return cn.logError("close", err)
 	}
@@ -325,20 +473,23 @@ func (cn *Chestnut) decrypt(ciphertext []byte) (plaintext []byte, err error) {
 	cn.log.Debugf("decrypt: decrypting %d bytes", len(ciphertext))
 	plaintext, err = cn.opts.encryptor.Decrypt(ciphertext)
 	if err != nil {
-		err = cn.logError("decrypt", err)
+		err = cn.logError("decrypt", storage.WrapError(storage.ErrDecrypt, err))
 		return
 	}
 	cn.log.Debugf("decrypt: decrypted %d bytes", len(plaintext))
 	return
 }
 
-// marshal returns the JSON encoding of v as ciphertext.
+// marshal returns the secure JSON, or serializer, encoding of v as ciphertext.
 func (cn *Chestnut) marshal(v interface{}) (ciphertext []byte, err error) {
 	if v == nil {
 		err = errors.New("value cannot be nil")
 		return nil, cn.logError("marshal", err)
 	}
 	cn.log.Debugf("marshal: %v value", reflect.TypeOf(v))
+	if cn.opts.serializer != nil {
+		return cn.serialize(v)
+	}
 	ciphertext, err = json.SecureMarshal(v, cn.encrypt, secure.WithLogger(cn.log))
 	if err != nil {
 		err = cn.logError("marshal", err)
@@ -348,7 +499,7 @@ func (cn *Chestnut) marshal(v interface{}) (ciphertext []byte, err error) {
 	return
 }
 
-// unmarshal returns the plaintext decoded JSON value at v.
+// unmarshal returns the plaintext decoded value at v.
 func (cn *Chestnut) unmarshal(ciphertext []byte, v interface{}, sparse bool) error {
 	if v == nil {
 		err := errors.New("value cannot be nil")
@@ -356,6 +507,9 @@ func (cn *Chestnut) unmarshal(ciphertext []byte, v interface{}, sparse bool) err
 	}
 	cn.log.Debugf("unmarshal: decrypt %d bytes to %v value",
 		len(ciphertext), reflect.TypeOf(v))
+	if bytes.HasPrefix(ciphertext, []byte(serializedMarker)) {
+		return cn.deserialize(ciphertext, v)
+	}
 	opts := []secure.Option{secure.WithLogger(cn.log)}
 	if sparse {
 		cn.log.Debug("use sparse decoding")
@@ -369,6 +523,71 @@ func (cn *Chestnut) unmarshal(ciphertext []byte, v interface{}, sparse bool) err
 	return nil
 }
 
+// serializedMarker marks the values encoded by the serializer. The name of
+// the serializer is encrypted with the value, so it is not stored in the clear.
+const serializedMarker = "chestnut-serialized:"
+
+// serialize returns the serializer encoding of v, after a byte with the
+// length of the name of the serializer and the name, compressed and
+// encrypted after the serialized marker. The serializer cannot sparsely
+// encrypt or hash fields, so structs with secure or hash fields are an
+// error wrapping ErrNotSupported rather than silently saved without them.
+func (cn *Chestnut) serialize(v interface{}) ([]byte, error) {
+	name := cn.opts.serializer.Name()
+	cn.log.Debugf("marshal: %s encode %v value", name, reflect.TypeOf(v))
+	if field, ok := tags.OptionField(reflect.TypeOf(v)); ok {
+		err := fmt.Errorf("%w: %s serializer cannot encode the secure or hash field %s",
+			storage.ErrNotSupported, name, field)
+		return nil, cn.logError("marshal", err)
+	}
+	if name == "" || len(name) > math.MaxUint8 {
+		err := fmt.Errorf("invalid serializer name: %q", name)
+		return nil, cn.logError("marshal", err)
+	}
+	encoded, err := cn.opts.serializer.Marshal(v)
+	if err != nil {
+		return nil, cn.logError("marshal", err)
+	}
+	plaintext := make([]byte, 0, 1+len(name)+len(encoded))
+	plaintext = append(plaintext, byte(len(name)))
+	plaintext = append(plaintext, name...)
+	plaintext = append(plaintext, encoded...)
+	if plaintext, err = cn.compress(plaintext); err != nil {
+		return nil, cn.logError("marshal", err)
+	}
+	ciphertext, err := cn.encrypt(plaintext)
+	if err != nil {
+		return nil, cn.logError("marshal", err)
+	}
+	cn.log.Debugf("marshal: encrypted %d bytes", len(ciphertext))
+	return append([]byte(serializedMarker), ciphertext...), nil
+}
+
+// deserialize decrypts and decodes a value encoded by serialize into v.
+func (cn *Chestnut) deserialize(data []byte, v interface{}) error {
+	plaintext, err := cn.decrypt(data[len(serializedMarker):])
+	if err != nil {
+		return cn.logError("unmarshal", err)
+	}
+	if plaintext, err = cn.decompress(plaintext); err != nil {
+		return cn.logError("unmarshal", err)
+	}
+	if len(plaintext) < 1 || len(plaintext) < 1+int(plaintext[0]) {
+		err = storage.WrapError(storage.ErrCorrupt, errors.New("invalid serializer name"))
+		return cn.logError("unmarshal", err)
+	}
+	name, encoded := string(plaintext[1:1+plaintext[0]]), plaintext[1+plaintext[0]:]
+	if cn.opts.serializer == nil || cn.opts.serializer.Name() != name {
+		err = fmt.Errorf("%w: value encoded with %s serializer", storage.ErrNotSupported, name)
+		return cn.logError("unmarshal", err)
+	}
+	if err = cn.opts.serializer.Unmarshal(encoded, v); err != nil {
+		return cn.logError("unmarshal", err)
+	}
+	cn.log.Debugf("unmarshal: %s decoded %v value", name, reflect.TypeOf(v))
+	return nil
+}
+
 func (cn *Chestnut) compress(data []byte) ([]byte, error) {
 	format := cn.opts.compression
 	if format == compress.None {
@@ -426,6 +645,7 @@ func (cn *Chestnut) decompress(data []byte) ([]byte, error) {
 	cn.log.Debugf("decompressing %d bytes with %s", len(compressed), format)
 	decompressed, err := decompressor(compressed)
 	if err != nil {
+		err = storage.WrapError(storage.ErrCorrupt, err)
 		return nil, cn.logError("decompress", err)
 	}
 	cn.log.Debugf("decompressed %d bytes with %s",
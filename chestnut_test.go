@@ -2,23 +2,33 @@ package chestnut
 
 import (
 	"errors"
+	"math"
+	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
+	"git.tcp.direct/kayos/chestnut/encoding/cbor"
 	"git.tcp.direct/kayos/chestnut/encoding/compress"
 	"git.tcp.direct/kayos/chestnut/encoding/compress/zstd"
+	"git.tcp.direct/kayos/chestnut/encoding/msgpack"
 	"git.tcp.direct/kayos/chestnut/encryptor"
 	"git.tcp.direct/kayos/chestnut/encryptor/aes"
+	"git.tcp.direct/kayos/chestnut/encryptor/chacha"
 	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
 	"git.tcp.direct/kayos/chestnut/log"
 	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/archive"
 	"git.tcp.direct/kayos/chestnut/storage/bolt"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
 	"git.tcp.direct/kayos/chestnut/storage/nuts"
 	"git.tcp.direct/kayos/chestnut/value"
 )
@@ -415,6 +425,53 @@ func (ts *ChestnutTestSuite) TestStore_Export() {
 	ts.NoError(err)
 }
 
+func (ts *ChestnutTestSuite) TestStore_EncryptedExport() {
+	key := []byte(newKey())
+	err := ts.cn.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	secret := crypto.TextSecret("i-am-a-backup-secret")
+	cn := NewChestnut(ts.cn.store, encryptorOpt, WithExportSecret(secret))
+	dir := ts.T().TempDir()
+	path := filepath.Join(dir, "chest.arc")
+	err = cn.Export(path)
+	ts.NoError(err)
+	dest := filepath.Join(dir, "restored")
+	err = archive.Restore(path, dest, secret)
+	ts.NoError(err)
+	restored := NewChestnut(ts.storeFunc(ts.T(), dest), encryptorOpt)
+	err = restored.Open()
+	ts.NoError(err)
+	defer restored.Close()
+	val, err := restored.Get(testName, key)
+	ts.NoError(err)
+	ts.Equal(testValue, string(val))
+}
+
+func (ts *ChestnutTestSuite) TestStore_ExportTo() {
+	key := []byte(newKey())
+	err := ts.cn.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	secret := crypto.TextSecret("i-am-a-backup-secret")
+	cn := NewChestnut(ts.cn.store, encryptorOpt, WithExportSecret(secret))
+	dir := ts.T().TempDir()
+	path := filepath.Join(dir, "chest.arc")
+	f, err := os.Create(path)
+	ts.NoError(err)
+	err = cn.ExportTo(f)
+	ts.NoError(err)
+	ts.NoError(f.Close())
+	dest := filepath.Join(dir, "restored")
+	err = archive.Restore(path, dest, secret)
+	ts.NoError(err)
+	restored := NewChestnut(ts.storeFunc(ts.T(), dest), encryptorOpt)
+	err = restored.Open()
+	ts.NoError(err)
+	defer restored.Close()
+	val, err := restored.Get(testName, key)
+	ts.NoError(err)
+	ts.Equal(testValue, string(val))
+}
+
 func (ts *ChestnutTestSuite) TestStore_SecureEntry() {
 	const (
 		testKey   = "hello"
@@ -531,6 +588,41 @@ func (ts *ChestnutTestSuite) TestChestnut_ChainedEncryptor() {
 	ts.NoError(err)
 }
 
+func (ts *ChestnutTestSuite) TestChestnut_ChaCha() {
+	secret := crypto.TextSecret("i-am-a-chacha-secret")
+	store := ts.storeFunc(ts.T(), ts.T().TempDir())
+	cn := NewChestnut(store, WithChaCha(secret))
+	err := cn.Open()
+	ts.NoError(err)
+	defer func() {
+		err = cn.Close()
+		ts.NoError(err)
+	}()
+	key := []byte(newKey())
+	err = cn.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	v, err := cn.Get(testName, key)
+	ts.NoError(err)
+	ts.Equal(testValue, string(v))
+	err = cn.Save(testName, key, secureSrc)
+	ts.NoError(err)
+	dst := &TSecure{}
+	err = cn.Load(testName, key, dst)
+	ts.NoError(err)
+	ts.Equal(&secureOut, dst)
+	// a chained chacha and aes encryptor
+	chained := NewChestnut(store, WithEncryptorChain(
+		chacha.NewEncryptor(secret),
+		encryptor.NewAESEncryptor(crypto.Key256, aes.GCM, secret)))
+	err = chained.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	v, err = chained.Get(testName, key)
+	ts.NoError(err)
+	ts.Equal(testValue, string(v))
+	_, err = cn.Get(testName, key)
+	ts.ErrorIs(err, storage.ErrDecrypt)
+}
+
 func (ts *ChestnutTestSuite) TestChestnut_Compression() {
 	compOpt := WithCompression(compress.Zstd)
 	key := newKey()
@@ -573,6 +665,266 @@ func (ts *ChestnutTestSuite) TestChestnut_Compressors() {
 	ts.Equal(lorumIpsum, string(val))
 }
 
+func (ts *ChestnutTestSuite) TestChestnut_Serializers() {
+	src := &TObject{ValueA: "i-am-a-serialized-plaintext", ValueB: 1}
+	serializers := []storage.Serializer{storage.JSON, storage.Gob, msgpack.Serializer, cbor.Serializer}
+	for _, s := range serializers {
+		key := []byte(s.Name())
+		cn := NewChestnut(ts.cn.store, encryptorOpt, WithSerializer(s), WithCompression(compress.Zstd))
+		err := cn.Save(testName, key, src)
+		ts.NoError(err, s.Name())
+		stored, err := ts.cn.store.Get(testName, key)
+		ts.NoError(err, s.Name())
+		ts.NotContains(string(stored), src.ValueA, s.Name())
+		ts.NotContains(string(stored), s.Name(), s.Name())
+		dst := &TObject{}
+		err = cn.Load(testName, key, dst)
+		ts.NoError(err, s.Name())
+		ts.Equal(src, dst, s.Name())
+		// the storage chest must use the same serializer
+		err = ts.cn.Load(testName, key, &TObject{})
+		ts.ErrorIs(err, storage.ErrNotSupported, s.Name())
+		// serializers cannot sparsely encrypt or hash fields
+		err = cn.Save(testName, key, &TAll{})
+		ts.ErrorIs(err, storage.ErrNotSupported, s.Name())
+		err = cn.Save(testName, key, []THash{{}})
+		ts.ErrorIs(err, storage.ErrNotSupported, s.Name())
+	}
+	// values saved with the secure JSON encoding can still be loaded
+	all := &TAll{
+		TObject:   TObject{ValueA: "a", ValueB: 1},
+		Secure:    TSecure{SecureValueA: "secure", SecureValueB: 3},
+		AllValueB: 4,
+	}
+	err := ts.cn.Save(testName, []byte("secure-json"), all)
+	ts.NoError(err)
+	cn := NewChestnut(ts.cn.store, encryptorOpt, WithSerializer(storage.Gob))
+	dst := &TAll{}
+	err = cn.Load(testName, []byte("secure-json"), dst)
+	ts.NoError(err)
+	ts.Equal(all.TObject, dst.TObject)
+	ts.Equal(all.Secure, dst.Secure)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_Errors() {
+	key := []byte(newKey())
+	_, err := ts.cn.Get(testName, key)
+	ts.ErrorIs(err, storage.ErrNotFound)
+	_, err = ts.cn.List(newKey())
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	// gcm authenticates the ciphertext, so the wrong secret fails to decrypt
+	gcm1 := NewChestnut(ts.cn.store, WithAES(crypto.Key256, aes.GCM, textSecret))
+	gcm2 := NewChestnut(ts.cn.store, WithAES(crypto.Key256, aes.GCM,
+		crypto.TextSecret("i-am-the-wrong-secret")))
+	err = gcm1.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	_, err = gcm2.Get(testName, key)
+	ts.ErrorIs(err, storage.ErrDecrypt)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_StoreFaults() {
+	key := []byte(newKey())
+	store := storage.Wrap(ts.cn.store, storage.InjectFaults(
+		storage.Fault{Op: storage.OpPut, Err: storage.ErrReadOnly, Times: 1},
+		storage.Fault{Op: storage.OpGet, Err: storage.ErrClosed, Skip: 1},
+	))
+	cn := NewChestnut(store, encryptorOpt)
+	err := cn.Put(testName, key, []byte(testValue))
+	ts.ErrorIs(err, storage.ErrReadOnly)
+	err = cn.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	val, err := cn.Get(testName, key)
+	ts.NoError(err)
+	ts.Equal(testValue, string(val))
+	_, err = cn.Get(testName, key)
+	ts.ErrorIs(err, storage.ErrClosed)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_Compact() {
+	for i := 0; i < 100; i++ {
+		err := ts.cn.Put(testName, []byte("overwritten"), []byte(lorumIpsum))
+		ts.NoError(err)
+	}
+	err := ts.cn.Compact()
+	ts.NoError(err)
+	val, err := ts.cn.Get(testName, []byte("overwritten"))
+	ts.NoError(err)
+	ts.Equal(lorumIpsum, string(val))
+	cn := NewChestnut(memory.NewStore(), encryptorOpt)
+	err = cn.Compact()
+	ts.ErrorIs(err, storage.ErrNotSupported)
+	ts.Panics(func() {
+		NewChestnut(memory.NewStore(), encryptorOpt, WithAutoCompaction(time.Second, 0.5))
+	})
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_AutoCompaction() {
+	store := ts.storeFunc(ts.T(), ts.T().TempDir())
+	cn := NewChestnut(store, encryptorOpt, WithAutoCompaction(10*time.Millisecond, 0))
+	err := cn.Open()
+	ts.NoError(err)
+	for i := 0; i < 20; i++ {
+		err = cn.Put(testName, []byte("overwritten"), []byte(lorumIpsum))
+		ts.NoError(err)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	val, err := cn.Get(testName, []byte("overwritten"))
+	ts.NoError(err)
+	ts.Equal(lorumIpsum, string(val))
+	err = cn.Close()
+	ts.NoError(err)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_Backup() {
+	key := []byte(newKey())
+	err := ts.cn.Put(testName, key, []byte(testValue))
+	ts.NoError(err)
+	dir := ts.T().TempDir()
+	var mu sync.Mutex
+	var paths []string
+	hook := func(path string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ts.NoError(err)
+		paths = append(paths, path)
+	}
+	cn := NewChestnut(ts.cn.store, encryptorOpt,
+		WithBackupSchedule(dir, 0, BackupRetention{Last: 2}),
+		WithBackupHook(hook))
+	for i := 0; i < 3; i++ {
+		_, err = cn.Backup()
+		ts.NoError(err)
+	}
+	ts.Len(paths, 3)
+	backups, err := listBackups(dir)
+	ts.NoError(err)
+	// only the last two backups are kept
+	ts.Len(backups, 2)
+	ts.Equal(paths[2], backups[0].path)
+	ts.Equal(paths[1], backups[1].path)
+	entries, err := os.ReadDir(dir)
+	ts.NoError(err)
+	ts.Len(entries, 2)
+	for _, b := range backups {
+		ts.NoError(storage.VerifyArchive(b.path))
+	}
+	// backups without a directory are not allowed
+	_, err = ts.cn.Backup()
+	ts.Error(err)
+	ts.Panics(func() {
+		NewChestnut(ts.cn.store, encryptorOpt, WithBackupSchedule("", time.Second, BackupRetention{}))
+	})
+	ts.Panics(func() {
+		NewChestnut(ts.cn.store, encryptorOpt, WithBackupSchedule(dir, time.Second, BackupRetention{Last: -1}))
+	})
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_ScheduledBackups() {
+	store := ts.storeFunc(ts.T(), ts.T().TempDir())
+	dir := ts.T().TempDir()
+	secret := crypto.TextSecret("i-am-a-backup-secret")
+	var mu sync.Mutex
+	var paths []string
+	cn := NewChestnut(store, encryptorOpt, WithExportSecret(secret),
+		WithBackupSchedule(dir, 10*time.Millisecond, BackupRetention{}),
+		WithBackupHook(func(path string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ts.NoError(err)
+			paths = append(paths, path)
+		}))
+	err := cn.Open()
+	ts.NoError(err)
+	err = cn.Put(testName, []byte("key"), []byte(testValue))
+	ts.NoError(err)
+	time.Sleep(100 * time.Millisecond)
+	err = cn.Close()
+	ts.NoError(err)
+	mu.Lock()
+	defer mu.Unlock()
+	ts.NotEmpty(paths)
+	for _, path := range paths {
+		ts.True(strings.HasSuffix(path, ".arc"), path)
+		ts.NoError(archive.Verify(path, secret))
+	}
+}
+
+func TestRetainBackups(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var backups []backup
+	// a backup every 6 hours for four weeks, most recent first
+	for i := 4*7*4 - 1; i >= 0; i-- {
+		t := start.Add(time.Duration(i) * 6 * time.Hour)
+		backups = append(backups, backup{path: t.Format(backupTimeFormat), time: t})
+	}
+	keep := retainBackups(backups, BackupRetention{Last: 3})
+	assert.Len(t, keep, 3)
+	keep = retainBackups(backups, BackupRetention{Daily: 2})
+	assert.Len(t, keep, 2)
+	assert.True(t, keep[backups[0].path])
+	// the most recent backup of the previous day
+	assert.True(t, keep[backups[4].path])
+	keep = retainBackups(backups, BackupRetention{Last: 2, Daily: 3, Weekly: 10})
+	// 2024-01-01 is a monday, so the backups span 4 ISO weeks
+	assert.Len(t, keep, 2+2+4-1)
+	// the most recent backup of the first week, 7 days of 4 backups
+	assert.True(t, keep[backups[len(backups)-7*4].path])
+	assert.Len(t, retainBackups(nil, BackupRetention{Last: 1, Daily: 1, Weekly: 1}), 0)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_Stats() {
+	const statsName = "stats-namespace"
+	for _, key := range []string{"a", "b", "c"} {
+		err := ts.cn.Put(statsName, []byte(key), []byte(testValue))
+		ts.NoError(err)
+	}
+	count, err := ts.cn.Count(statsName)
+	ts.NoError(err)
+	ts.Equal(int64(3), count)
+	_, err = ts.cn.Count("not-found")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	stats, err := ts.cn.Stats()
+	ts.NoError(err)
+	ns := stats.Namespaces[statsName]
+	ts.Equal(int64(3), ns.Keys)
+	// the stored values are encrypted, so they are larger than the plaintext
+	ts.Greater(ns.AverageValueSize(), float64(len(testValue)))
+	ts.GreaterOrEqual(stats.Keys, ns.Keys)
+}
+
+func (ts *ChestnutTestSuite) TestChestnut_Namespaces() {
+	const tenant = "tenant-namespace"
+	for _, key := range []string{"a", "b"} {
+		err := ts.cn.Put(tenant, []byte(key), []byte(testValue))
+		ts.NoError(err)
+	}
+	err := ts.cn.CopyNamespace(tenant, tenant+"-copy")
+	ts.NoError(err)
+	err = ts.cn.RenameNamespace(tenant+"-copy", tenant+"-moved")
+	ts.NoError(err)
+	// the moved values are still encrypted with the same secret
+	v, err := ts.cn.Get(tenant+"-moved", []byte("a"))
+	ts.NoError(err)
+	ts.Equal([]byte(testValue), v)
+	err = ts.cn.RenameNamespace(tenant, tenant+"-moved")
+	ts.ErrorIs(err, storage.ErrNamespaceExists)
+	names, err := ts.cn.ListNamespaces()
+	ts.NoError(err)
+	ts.Contains(names, tenant)
+	ts.Contains(names, tenant+"-moved")
+	ts.NotContains(names, tenant+"-copy")
+	for _, name := range []string{tenant, tenant + "-moved"} {
+		err = ts.cn.DropNamespace(name)
+		ts.NoError(err)
+		has, err := ts.cn.Has(name, []byte("a"))
+		ts.NoError(err)
+		ts.False(has)
+	}
+	err = ts.cn.DropNamespace(tenant)
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+}
+
 func (ts *ChestnutTestSuite) TestChestnut_OpenErr() {
 	cn := &Chestnut{}
 	err := cn.Open()
@@ -645,6 +997,11 @@ func (ts *ChestnutTestSuite) TestChestnut_BadConfig() {
 	ts.Panics(func() {
 		_ = NewChestnut(store, encryptorOpt, WithCompressors(nil, compress.PassthroughDecompressor))
 	})
+	for _, threshold := range []float64{-0.1, 1.1, math.NaN()} {
+		ts.Panics(func() {
+			_ = NewChestnut(store, encryptorOpt, WithAutoCompaction(time.Second, threshold))
+		}, "threshold %v", threshold)
+	}
 }
 
 type badEncryptor struct{}
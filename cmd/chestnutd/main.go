@@ -0,0 +1,160 @@
+// Command chestnutd serves an encrypted chestnut storage chest over an
+// authenticated HTTP/JSON api.
+//
+//	$ CHESTNUT_SECRET=i-am-a-good-secret chestnutd -store bolt -path ./chest \
+//	    -tokens tokens.json -tls-cert cert.pem -tls-key key.pem
+//
+// The tokens file is a JSON list of tokens and the namespaces they may access:
+//
+//	[
+//	  {"token": "admin-token", "namespaces": ["*"]},
+//	  {"token": "svc-token", "namespaces": ["svc"], "read_only": true}
+//	]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut"
+	"git.tcp.direct/kayos/chestnut/encryptor/aes"
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/server"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/bolt"
+	"git.tcp.direct/kayos/chestnut/storage/nuts"
+)
+
+const secretEnv = "CHESTNUT_SECRET"
+
+func main() {
+	var (
+		addr       = flag.String("addr", "127.0.0.1:7373", "address to listen on")
+		storeType  = flag.String("store", "bolt", "backing store: bolt or nuts")
+		path       = flag.String("path", "", "path to the backing store")
+		tokensFile = flag.String("tokens", "", "path to the JSON tokens file")
+		secretFile = flag.String("secret-file", "", "path to a file containing the chest secret (default $"+secretEnv+")")
+		certFile   = flag.String("tls-cert", "", "path to the tls certificate")
+		keyFile    = flag.String("tls-key", "", "path to the tls key")
+		timeout    = flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for requests to finish on shutdown")
+		level      = flag.String("log-level", "info", "log level: debug, info, warn, error")
+	)
+	flag.Parse()
+	if err := run(*addr, *storeType, *path, *tokensFile, *secretFile,
+		*certFile, *keyFile, *timeout, *level); err != nil {
+		fmt.Fprintf(os.Stderr, "chestnutd: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(addr, storeType, path, tokensFile, secretFile, certFile, keyFile string,
+	timeout time.Duration, level string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger := log.NewZerologLoggerWithLevel(lvl)
+	if path == "" {
+		return fmt.Errorf("store path required")
+	}
+	var store storage.Storage
+	switch strings.ToLower(storeType) {
+	case "bolt":
+		store = bolt.NewStore(path, storage.WithLogger(logger))
+	case "nuts", "nutsdb":
+		store = nuts.NewStore(path, storage.WithLogger(logger))
+	default:
+		return fmt.Errorf("unsupported store: %s", storeType)
+	}
+	secret, err := loadSecret(secretFile)
+	if err != nil {
+		return err
+	}
+	tokens, err := loadTokens(tokensFile)
+	if err != nil {
+		return err
+	}
+	cn := chestnut.NewChestnut(store,
+		chestnut.WithAES(crypto.Key256, aes.CTR, secret),
+		chestnut.WithLogger(logger))
+	if err = cn.Open(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = cn.Close()
+	}()
+	opts := []server.Option{
+		server.WithAddr(addr),
+		server.WithTokens(tokens...),
+		server.WithShutdownTimeout(timeout),
+		server.WithLogger(logger),
+	}
+	if certFile != "" || keyFile != "" {
+		opts = append(opts, server.WithTLS(certFile, keyFile))
+	}
+	srv := server.NewServer(cn, opts...)
+	if err = srv.Start(); err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		logger.Infof("received %s", s)
+	case <-srv.Done():
+	}
+	return srv.Close()
+}
+
+func loadSecret(path string) (crypto.Secret, error) {
+	secret := os.Getenv(secretEnv)
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("secret required: use -secret-file or $%s", secretEnv)
+	}
+	return crypto.TextSecret(secret), nil
+}
+
+func loadTokens(path string) ([]server.Token, error) {
+	if path == "" {
+		return nil, fmt.Errorf("tokens file required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []server.Token
+	if err = jsoniter.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("tokens file: %w", err)
+	}
+	return tokens, nil
+}
+
+func parseLevel(level string) (log.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return log.DebugLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "warn":
+		return log.WarnLevel, nil
+	case "error":
+		return log.ErrorLevel, nil
+	default:
+		return log.InfoLevel, fmt.Errorf("unknown log level: %s", level)
+	}
+}
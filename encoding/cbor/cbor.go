@@ -0,0 +1,27 @@
+package cbor
+
+import (
+	"github.com/fxamacker/cbor/v2"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// Concise Binary Object Representation serialization
+// https://cbor.io/
+
+// Serializer serializes values as CBOR.
+var Serializer storage.Serializer = serializer{}
+
+type serializer struct{}
+
+func (serializer) Name() string {
+	return "cbor"
+}
+
+func (serializer) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (serializer) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
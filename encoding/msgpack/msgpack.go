@@ -0,0 +1,27 @@
+package msgpack
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// MessagePack serialization
+// https://msgpack.org/
+
+// Serializer serializes values as MessagePack.
+var Serializer storage.Serializer = serializer{}
+
+type serializer struct{}
+
+func (serializer) Name() string {
+	return "msgpack"
+}
+
+func (serializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (serializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
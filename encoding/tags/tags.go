@@ -1,6 +1,9 @@
 package tags
 
-import "strings"
+import (
+	"reflect"
+	"strings"
+)
 
 const (
 	// TODO: Add support for chestnut & gorm struct field tags
@@ -81,3 +84,43 @@ func HashName(opts []string) Hash {
 func IsSecure(opts []string) bool {
 	return HasOption(opts, SecureOption)
 }
+
+// OptionField returns the name of the first struct field with the secure or
+// hash option in its JSON tag, in typ or in the types typ contains, such as
+// the elements of its slices and maps, and the types of its fields.
+func OptionField(typ reflect.Type) (string, bool) {
+	return optionField(typ, map[reflect.Type]bool{})
+}
+
+func optionField(typ reflect.Type, seen map[reflect.Type]bool) (string, bool) {
+	if typ == nil || seen[typ] {
+		return "", false
+	}
+	seen[typ] = true
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return optionField(typ.Elem(), seen)
+	case reflect.Map:
+		if name, ok := optionField(typ.Key(), seen); ok {
+			return name, ok
+		}
+		return optionField(typ.Elem(), seen)
+	case reflect.Struct:
+	default:
+		return "", false
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, opts := ParseJSONTag(field.Tag.Get(JSONTag))
+		if IgnoreField(name) {
+			continue
+		}
+		if IsSecure(opts) || HashName(opts) != HashNone {
+			return typ.String() + "." + field.Name, true
+		}
+		if name, ok := optionField(field.Type, seen); ok {
+			return name, ok
+		}
+	}
+	return "", false
+}
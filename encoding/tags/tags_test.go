@@ -1,6 +1,7 @@
 package tags
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -103,3 +104,45 @@ func TestIsSecure(t *testing.T) {
 		assert.Equal(t, test.is, is)
 	}
 }
+
+func TestOptionField(t *testing.T) {
+	type plain struct {
+		A string `json:"a"`
+		B int
+	}
+	type secure struct {
+		A string `json:"a,secure"`
+	}
+	type hashed struct {
+		A string `json:"a,hash"`
+	}
+	type ignored struct {
+		A string `json:"-,secure"`
+	}
+	type nested struct {
+		P plain
+		S []map[string]*hashed
+	}
+	type cyclic struct {
+		Next *cyclic
+		P    plain
+	}
+	tests := []struct {
+		v     interface{}
+		field string
+	}{
+		{"", ""},
+		{&plain{}, ""},
+		{&ignored{}, ""},
+		{&cyclic{}, ""},
+		{secure{}, "tags.secure.A"},
+		{&hashed{}, "tags.hashed.A"},
+		{&nested{}, "tags.hashed.A"},
+		{map[string]secure{}, "tags.secure.A"},
+	}
+	for _, test := range tests {
+		field, ok := OptionField(reflect.TypeOf(test.v))
+		assert.Equal(t, test.field != "", ok)
+		assert.Equal(t, test.field, field)
+	}
+}
@@ -0,0 +1,141 @@
+// Package chacha provides ChaCha20-Poly1305 and XChaCha20-Poly1305
+// authenticated encryption, which is fast on hardware without AES
+// instructions. The XChaCha20 variant uses random 192-bit nonces,
+// which are safe to generate for every encryption.
+package chacha
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+)
+
+// supported ciphers and the mode of both ciphers
+const (
+	ChaCha20  = "chacha20"
+	XChaCha20 = "xchacha20"
+
+	Poly1305 crypto.Mode = "poly1305"
+)
+
+// Encryptor is an encryptor that supports ChaCha20-Poly1305
+// and XChaCha20-Poly1305 with 256 bit keys.
+type Encryptor struct {
+	secret crypto.Secret
+	cipher string
+}
+
+var _ crypto.Encryptor = (*Encryptor)(nil)
+
+// NewEncryptor returns a new ChaCha20-Poly1305 Encryptor for
+// a secret. It uses random 96-bit nonces, SEE: NewXEncryptor.
+func NewEncryptor(secret crypto.Secret) *Encryptor {
+	return &Encryptor{secret: secret, cipher: ChaCha20}
+}
+
+// NewXEncryptor returns a new XChaCha20-Poly1305 Encryptor for a secret.
+func NewXEncryptor(secret crypto.Secret) *Encryptor {
+	return &Encryptor{secret: secret, cipher: XChaCha20}
+}
+
+// ID returns the id of the encryptor (secret) that
+// was used to encrypt the data (for tracking).
+func (e *Encryptor) ID() string {
+	return e.secret.ID()
+}
+
+// Name returns the name of the configured cipher
+// e.g. "chacha20-poly1305" or "xchacha20-poly1305".
+func (e *Encryptor) Name() string {
+	return fmt.Sprintf("%s-%s", e.cipher, Poly1305)
+}
+
+// Encrypt returns the plain data encrypted with the configured cipher and secret.
+func (e *Encryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	if len(plaintext) <= 0 {
+		return nil, errors.New("invalid plain data")
+	}
+	nonceSize, err := e.nonceSize()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := crypto.MakeSalt()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := crypto.MakeRand(uint(nonceSize))
+	if err != nil {
+		return nil, err
+	}
+	header, err := crypto.NewHeader(e.cipher, crypto.Key256, Poly1305, salt, nil, nonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.newAEAD(header.Salt)
+	if err != nil {
+		return nil, err
+	}
+	// encode the encrypted data and return the result
+	data := crypto.NewData(header, aead.Seal(nil, header.Nonce, plaintext, nil))
+	return crypto.EncodeData(data)
+}
+
+// Decrypt returns the cipher data decrypted with the configured cipher and secret.
+func (e *Encryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) <= 0 {
+		return nil, errors.New("invalid cipher data")
+	}
+	// decode the encrypted data
+	data, err := crypto.DecodeData(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	// check the encoding
+	if err = data.Valid(); err != nil {
+		return nil, err
+	}
+	if data.Name() != crypto.CipherName(e.cipher, crypto.Key256, Poly1305) {
+		return nil, fmt.Errorf("unsupported decryption cipher: %s", data.Name())
+	}
+	aead, err := e.newAEAD(data.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	// decrypt the data
+	return aead.Open(nil, data.Nonce, data.Bytes, nil)
+}
+
+// nonceSize returns the nonce size of the configured cipher.
+func (e *Encryptor) nonceSize() (int, error) {
+	switch e.cipher {
+	case ChaCha20:
+		return chacha20poly1305.NonceSize, nil
+	case XChaCha20:
+		return chacha20poly1305.NonceSizeX, nil
+	default:
+		return 0, fmt.Errorf("unsupported cipher: %s", e.cipher)
+	}
+}
+
+// newAEAD returns the AEAD of the configured cipher with the key for salt.
+func (e *Encryptor) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := crypto.NewCipherKey(crypto.Key256, e.secret.Open(), salt)
+	if err != nil {
+		return nil, err
+	}
+	switch e.cipher {
+	case ChaCha20:
+		return chacha20poly1305.New(key)
+	case XChaCha20:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", e.cipher)
+	}
+}
@@ -0,0 +1,84 @@
+package chacha
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+)
+
+const testPlainText = "Lorem ipsum dolor sit amet"
+
+var (
+	textSecret    = crypto.TextSecret("i-am-a-good-secret")
+	managedSecret = crypto.NewManagedSecret(uuid.New().String(), "i-am-a-managed-secret")
+)
+
+func TestEncryptor(t *testing.T) {
+	encryptors := []struct {
+		name      string
+		new       func(crypto.Secret) *Encryptor
+		nonceSize int
+	}{
+		{"chacha20-poly1305", NewEncryptor, 12},
+		{"xchacha20-poly1305", NewXEncryptor, 24},
+	}
+	for _, test := range encryptors {
+		t.Run(test.name, func(t *testing.T) {
+			for _, secret := range []crypto.Secret{textSecret, managedSecret} {
+				e := test.new(secret)
+				assert.Equal(t, secret.ID(), e.ID())
+				assert.Equal(t, test.name, e.Name())
+				encrypted, err := e.Encrypt([]byte(testPlainText))
+				assert.NoError(t, err)
+				assert.NotEmpty(t, encrypted)
+				data, err := crypto.DecodeData(encrypted)
+				assert.NoError(t, err)
+				assert.Equal(t, crypto.KeyLen(crypto.Key256), data.KeyLen)
+				assert.Equal(t, Poly1305, data.Mode)
+				assert.Len(t, data.Nonce, test.nonceSize)
+				decrypted, err := e.Decrypt(encrypted)
+				assert.NoError(t, err)
+				assert.Equal(t, testPlainText, string(decrypted))
+				// every encryption uses a new nonce
+				again, err := e.Encrypt([]byte(testPlainText))
+				assert.NoError(t, err)
+				assert.NotEqual(t, encrypted, again)
+			}
+			e := test.new(textSecret)
+			_, err := e.Encrypt(nil)
+			assert.Error(t, err)
+			for _, bd := range [][]byte{nil, []byte(""), []byte("bad")} {
+				_, err = e.Decrypt(bd)
+				assert.Error(t, err)
+			}
+			// the data is authenticated
+			encrypted, err := e.Encrypt([]byte(testPlainText))
+			assert.NoError(t, err)
+			data, err := crypto.DecodeData(encrypted)
+			assert.NoError(t, err)
+			data.Bytes[0] ^= 0xff
+			tampered, err := crypto.EncodeData(data)
+			assert.NoError(t, err)
+			_, err = e.Decrypt(tampered)
+			assert.Error(t, err)
+			_, err = test.new(crypto.TextSecret("i-am-the-wrong-secret")).Decrypt(encrypted)
+			assert.Error(t, err)
+		})
+	}
+	// the ciphers can't decrypt each other's data
+	encrypted, err := NewEncryptor(textSecret).Encrypt([]byte(testPlainText))
+	assert.NoError(t, err)
+	_, err = NewXEncryptor(textSecret).Decrypt(encrypted)
+	assert.Error(t, err)
+	// an invalid nonce is an error, not a panic
+	data, err := crypto.DecodeData(encrypted)
+	assert.NoError(t, err)
+	data.Nonce = append(data.Nonce, 0)
+	invalid, err := crypto.EncodeData(data)
+	assert.NoError(t, err)
+	_, err = NewEncryptor(textSecret).Decrypt(invalid)
+	assert.Error(t, err)
+}
@@ -82,8 +82,10 @@ func (ks *Keystore) Put(s string, key ci.PrivKey) error {
 // exists, and returns ErrNoSuchKey otherwise.
 func (ks *Keystore) Get(s string) (ci.PrivKey, error) {
 	data, err := ks.cn.Get(namespace, []byte(s))
-	if err != nil {
+	if errors.Is(err, storage.ErrNotFound) {
 		return nil, keystore.ErrNoSuchKey
+	} else if err != nil {
+		return nil, err
 	}
 	return ci.UnmarshalPrivateKey(data)
 }
@@ -1,10 +1,14 @@
 package chestnut
 
 import (
+	"time"
+
 	"git.tcp.direct/kayos/chestnut/encoding/compress"
 	"git.tcp.direct/kayos/chestnut/encryptor"
+	"git.tcp.direct/kayos/chestnut/encryptor/chacha"
 	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
 	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
 )
 
 // ChestOptions provides a default implementation for common options for a secure store.
@@ -20,7 +24,21 @@ type ChestOptions struct {
 	// if Overwrite is false, overwrite are disabled and successive calls to save data
 	// 	with the same key will fail with an error. The existing data will not be overwritten.
 	overwrites bool
-	log        log.Logger
+	// exportSecret encrypts exports into archives, SEE: WithExportSecret.
+	exportSecret crypto.Secret
+	// serializer encodes the values of Save and Load, SEE: WithSerializer.
+	serializer storage.Serializer
+	// compactInterval and compactThreshold schedule auto-compaction,
+	// SEE: WithAutoCompaction.
+	compactInterval  time.Duration
+	compactThreshold float64
+	// backupDir, backupInterval and backupRetention schedule backups,
+	// SEE: WithBackupSchedule.
+	backupDir       string
+	backupInterval  time.Duration
+	backupRetention BackupRetention
+	backupHooks     []BackupHook
+	log             log.Logger
 }
 
 // DefaultChestOptions represents the recommended default ChestOptions for a store.
@@ -113,6 +131,12 @@ func WithAES(keyLen crypto.KeyLen, mode crypto.Mode, secret crypto.Secret) Chest
 	return WithEncryptor(encryptor.NewAESEncryptor(keyLen, mode, secret))
 }
 
+// WithChaCha is a convenience that returns a ChestOption which sets the
+// encryptor to be an XChaCha20-Poly1305 encryptor initialized with a Secret.
+func WithChaCha(secret crypto.Secret) ChestOption {
+	return WithEncryptor(chacha.NewXEncryptor(secret))
+}
+
 // WithCompressors instructs the storage chest to compress/decompress data with these compressor
 // functions before committing it. If this option is set, WithCompression is ignored.
 func WithCompressors(c compress.CompressorFunc, d compress.DecompressorFunc) ChestOption {
@@ -133,6 +157,19 @@ func WithCompression(format compress.Format) ChestOption {
 	})
 }
 
+// WithSerializer instructs the storage chest to encode the values of Save
+// with s, e.g. storage.Gob, msgpack.Serializer or cbor.Serializer, instead of
+// the secure JSON encoding. The encoded values are compressed and encrypted
+// like the values of Put, so Sparse is equivalent to Load. Serializers cannot
+// sparsely encrypt or hash fields, so saving a struct with secure or hash
+// tag options is an error. Values saved with the secure JSON encoding can
+// still be loaded.
+func WithSerializer(s storage.Serializer) ChestOption {
+	return newFuncOption(func(o *ChestOptions) {
+		o.serializer = s
+	})
+}
+
 // OverwritesForbidden prevents the store from overwriting existing data.
 func OverwritesForbidden() ChestOption {
 	return newFuncOption(func(o *ChestOptions) {
@@ -140,6 +177,48 @@ func OverwritesForbidden() ChestOption {
 	})
 }
 
+// WithExportSecret instructs the storage chest to write exports as encrypted
+// archives, which are encrypted with secret. The secret should not be the
+// secret used to encrypt values. Archives are restored with archive.Restore.
+func WithExportSecret(secret crypto.Secret) ChestOption {
+	return newFuncOption(func(o *ChestOptions) {
+		o.exportSecret = secret
+	})
+}
+
+// WithAutoCompaction instructs the storage chest to check the dead space of
+// the store every interval while it is open, and to compact the store once
+// the fraction of dead space is at least threshold, from 0 to 1. The store
+// must implement storage.Compactor.
+func WithAutoCompaction(interval time.Duration, threshold float64) ChestOption {
+	return newFuncOption(func(o *ChestOptions) {
+		o.compactInterval = interval
+		o.compactThreshold = threshold
+	})
+}
+
+// WithBackupSchedule instructs the storage chest to write a timestamped
+// export archive to dir every interval while it is open. Each archive is
+// verified after it is written, then the backups which are not kept by
+// retention are removed from dir. If interval is 0, backups are only
+// written by Chestnut.Backup. The archives are encrypted if an export
+// secret is set, SEE: WithExportSecret.
+func WithBackupSchedule(dir string, interval time.Duration, retention BackupRetention) ChestOption {
+	return newFuncOption(func(o *ChestOptions) {
+		o.backupDir = dir
+		o.backupInterval = interval
+		o.backupRetention = retention
+	})
+}
+
+// WithBackupHook adds a hook which is called after every backup with the
+// path of the archive, and the error if the backup failed.
+func WithBackupHook(hook BackupHook) ChestOption {
+	return newFuncOption(func(o *ChestOptions) {
+		o.backupHooks = append(o.backupHooks, hook)
+	})
+}
+
 // WithLogger returns a StoreOption which sets the logger to use for the encrypted store.
 func WithLogger(l log.Logger) ChestOption {
 	return newFuncOption(func(o *ChestOptions) {
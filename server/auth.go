@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AllNamespaces authorizes a token for every namespace in the chest.
+const AllNamespaces = "*"
+
+// Token is a bearer token that grants access to namespaces in the chest.
+type Token struct {
+	// Secret is the bearer token presented by the client.
+	Secret string `json:"token"`
+	// Namespaces the token is authorized for. A list containing
+	// AllNamespaces authorizes all namespaces. A token must be
+	// authorized for at least one namespace.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ReadOnly prevents the token from being used to put or delete keys.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// Valid returns an error if the Token is not valid.
+func (t Token) Valid() error {
+	if t.Secret == "" {
+		return errors.New("token secret required")
+	}
+	if len(t.Namespaces) <= 0 {
+		return errors.New("token namespaces required, use AllNamespaces for full access")
+	}
+	for _, ns := range t.Namespaces {
+		if ns == "" {
+			return errors.New("token namespace cannot be empty")
+		}
+	}
+	return nil
+}
+
+// Authorized returns true if the token may access the namespace. If
+// write is true, the token must also be allowed to modify the namespace.
+func (t Token) Authorized(namespace string, write bool) bool {
+	if write && t.ReadOnly {
+		return false
+	}
+	for _, ns := range t.Namespaces {
+		if ns == AllNamespaces || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenHash is the fixed size representation of a secret
+// that is used to compare tokens in constant time.
+type tokenHash [sha256.Size]byte
+
+func hashToken(secret string) tokenHash {
+	return sha256.Sum256([]byte(secret))
+}
+
+// authenticate returns the token matching the bearer token in the request.
+// Every configured token is compared so the time taken does not depend
+// on which (if any) of the tokens matched.
+func (s *Server) authenticate(r *http.Request) (Token, bool) {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return Token{}, false
+	}
+	sum := hashToken(strings.TrimSpace(h[len(prefix):]))
+	var (
+		found Token
+		ok    bool
+	)
+	for i, hash := range s.hashes {
+		if subtle.ConstantTimeCompare(sum[:], hash[:]) == 1 {
+			found, ok = s.opts.tokens[i], true
+		}
+	}
+	return found, ok
+}
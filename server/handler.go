@@ -0,0 +1,269 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// MaxValueSize is the largest request body the server will accept.
+const MaxValueSize = 32 << 20
+
+const (
+	apiPrefix     = "/v1/"
+	healthPath    = "/v1/health"
+	namespacesSeg = "namespaces"
+	keysSeg       = "keys"
+	sparseSeg     = "sparse"
+)
+
+// KeyList is the response body for a list request.
+type KeyList struct {
+	Namespace string   `json:"namespace"`
+	Keys      []string `json:"keys"`
+}
+
+// Value is the request body for a put request, and
+// the response body for a get or sparse request.
+type Value struct {
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key,omitempty"`
+	// Value is the plaintext value as base64 when used with put
+	// or get, or the sparsely decoded JSON value for sparse.
+	Value jsoniter.RawMessage `json:"value"`
+}
+
+// Error is the response body for a failed request.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// route is a parsed api request path.
+type route struct {
+	namespace string
+	key       string
+	sparse    bool
+}
+
+// parseRoute parses the escaped request path. Namespaces and keys are
+// path escaped individually so that they may contain a slash (e.g. "c/c").
+func parseRoute(escapedPath string) (route, bool) {
+	p := strings.TrimPrefix(escapedPath, apiPrefix)
+	if p == escapedPath {
+		return route{}, false
+	}
+	parts := strings.Split(p, "/")
+	if parts[0] != namespacesSeg || (len(parts) != 2 && len(parts) != 4) {
+		return route{}, false
+	}
+	var (
+		rt  route
+		err error
+	)
+	if rt.namespace, err = url.PathUnescape(parts[1]); err != nil || rt.namespace == "" {
+		return route{}, false
+	}
+	if len(parts) == 2 {
+		return rt, true
+	}
+	switch parts[2] {
+	case keysSeg:
+		break
+	case sparseSeg:
+		rt.sparse = true
+	default:
+		return route{}, false
+	}
+	if rt.key, err = url.PathUnescape(parts[3]); err != nil || rt.key == "" {
+		return route{}, false
+	}
+	return rt, true
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(apiPrefix, s.serveAPI)
+	return mux
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	rt, ok := parseRoute(r.URL.EscapedPath())
+	if !ok {
+		s.writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	write := r.Method == http.MethodPut || r.Method == http.MethodDelete
+	token, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chestnut"`)
+		s.writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	if !token.Authorized(rt.namespace, write) {
+		s.log.Warnf("token not authorized for %s %s", r.Method, rt.namespace)
+		s.writeError(w, http.StatusForbidden, errors.New("forbidden"))
+		return
+	}
+	switch {
+	case rt.key == "" && r.Method == http.MethodGet:
+		s.list(w, rt)
+	case rt.key == "":
+		s.methodNotAllowed(w, http.MethodGet)
+	case rt.sparse && r.Method == http.MethodGet:
+		s.sparse(w, rt)
+	case rt.sparse:
+		s.methodNotAllowed(w, http.MethodGet)
+	case r.Method == http.MethodGet:
+		s.get(w, rt)
+	case r.Method == http.MethodHead:
+		s.has(w, rt)
+	case r.Method == http.MethodPut:
+		s.put(w, r, rt)
+	case r.Method == http.MethodDelete:
+		s.delete(w, rt)
+	default:
+		s.methodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, rt route) {
+	keys, err := s.cn.List(rt.namespace)
+	if err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	res := KeyList{Namespace: rt.namespace, Keys: make([]string, len(keys))}
+	for i, k := range keys {
+		res.Keys[i] = string(k)
+	}
+	s.writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) get(w http.ResponseWriter, rt route) {
+	plaintext, err := s.cn.Get(rt.namespace, []byte(rt.key))
+	if err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	b, err := jsoniter.Marshal(plaintext)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, Value{rt.namespace, rt.key, b})
+}
+
+func (s *Server) sparse(w http.ResponseWriter, rt route) {
+	var v interface{}
+	if err := s.cn.Sparse(rt.namespace, []byte(rt.key), &v); err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, Value{rt.namespace, rt.key, b})
+}
+
+func (s *Server) has(w http.ResponseWriter, rt route) {
+	has, err := s.cn.Has(rt.namespace, []byte(rt.key))
+	if err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	if !has {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, rt route) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxValueSize))
+	if err != nil {
+		s.writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var (
+		req       Value
+		plaintext []byte
+	)
+	if err = jsoniter.Unmarshal(body, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = jsoniter.Unmarshal(req.Value, &plaintext); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(plaintext) <= 0 {
+		s.writeError(w, http.StatusBadRequest, errors.New("value cannot be empty"))
+		return
+	}
+	if err = s.cn.Put(rt.namespace, []byte(rt.key), plaintext); err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delete(w http.ResponseWriter, rt route) {
+	if err := s.cn.Delete(rt.namespace, []byte(rt.key)); err != nil {
+		s.writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+// writeStoreError maps an error returned by the chest to a status code.
+func (s *Server) writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrInvalidKey):
+		status = http.StatusBadRequest
+	case errors.Is(err, storage.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, chestnut.ErrForbidden):
+		status = http.StatusConflict
+	case errors.Is(err, storage.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, storage.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+	s.writeError(w, status, err)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	s.writeJSON(w, status, Error{err.Error()})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		s.log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(b); err != nil {
+		s.log.Warnf("write response: %s", err)
+	}
+}
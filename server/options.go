@@ -0,0 +1,113 @@
+package server
+
+import (
+	"time"
+
+	"git.tcp.direct/kayos/chestnut/log"
+)
+
+// Options provides the configuration for a chestnut server.
+type Options struct {
+	addr            string
+	certFile        string
+	keyFile         string
+	tokens          []Token
+	shutdownTimeout time.Duration
+	log             log.Logger
+}
+
+// DefaultOptions represents the recommended default Options for a server.
+var DefaultOptions = Options{
+	addr:            "127.0.0.1:7373",
+	shutdownTimeout: 30 * time.Second,
+	log:             log.Log,
+}
+
+// An Option sets options such as the listen address, tokens, and tls, etc.
+type Option interface {
+	apply(*Options)
+}
+
+// EmptyOption does not alter the server configuration.
+// It can be embedded in another structure to build custom options.
+type EmptyOption struct{}
+
+func (EmptyOption) apply(*Options) {}
+
+// funcOption wraps a function that modifies Options
+// into an implementation of the Option interface.
+type funcOption struct {
+	f func(*Options)
+}
+
+// apply applies an Option to Options.
+func (fdo *funcOption) apply(do *Options) {
+	fdo.f(do)
+}
+
+func newFuncOption(f func(*Options)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// applyOptions accepts an Options struct and applies the Option(s) to it.
+func applyOptions(opts Options, opt ...Option) Options {
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	return opts
+}
+
+// WithAddr returns an Option which sets the address the server listens on.
+// Use a port of 0 (e.g. "127.0.0.1:0") to listen on a random loopback port.
+func WithAddr(addr string) Option {
+	return newFuncOption(func(o *Options) {
+		o.addr = addr
+	})
+}
+
+// WithTLS returns an Option which serves the api over tls using the
+// certificate and key files at certFile and keyFile.
+func WithTLS(certFile, keyFile string) Option {
+	return newFuncOption(func(o *Options) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	})
+}
+
+// WithTokens returns an Option which adds bearer tokens the server will accept.
+func WithTokens(tokens ...Token) Option {
+	return newFuncOption(func(o *Options) {
+		o.tokens = append(o.tokens, tokens...)
+	})
+}
+
+// WithToken is a convenience that returns an Option for a read/write
+// token that is authorized for the namespaces. Use AllNamespaces to
+// authorize the token for all namespaces.
+func WithToken(secret string, namespaces ...string) Option {
+	return WithTokens(Token{Secret: secret, Namespaces: namespaces})
+}
+
+// WithReadOnlyToken is a convenience that returns an Option for a read
+// only token that is authorized for the namespaces. Use AllNamespaces
+// to authorize the token for all namespaces.
+func WithReadOnlyToken(secret string, namespaces ...string) Option {
+	return WithTokens(Token{Secret: secret, Namespaces: namespaces, ReadOnly: true})
+}
+
+// WithShutdownTimeout returns an Option which sets how long Close will wait
+// for in-flight requests to finish before forcibly closing connections.
+func WithShutdownTimeout(d time.Duration) Option {
+	return newFuncOption(func(o *Options) {
+		o.shutdownTimeout = d
+	})
+}
+
+// WithLogger returns an Option which sets the logger to use for the server.
+func WithLogger(l log.Logger) Option {
+	return newFuncOption(func(o *Options) {
+		o.log = l
+	})
+}
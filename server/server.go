@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.tcp.direct/kayos/chestnut"
+	"git.tcp.direct/kayos/chestnut/log"
+)
+
+const logName = "server"
+
+// Server exposes a Chestnut storage chest over an authenticated HTTP/JSON api.
+// The server does not own the chest, it is up to the caller to open the chest
+// before the server is started and close it after the server is shut down.
+type Server struct {
+	opts    Options
+	cn      *chestnut.Chestnut
+	hashes  []tokenHash
+	handler http.Handler
+	log     log.Logger
+
+	mu   sync.Mutex
+	srv  *http.Server
+	ln   net.Listener
+	done chan struct{}
+	err  error
+}
+
+// NewServer is used to create a new chestnut server for the chest.
+func NewServer(cn *chestnut.Chestnut, opt ...Option) *Server {
+	opts := applyOptions(DefaultOptions, opt...)
+	logger := log.Named(opts.log, logName)
+	s := &Server{opts: opts, cn: cn, log: logger}
+	if err := s.validConfig(); err != nil {
+		logger.Panic(err)
+		return nil
+	}
+	s.hashes = make([]tokenHash, len(opts.tokens))
+	for i, t := range opts.tokens {
+		s.hashes[i] = hashToken(t.Secret)
+	}
+	s.handler = s.routes()
+	return s
+}
+
+func (s *Server) validConfig() error {
+	if s.cn == nil {
+		return errors.New("chest required")
+	}
+	if s.opts.addr == "" {
+		return errors.New("listen address required")
+	}
+	if len(s.opts.tokens) <= 0 {
+		return errors.New("at least one token is required")
+	}
+	for _, t := range s.opts.tokens {
+		if err := t.Valid(); err != nil {
+			return err
+		}
+	}
+	if (s.opts.certFile == "") != (s.opts.keyFile == "") {
+		return errors.New("tls requires both a certificate and a key")
+	}
+	return nil
+}
+
+// Handler returns the http.Handler that serves the api.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Start listens on the configured address and serves the api in the
+// background. Start returns once the server is accepting connections.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv != nil {
+		return s.logError("start", errors.New("server already started"))
+	}
+	ln, err := net.Listen("tcp", s.opts.addr)
+	if err != nil {
+		return s.logError("start", err)
+	}
+	srv := &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.opts.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.opts.certFile, s.opts.keyFile)
+		if err != nil {
+			_ = ln.Close()
+			return s.logError("start", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+	s.srv, s.ln = srv, ln
+	s.done = make(chan struct{})
+	go s.serve(srv, ln, s.done)
+	s.log.Infof("listening on %s (tls: %t)", ln.Addr(), srv.TLSConfig != nil)
+	return nil
+}
+
+func (s *Server) serve(srv *http.Server, ln net.Listener, done chan struct{}) {
+	defer close(done)
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	s.mu.Lock()
+	s.err = s.logError("serve", err)
+	s.mu.Unlock()
+}
+
+// Addr returns the address the server is listening on, or an
+// empty string if the server has not been started.
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
+// Done returns a channel that is closed when the server stops serving.
+func (s *Server) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// Shutdown gracefully stops the server, waiting for in-flight
+// requests to complete or for ctx to be done, whichever is first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv, done := s.srv, s.done
+	s.srv, s.ln = nil, nil
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	s.log.Info("shutting down")
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		// we ran out of time, drop whatever is still connected
+		_ = srv.Close()
+	}
+	<-done
+	s.mu.Lock()
+	if err == nil {
+		err = s.err
+	}
+	s.err = nil
+	s.mu.Unlock()
+	if err != nil {
+		return s.logError("shutdown", err)
+	}
+	s.log.Info("server stopped")
+	return nil
+}
+
+// Close gracefully stops the server using the configured shutdown timeout.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.shutdownTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
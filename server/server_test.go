@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"git.tcp.direct/kayos/chestnut"
+	"git.tcp.direct/kayos/chestnut/encryptor/aes"
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage/bolt"
+)
+
+const (
+	testName      = "test-namespace"
+	otherName     = "other-namespace"
+	testValue     = "i-am-plaintext"
+	adminToken    = "admin-token"
+	readerToken   = "reader-token"
+	limitedToken  = "limited-token"
+	unknownToken  = "unknown-token"
+	testShutdown  = 5 * time.Second
+	contentTypeJS = "application/json"
+)
+
+type TSecure struct {
+	Value       string `json:"value"`
+	SecureValue string `json:"secure_value,secure"`
+}
+
+type ServerTestSuite struct {
+	suite.Suite
+	cn     *chestnut.Chestnut
+	srv    *Server
+	client *http.Client
+	scheme string
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
+
+func (ts *ServerTestSuite) SetupTest() {
+	ts.cn = chestnut.NewChestnut(bolt.NewStore(ts.T().TempDir()),
+		chestnut.WithAES(crypto.Key256, aes.CFB, crypto.TextSecret("i-am-a-good-secret")),
+		chestnut.WithLogger(log.NewZerologLoggerWithLevel(log.ErrorLevel)))
+	ts.Require().NoError(ts.cn.Open())
+	ts.client = http.DefaultClient
+	ts.scheme = "http"
+	ts.start()
+}
+
+func (ts *ServerTestSuite) start(opt ...Option) {
+	opts := append([]Option{
+		WithAddr("127.0.0.1:0"),
+		WithToken(adminToken, AllNamespaces),
+		WithReadOnlyToken(readerToken, AllNamespaces),
+		WithToken(limitedToken, testName),
+		WithShutdownTimeout(testShutdown),
+	}, opt...)
+	ts.srv = NewServer(ts.cn, opts...)
+	ts.Require().NotNil(ts.srv)
+	ts.Require().NoError(ts.srv.Start())
+	ts.NotEmpty(ts.srv.Addr())
+}
+
+func (ts *ServerTestSuite) TearDownTest() {
+	ts.NoError(ts.srv.Close())
+	ts.NoError(ts.cn.Close())
+}
+
+func (ts *ServerTestSuite) url(name, seg, key string) string {
+	u := fmt.Sprintf("%s://%s/v1/namespaces/%s", ts.scheme, ts.srv.Addr(), url.PathEscape(name))
+	if seg != "" {
+		u += "/" + seg + "/" + url.PathEscape(key)
+	}
+	return u
+}
+
+func (ts *ServerTestSuite) do(method, token, u string, body interface{}) (int, []byte) {
+	var r io.Reader
+	if body != nil {
+		b, err := jsoniter.Marshal(body)
+		ts.Require().NoError(err)
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	ts.Require().NoError(err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := ts.client.Do(req)
+	ts.Require().NoError(err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	ts.Require().NoError(err)
+	if len(b) > 0 {
+		ts.Equal(contentTypeJS, res.Header.Get("Content-Type"))
+	}
+	return res.StatusCode, b
+}
+
+func (ts *ServerTestSuite) put(token, name, key, value string) int {
+	v, err := jsoniter.Marshal([]byte(value))
+	ts.Require().NoError(err)
+	status, _ := ts.do(http.MethodPut, token, ts.url(name, keysSeg, key), Value{Value: v})
+	return status
+}
+
+func (ts *ServerTestSuite) TestServer_PutGet() {
+	tests := []struct {
+		key    string
+		value  string
+		status int
+	}{
+		{"a", "", http.StatusBadRequest},
+		{"b", testValue, http.StatusNoContent},
+		{"c/c", testValue, http.StatusNoContent},
+		{".d", testValue, http.StatusNoContent},
+	}
+	for i, test := range tests {
+		ts.Equal(test.status, ts.put(adminToken, testName, test.key, test.value), "%d key: %s", i, test.key)
+	}
+	for i, test := range tests {
+		status, body := ts.do(http.MethodGet, adminToken, ts.url(testName, keysSeg, test.key), nil)
+		if test.status != http.StatusNoContent {
+			ts.Equal(http.StatusNotFound, status, "%d key: %s", i, test.key)
+			continue
+		}
+		ts.Require().Equal(http.StatusOK, status, "%d key: %s", i, test.key)
+		var v Value
+		ts.NoError(jsoniter.Unmarshal(body, &v))
+		var plaintext []byte
+		ts.NoError(jsoniter.Unmarshal(v.Value, &plaintext))
+		ts.Equal(test.key, v.Key)
+		ts.Equal(test.value, string(plaintext))
+	}
+	status, _ := ts.do(http.MethodHead, adminToken, ts.url(testName, keysSeg, "b"), nil)
+	ts.Equal(http.StatusOK, status)
+	status, _ = ts.do(http.MethodHead, adminToken, ts.url(testName, keysSeg, "not-found"), nil)
+	ts.Equal(http.StatusNotFound, status)
+}
+
+func (ts *ServerTestSuite) TestServer_ListDelete() {
+	keys := []string{"a", "b", "c/c"}
+	for _, k := range keys {
+		ts.Equal(http.StatusNoContent, ts.put(adminToken, testName, k, testValue))
+	}
+	status, body := ts.do(http.MethodGet, adminToken, ts.url(testName, "", ""), nil)
+	ts.Require().Equal(http.StatusOK, status)
+	var list KeyList
+	ts.NoError(jsoniter.Unmarshal(body, &list))
+	ts.ElementsMatch(keys, list.Keys)
+	status, _ = ts.do(http.MethodDelete, adminToken, ts.url(testName, keysSeg, "b"), nil)
+	ts.Equal(http.StatusNoContent, status)
+	status, _ = ts.do(http.MethodGet, adminToken, ts.url(testName, keysSeg, "b"), nil)
+	ts.Equal(http.StatusNotFound, status)
+}
+
+func (ts *ServerTestSuite) TestServer_Sparse() {
+	src := TSecure{Value: testValue, SecureValue: testValue}
+	ts.Require().NoError(ts.cn.Save(testName, []byte("sparse"), src))
+	status, body := ts.do(http.MethodGet, readerToken, ts.url(testName, sparseSeg, "sparse"), nil)
+	ts.Require().Equal(http.StatusOK, status)
+	var v Value
+	ts.NoError(jsoniter.Unmarshal(body, &v))
+	var spr TSecure
+	ts.NoError(jsoniter.Unmarshal(v.Value, &spr))
+	ts.Equal(TSecure{Value: testValue}, spr)
+}
+
+func (ts *ServerTestSuite) TestServer_StoreErrors() {
+	// a failing store is not a missing key
+	ts.NoError(ts.cn.Close())
+	status, _ := ts.do(http.MethodHead, adminToken, ts.url(testName, keysSeg, "a"), nil)
+	ts.Equal(http.StatusServiceUnavailable, status)
+	status, _ = ts.do(http.MethodGet, adminToken, ts.url(testName, keysSeg, "a"), nil)
+	ts.Equal(http.StatusServiceUnavailable, status)
+	// overwrites are forbidden by the chest
+	ts.NoError(ts.srv.Close())
+	ts.cn = chestnut.NewChestnut(bolt.NewStore(ts.T().TempDir()),
+		chestnut.WithAES(crypto.Key256, aes.CFB, crypto.TextSecret("i-am-a-good-secret")),
+		chestnut.WithLogger(log.NewZerologLoggerWithLevel(log.ErrorLevel)),
+		chestnut.OverwritesForbidden())
+	ts.Require().NoError(ts.cn.Open())
+	ts.start()
+	ts.Equal(http.StatusNoContent, ts.put(adminToken, testName, "a", testValue))
+	ts.Equal(http.StatusConflict, ts.put(adminToken, testName, "a", testValue))
+}
+
+func (ts *ServerTestSuite) TestServer_Auth() {
+	ts.Equal(http.StatusNoContent, ts.put(adminToken, otherName, "a", testValue))
+	tests := []struct {
+		method string
+		token  string
+		name   string
+		status int
+	}{
+		{http.MethodGet, "", testName, http.StatusUnauthorized},
+		{http.MethodGet, unknownToken, testName, http.StatusUnauthorized},
+		{http.MethodPut, readerToken, testName, http.StatusForbidden},
+		{http.MethodDelete, readerToken, otherName, http.StatusForbidden},
+		{http.MethodGet, readerToken, otherName, http.StatusOK},
+		{http.MethodPut, limitedToken, testName, http.StatusNoContent},
+		{http.MethodGet, limitedToken, otherName, http.StatusForbidden},
+		{http.MethodPut, limitedToken, otherName, http.StatusForbidden},
+	}
+	v, err := jsoniter.Marshal([]byte(testValue))
+	ts.Require().NoError(err)
+	for i, test := range tests {
+		var body interface{}
+		if test.method == http.MethodPut {
+			body = Value{Value: v}
+		}
+		status, _ := ts.do(test.method, test.token, ts.url(test.name, keysSeg, "a"), body)
+		ts.Equal(test.status, status, "%d %s %s", i, test.method, test.name)
+	}
+}
+
+func (ts *ServerTestSuite) TestServer_BadRequests() {
+	base := fmt.Sprintf("%s://%s", ts.scheme, ts.srv.Addr())
+	status, _ := ts.do(http.MethodGet, adminToken, base+"/v1/nope", nil)
+	ts.Equal(http.StatusNotFound, status)
+	status, _ = ts.do(http.MethodPost, adminToken, ts.url(testName, keysSeg, "a"), nil)
+	ts.Equal(http.StatusMethodNotAllowed, status)
+	status, _ = ts.do(http.MethodGet, "", base+healthPath, nil)
+	ts.Equal(http.StatusOK, status)
+}
+
+func (ts *ServerTestSuite) TestServer_TLS() {
+	ts.NoError(ts.srv.Close())
+	cert, key, pool := writeTestCert(ts.T())
+	ts.start(WithTLS(cert, key))
+	ts.scheme = "https"
+	ts.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	ts.Equal(http.StatusNoContent, ts.put(adminToken, testName, "a", testValue))
+	status, _ := ts.do(http.MethodGet, adminToken, ts.url(testName, keysSeg, "a"), nil)
+	ts.Equal(http.StatusOK, status)
+}
+
+func (ts *ServerTestSuite) TestServer_Shutdown() {
+	done := ts.srv.Done()
+	addr := ts.srv.Addr()
+	ts.NoError(ts.srv.Close())
+	<-done
+	ts.Empty(ts.srv.Addr())
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	ts.Error(err)
+	// shutting down a stopped server is a no-op
+	ts.NoError(ts.srv.Close())
+	ts.Require().NoError(ts.srv.Start())
+}
+
+func TestToken_Authorized(t *testing.T) {
+	tests := []struct {
+		token Token
+		name  string
+		write bool
+		ok    bool
+	}{
+		{Token{Secret: adminToken, Namespaces: []string{AllNamespaces}}, testName, true, true},
+		{Token{Secret: readerToken, Namespaces: []string{AllNamespaces}, ReadOnly: true}, testName, false, true},
+		{Token{Secret: readerToken, Namespaces: []string{AllNamespaces}, ReadOnly: true}, testName, true, false},
+		{Token{Secret: limitedToken, Namespaces: []string{testName}}, testName, true, true},
+		{Token{Secret: limitedToken, Namespaces: []string{testName}}, otherName, false, false},
+		// a token without namespaces has no access
+		{Token{Secret: limitedToken}, testName, false, false},
+	}
+	for i, test := range tests {
+		assert.Equal(t, test.ok, test.token.Authorized(test.name, test.write), "%d %s", i, test.name)
+	}
+	assert.Error(t, Token{Secret: adminToken}.Valid())
+	assert.Error(t, Token{Secret: adminToken, Namespaces: []string{""}}.Valid())
+	assert.NoError(t, Token{Secret: adminToken, Namespaces: []string{AllNamespaces}}.Valid())
+}
+
+func TestNewServer_BadConfig(t *testing.T) {
+	cn := chestnut.NewChestnut(bolt.NewStore(t.TempDir()),
+		chestnut.WithAES(crypto.Key256, aes.CFB, crypto.TextSecret("i-am-a-good-secret")))
+	assert.Panics(t, func() {
+		_ = NewServer(nil, WithToken(adminToken, AllNamespaces))
+	})
+	assert.Panics(t, func() {
+		_ = NewServer(cn)
+	})
+	assert.Panics(t, func() {
+		_ = NewServer(cn, WithToken("", AllNamespaces))
+	})
+	assert.Panics(t, func() {
+		// tokens must be authorized for at least one namespace
+		_ = NewServer(cn, WithToken(adminToken))
+	})
+	assert.Panics(t, func() {
+		_ = NewServer(cn, WithToken(adminToken, AllNamespaces), WithTLS("cert.pem", ""))
+	})
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		path string
+		rt   route
+		ok   bool
+	}{
+		{"/v1/namespaces/a", route{namespace: "a"}, true},
+		{"/v1/namespaces/a/keys/b", route{namespace: "a", key: "b"}, true},
+		{"/v1/namespaces/a/keys/c%2Fc", route{namespace: "a", key: "c/c"}, true},
+		{"/v1/namespaces/a/sparse/b", route{namespace: "a", key: "b", sparse: true}, true},
+		{"/v1/namespaces/", route{}, false},
+		{"/v1/namespaces/a/keys/", route{}, false},
+		{"/v1/namespaces/a/nope/b", route{}, false},
+		{"/v1/namespaces/a/keys/b/c", route{}, false},
+		{"/v2/namespaces/a", route{}, false},
+	}
+	for _, test := range tests {
+		rt, ok := parseRoute(test.path)
+		assert.Equal(t, test.ok, ok, test.path)
+		assert.Equal(t, test.rt, rt, test.path)
+	}
+}
+
+// writeTestCert writes a self-signed loopback certificate
+// and key to a temp dir and returns their paths.
+func writeTestCert(t *testing.T) (string, string, *x509.CertPool) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chestnut"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certFile, keyFile, pool
+}
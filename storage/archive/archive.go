@@ -0,0 +1,77 @@
+// Package archive provides encrypted export archives. An archive is a
+// gzipped tarball of a store's export, encrypted with a backup secret in
+// an authenticated streaming format, so neither the data nor the names of
+// the namespaces, keys and files in the export can be read or changed
+// without the secret.
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// Export writes an encrypted export archive of store to path. The archive
+// must not exist. SEE: ExportTo.
+func Export(store storage.Storage, path string, secret crypto.Secret) (err error) {
+	if path == "" {
+		return fmt.Errorf("invalid path: %s", path)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+	if err = ExportTo(store, f, secret); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ExportTo streams an encrypted export archive of store to w. Stores which
+// are not a storage.StreamExporter are exported to a temporary directory
+// first, SEE: storage.ExportTo.
+func ExportTo(store storage.Storage, w io.Writer, secret crypto.Secret) error {
+	enc, err := NewWriter(w, secret)
+	if err != nil {
+		return err
+	}
+	if err = storage.ExportTo(store, enc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// WithSecret returns a storage.RestoreOption which decrypts an archive
+// written by Export, so a store's own Restore can restore it.
+func WithSecret(secret crypto.Secret) storage.RestoreOption {
+	return storage.WithDecrypter(func(r io.Reader) (io.Reader, error) {
+		return NewReader(r, secret)
+	})
+}
+
+// Verify authenticates every chunk of the archive at path, and checks
+// every file in it against the archive's manifest of checksums.
+func Verify(path string, secret crypto.Secret) error {
+	return storage.VerifyArchive(path, WithSecret(secret))
+}
+
+// Restore restores the export in the archive at archivePath to destPath,
+// as if the store had been exported to destPath. The whole archive is
+// verified before anything is written to destPath, and Restore fails if
+// the archive was changed, the secret is wrong, or a file in the archive
+// is outside of the export. Existing data at destPath is only replaced
+// if storage.WithOverwrite is given. SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, secret crypto.Secret, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, append(opt, WithSecret(secret))...)
+}
@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+)
+
+var testSecret = crypto.TextSecret("i-am-a-backup-secret")
+
+func TestStream(t *testing.T) {
+	// sizes around the chunk size, so the last chunk is
+	// empty, partial and full
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i)
+		}
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, testSecret)
+		assert.NoError(t, err)
+		_, err = w.Write(plain)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		sealed := buf.Bytes()
+		assert.NotContains(t, string(sealed), "\x01\x02\x03\x04\x05\x06\x07\x08")
+		r, err := NewReader(bytes.NewReader(sealed), testSecret)
+		assert.NoError(t, err)
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err, "size: %d", size)
+		assert.Equal(t, plain, got, "size: %d", size)
+		// a changed byte, wrong secret or truncated stream is rejected
+		read := func(b []byte, secret crypto.Secret) error {
+			r, err := NewReader(bytes.NewReader(b), secret)
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadAll(r)
+			return err
+		}
+		changed := append([]byte(nil), sealed...)
+		changed[len(changed)-1] ^= 1
+		assert.ErrorIs(t, read(changed, testSecret), ErrAuthentication)
+		assert.ErrorIs(t, read(sealed, crypto.TextSecret("wrong")), ErrAuthentication)
+		assert.ErrorIs(t, read(sealed[:len(sealed)-1], testSecret), storage.ErrCorrupt)
+		assert.ErrorIs(t, read(append(sealed, 0), testSecret), storage.ErrCorrupt)
+		if size > chunkSize {
+			// the last chunk flag is authenticated
+			truncated := append([]byte(nil), sealed[:headerLen+4+sealedLimit]...)
+			truncated[headerLen] |= 0x80
+			assert.ErrorIs(t, read(truncated, testSecret), ErrAuthentication)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	store := fs.NewStore(filepath.Join(dir, "store"))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("secret-namespace", []byte("secret-key"), []byte("value")))
+	path := filepath.Join(dir, "export.arc")
+	assert.NoError(t, Export(store, path, testSecret))
+	// the archive cannot be overwritten
+	assert.Error(t, Export(store, path, testSecret))
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "secret")
+	assert.NoError(t, Verify(path, testSecret))
+	assert.ErrorIs(t, Verify(path, crypto.TextSecret("wrong")), ErrAuthentication)
+	dest := filepath.Join(dir, "restored")
+	assert.NoError(t, Restore(path, dest, testSecret))
+	restored := fs.NewStore(dest)
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	v, err := restored.Get("secret-namespace", []byte("secret-key"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(v))
+	// a restore does not overwrite files
+	assert.Error(t, Restore(path, dest, testSecret))
+}
+
+func TestExport_File(t *testing.T) {
+	dir := t.TempDir()
+	store := memory.NewStore()
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("n", []byte("k"), []byte("v")))
+	path := filepath.Join(dir, "export.arc")
+	assert.NoError(t, Export(store, path, testSecret))
+	dest := filepath.Join(dir, "snapshot")
+	assert.NoError(t, Restore(path, dest, testSecret))
+	restored := memory.NewStore(memory.WithSnapshot(dest))
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	v, err := restored.Get("n", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v", string(v))
+}
+
+func TestRestore_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, entries ...*tar.Header) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		assert.NoError(t, err)
+		defer f.Close()
+		enc, err := NewWriter(f, testSecret)
+		assert.NoError(t, err)
+		gz := gzip.NewWriter(enc)
+		tw := tar.NewWriter(gz)
+		for _, hdr := range entries {
+			assert.NoError(t, tw.WriteHeader(hdr))
+			_, err = tw.Write(make([]byte, hdr.Size))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, gz.Close())
+		assert.NoError(t, enc.Close())
+		return path
+	}
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: 1}
+	}
+	tests := []string{
+		write("traversal", file("export/../../escaped")),
+		write("absolute", file("/export")),
+		write("outside", file("other/file")),
+		write("symlink", &tar.Header{Name: "export", Typeflag: tar.TypeSymlink, Linkname: "/"}),
+		// nothing is written before the invalid entry is found
+		write("late", file("export/a"), file("export/../b")),
+	}
+	for _, path := range tests {
+		dest := filepath.Join(dir, "restored")
+		err := Restore(path, dest, testSecret)
+		assert.ErrorIs(t, err, storage.ErrCorrupt, path)
+		_, err = os.Stat(dest)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped"))
+	assert.True(t, os.IsNotExist(err))
+}
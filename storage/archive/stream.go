@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// The stream is a header followed by chunks. The header is the magic, the
+// version and the salt used to derive the key from the secret. Each chunk
+// is its length as a big endian uint32, with the high bit set for the last
+// chunk, followed by up to chunkSize bytes sealed with AES256-GCM. The nonce
+// of a chunk is its sequence number and a last chunk flag, and the header is
+// authenticated with every chunk, so chunks cannot be changed, reordered,
+// dropped or added, and the stream cannot be truncated.
+const (
+	magic            = "CHESTARC"
+	version     byte = 1
+	headerLen        = len(magic) + 1 + crypto.SaltLength
+	chunkSize        = 64 << 10
+	lastChunk        = 1 << 31
+	lastNonce   byte = 1
+	sealedLimit      = chunkSize + 16
+)
+
+// ErrAuthentication is returned when a chunk of an archive cannot be
+// authenticated, because the archive was changed or the secret is wrong.
+var ErrAuthentication = errors.New("archive authentication failed")
+
+// newAEAD returns the cipher for a stream, the key is derived from secret and salt.
+func newAEAD(secret crypto.Secret, salt []byte) (cipher.AEAD, error) {
+	key, err := crypto.NewCipherKey(crypto.Key256, secret.Open(), salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for the chunk at seq.
+func chunkNonce(seq uint64, last bool) []byte {
+	nonce := make([]byte, crypto.NonceLength)
+	binary.BigEndian.PutUint64(nonce, seq)
+	if last {
+		nonce[len(nonce)-1] = lastNonce
+	}
+	return nonce
+}
+
+// writer encrypts a stream in chunks.
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	seq    uint64
+	err    error
+}
+
+// NewWriter returns a WriteCloser which encrypts the data written to it
+// with a key derived from secret, and writes the stream to w. Close must
+// be called to write the last chunk, it does not close w.
+func NewWriter(w io.Writer, secret crypto.Secret) (io.WriteCloser, error) {
+	salt, err := crypto.MakeSalt()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, headerLen)
+	header = append(header, magic...)
+	header = append(header, version)
+	header = append(header, salt...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Write encrypts p, a chunk is written each time the buffer is full.
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// a full buffer is only written once there is more data,
+		// so the last chunk is always written by Close
+		if len(w.buf) == chunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return n - len(p), w.err
+			}
+		}
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Close writes the last chunk.
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.seal(true)
+	if w.err == nil {
+		w.err = errors.New("archive writer is closed")
+		return nil
+	}
+	return w.err
+}
+
+// seal writes the buffer as a chunk.
+func (w *writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.seq, last), w.buf, w.header)
+	size := uint32(len(sealed))
+	if last {
+		size |= lastChunk
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], size)
+	if _, err := w.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.seq++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// reader decrypts a stream in chunks.
+type reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	seq    uint64
+	done   bool
+	err    error
+}
+
+// NewReader returns a Reader which decrypts the stream written by a
+// writer from NewWriter with the same secret. Each chunk is authenticated
+// before it is returned, and reading fails with ErrAuthentication if the
+// stream was changed or the secret is wrong.
+func NewReader(r io.Reader, secret crypto.Secret) (io.Reader, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, storage.WrapError(storage.ErrCorrupt, fmt.Errorf("archive header: %w", err))
+	} else if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not an archive", storage.ErrCorrupt)
+	} else if v := header[len(magic)]; v != version {
+		return nil, fmt.Errorf("%w: unsupported archive version: %d", storage.ErrCorrupt, v)
+	}
+	aead, err := newAEAD(secret, header[len(magic)+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r: r, aead: aead, header: header}, nil
+}
+
+// Read returns the decrypted data of the stream.
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) <= 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.open()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk. Once the last chunk
+// is read, open checks that the stream ends and returns io.EOF.
+func (r *reader) open() error {
+	if r.done {
+		return io.EOF
+	}
+	var prefix [4]byte
+	if _, err := io.ReadFull(r.r, prefix[:]); err == io.EOF {
+		return fmt.Errorf("%w: archive is truncated", storage.ErrCorrupt)
+	} else if err != nil {
+		return storage.WrapError(storage.ErrCorrupt, err)
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	last := size&lastChunk != 0
+	size &^= lastChunk
+	if size > sealedLimit {
+		return fmt.Errorf("%w: invalid archive chunk size: %d", storage.ErrCorrupt, size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return storage.WrapError(storage.ErrCorrupt, err)
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.seq, last), sealed, r.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrAuthentication, r.seq)
+	}
+	r.seq++
+	r.buf = plain
+	if last {
+		r.done = true
+		if n, _ := r.r.Read(make([]byte, 1)); n > 0 {
+			return fmt.Errorf("%w: data after the end of the archive", storage.ErrCorrupt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 1
+)
+
+// Kind is the kind of a backup.
+type Kind string
+
+const (
+	// Full is a backup of every entry in the store.
+	Full Kind = "full"
+	// Incremental is a backup of the entries changed since the previous backup.
+	Incremental Kind = "incremental"
+)
+
+// Info describes a backup in a manifest.
+type Info struct {
+	// ID is the position of the backup in the manifest, starting at 1.
+	ID int `json:"id"`
+	// Kind is the kind of backup.
+	Kind Kind `json:"kind"`
+	// Seq is the sequence number of the last change in the backup.
+	Seq uint64 `json:"seq"`
+	// Since is the sequence number of the previous backup in the
+	// chain of an incremental backup.
+	Since uint64 `json:"since,omitempty"`
+	// Time is when the backup was taken.
+	Time time.Time `json:"time"`
+	// File is the name of the backup file in the backup directory.
+	File string `json:"file"`
+	// Puts is the number of entries in the backup.
+	Puts int `json:"puts"`
+	// Deletes is the number of deleted keys in the backup.
+	Deletes int `json:"deletes"`
+}
+
+// Manifest lists the backups in a backup directory, oldest first. Each
+// full backup starts a chain which is followed by its incremental backups.
+type Manifest struct {
+	Version int    `json:"version"`
+	Backups []Info `json:"backups"`
+}
+
+// record is an entry, or a deleted key, in a backup file.
+type record struct {
+	Op        string `json:"op"`
+	Namespace string `json:"namespace"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+const (
+	recordPut    = "put"
+	recordDelete = "delete"
+)
+
+// ReadManifest returns the manifest of the backups in dir. If dir has no
+// backups the manifest is empty.
+func ReadManifest(dir string) (Manifest, error) {
+	m := Manifest{Version: manifestVersion}
+	b, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	if err = jsoniter.Unmarshal(b, &m); err != nil {
+		return m, storage.WrapError(storage.ErrCorrupt, err)
+	} else if m.Version != manifestVersion {
+		err = fmt.Errorf("%w: unsupported manifest version: %d", storage.ErrCorrupt, m.Version)
+		return m, err
+	}
+	return m, nil
+}
+
+// Backup writes a backup of the store to the backup directory dir. If dir
+// has a backup of the store, the backup is incremental and only has the
+// entries changed since the last backup, otherwise it is a full backup.
+// Writes wait while the backup is taken, so it is a consistent copy of the
+// store. Once the backup is recorded in the manifest, the journal entries
+// it covers are removed.
+func (t *Tracker) Backup(dir string) (Info, error) {
+	return t.backup(dir, false)
+}
+
+// FullBackup writes a full backup of the store to the backup directory
+// dir, which starts a new chain of incremental backups.
+func (t *Tracker) FullBackup(dir string) (Info, error) {
+	return t.backup(dir, true)
+}
+
+func (t *Tracker) backup(dir string, full bool) (Info, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		ID:   len(m.Backups) + 1,
+		Kind: Full,
+		Seq:  t.Seq(),
+		Time: time.Now().UTC(),
+	}
+	// a journal behind the last backup is from another store,
+	// or a restored store, and needs a new chain
+	if n := len(m.Backups); !full && n > 0 && m.Backups[n-1].Seq <= info.Seq {
+		info.Kind = Incremental
+		info.Since = m.Backups[n-1].Seq
+	}
+	var keys map[string][][]byte
+	if info.Kind == Full {
+		keys, err = t.ListAll()
+	} else {
+		keys, err = t.changesSince(info.Since)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return Info{}, err
+	}
+	info.File = fmt.Sprintf("%06d-%s.jsonl.gz", info.ID, info.Kind)
+	if err = t.writeBackup(filepath.Join(dir, info.File), keys, &info); err != nil {
+		return Info{}, err
+	}
+	m.Backups = append(m.Backups, info)
+	b, err := jsoniter.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Info{}, err
+	}
+	if err = writeFile(filepath.Join(dir, manifestName), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}); err != nil {
+		return Info{}, err
+	}
+	// the backup is complete, and the next backup removes any journal
+	// entries left behind, so an error truncating the journal is ignored
+	_ = t.truncate(info.Seq)
+	return info, nil
+}
+
+// writeBackup writes the current values of keys to the backup file at path,
+// and counts the records in info.
+func (t *Tracker) writeBackup(path string, keys map[string][][]byte, info *Info) error {
+	return writeFile(path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		enc := jsoniter.NewEncoder(gz)
+		for name, nsKeys := range keys {
+			for _, key := range nsKeys {
+				value, err := t.store.Get(name, key)
+				if errors.Is(err, storage.ErrNotFound) {
+					if info.Kind == Full {
+						continue
+					}
+					err = enc.Encode(record{Op: recordDelete, Namespace: name, Key: key})
+					info.Deletes++
+				} else if err == nil {
+					err = enc.Encode(record{Op: recordPut, Namespace: name, Key: key, Value: value})
+					info.Puts++
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return gz.Close()
+	})
+}
+
+// Restore restores the backups in dir to store, which should be open and
+// empty. The store is restored to the last backup taken at or before at,
+// by restoring the full backup which starts its chain and then each of
+// the incremental backups in the chain. If at is zero the last backup is
+// restored. Restore returns the last backup restored.
+func Restore(dir string, store storage.Storage, at time.Time) (Info, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return Info{}, err
+	}
+	var chain []Info
+	for _, info := range m.Backups {
+		if !at.IsZero() && info.Time.After(at) {
+			break
+		}
+		switch {
+		case info.Kind == Full:
+			chain = []Info{info}
+		case len(chain) > 0 && info.Since == chain[len(chain)-1].Seq:
+			chain = append(chain, info)
+		default:
+			err = fmt.Errorf("%w: backup %d does not follow backup chain", storage.ErrCorrupt, info.ID)
+			return Info{}, err
+		}
+	}
+	if len(chain) <= 0 {
+		return Info{}, fmt.Errorf("%w: no backup at %s in %s", storage.ErrNotFound, at, dir)
+	}
+	for _, info := range chain {
+		if err = restoreFile(filepath.Join(dir, info.File), store); err != nil {
+			return Info{}, fmt.Errorf("backup %d: %w", info.ID, err)
+		}
+	}
+	return chain[len(chain)-1], nil
+}
+
+// restoreFile applies the records in the backup file at path to store.
+func restoreFile(path string, store storage.Storage) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return storage.WrapError(storage.ErrCorrupt, err)
+	}
+	br := bufio.NewReader(gz)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) <= 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return storage.WrapError(storage.ErrCorrupt, err)
+		}
+		var r record
+		if err = jsoniter.Unmarshal(line, &r); err != nil {
+			return storage.WrapError(storage.ErrCorrupt, err)
+		}
+		switch r.Op {
+		case recordPut:
+			err = store.Put(r.Namespace, r.Key, r.Value)
+		case recordDelete:
+			err = store.Delete(r.Namespace, r.Key)
+		default:
+			err = fmt.Errorf("%w: unknown backup record: %s", storage.ErrCorrupt, r.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// writeFile atomically replaces the file at path with the data
+// written by fn. The data is synced before it is renamed.
+func writeFile(path string, fn func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if err = fn(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
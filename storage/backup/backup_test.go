@@ -0,0 +1,155 @@
+package backup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/backup"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+func newTestTracker(path string, opt ...storage.StoreOption) storage.Storage {
+	return backup.Track(fs.NewStore(path, opt...))
+}
+
+func TestTracker(t *testing.T) {
+	storagetest.RunConformance(t, newTestTracker)
+}
+
+func TestTracker_Journal(t *testing.T) {
+	store := memory.NewStore()
+	tracker := backup.Track(store)
+	assert.NoError(t, tracker.Open())
+	defer tracker.Close()
+	assert.NoError(t, tracker.Put("n", []byte("a"), []byte("a")))
+	assert.NoError(t, tracker.Delete("n", []byte("a")))
+	assert.Equal(t, uint64(2), tracker.Seq())
+	// the journal is hidden and cannot be written
+	allKeys, err := tracker.ListAll()
+	assert.NoError(t, err)
+	assert.NotContains(t, allKeys, backup.JournalNamespace)
+	_, err = tracker.List(backup.JournalNamespace)
+	assert.ErrorIs(t, err, storage.ErrNamespaceNotFound)
+	err = tracker.Put(backup.JournalNamespace, []byte("a"), []byte("a"))
+	assert.ErrorIs(t, err, storage.ErrInvalidKey)
+	// the sequence continues when the store is reopened
+	journal, err := store.List(backup.JournalNamespace)
+	assert.NoError(t, err)
+	assert.Len(t, journal, 2)
+	assert.NoError(t, tracker.Close())
+	assert.NoError(t, tracker.Open())
+	assert.Equal(t, uint64(2), tracker.Seq())
+}
+
+func TestTracker_Namespaces(t *testing.T) {
+	tracker := backup.Track(memory.NewStore())
+	assert.NoError(t, tracker.Open())
+	defer tracker.Close()
+	assert.NoError(t, tracker.Put("a", []byte("k1"), []byte("v")))
+	assert.NoError(t, tracker.Put("a", []byte("k2"), []byte("v")))
+	names, err := tracker.ListNamespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, names)
+	// each key moved is journaled as a delete and a put
+	assert.NoError(t, tracker.RenameNamespace("a", "b"))
+	assert.Equal(t, uint64(6), tracker.Seq())
+	assert.NoError(t, tracker.CopyNamespace("b", "c"))
+	assert.Equal(t, uint64(8), tracker.Seq())
+	assert.NoError(t, tracker.DropNamespace("b"))
+	assert.Equal(t, uint64(10), tracker.Seq())
+	err = tracker.DropNamespace(backup.JournalNamespace)
+	assert.ErrorIs(t, err, storage.ErrInvalidKey)
+	err = tracker.CopyNamespace("c", backup.JournalNamespace)
+	assert.ErrorIs(t, err, storage.ErrInvalidKey)
+	names, err = tracker.ListNamespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, names)
+}
+
+func TestTracker_Backup(t *testing.T) {
+	dir := t.TempDir()
+	tracker := backup.Track(memory.NewStore())
+	assert.NoError(t, tracker.Open())
+	defer tracker.Close()
+	put := func(key, value string) {
+		assert.NoError(t, tracker.Put("n", []byte(key), []byte(value)))
+	}
+	put("a", "1")
+	put("b", "1")
+	full, err := tracker.Backup(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, backup.Full, full.Kind)
+	assert.Equal(t, 2, full.Puts)
+	put("b", "2")
+	put("c", "2")
+	assert.NoError(t, tracker.Delete("n", []byte("a")))
+	incr, err := tracker.Backup(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, backup.Incremental, incr.Kind)
+	assert.Equal(t, full.Seq, incr.Since)
+	assert.Equal(t, 2, incr.Puts)
+	assert.Equal(t, 1, incr.Deletes)
+	put("d", "3")
+	last, err := tracker.Backup(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, last.Puts)
+	m, err := backup.ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Len(t, m.Backups, 3)
+	for _, test := range []struct {
+		at   time.Time
+		want map[string]string
+	}{
+		{full.Time, map[string]string{"a": "1", "b": "1"}},
+		{incr.Time, map[string]string{"b": "2", "c": "2"}},
+		{time.Time{}, map[string]string{"b": "2", "c": "2", "d": "3"}},
+	} {
+		restored := memory.NewStore()
+		assert.NoError(t, restored.Open())
+		_, err = backup.Restore(dir, restored, test.at)
+		assert.NoError(t, err)
+		keys, err := restored.List("n")
+		assert.NoError(t, err)
+		got := map[string]string{}
+		for _, key := range keys {
+			v, err := restored.Get("n", key)
+			assert.NoError(t, err)
+			got[string(key)] = string(v)
+		}
+		assert.Equal(t, test.want, got)
+		assert.NoError(t, restored.Close())
+	}
+	_, err = backup.Restore(dir, memory.NewStore(), full.Time.Add(-time.Second))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestTracker_FullBackup(t *testing.T) {
+	dir := t.TempDir()
+	tracker := backup.Track(memory.NewStore())
+	assert.NoError(t, tracker.Open())
+	defer tracker.Close()
+	assert.NoError(t, tracker.Put("n", []byte("a"), []byte("a")))
+	_, err := tracker.Backup(dir)
+	assert.NoError(t, err)
+	info, err := tracker.FullBackup(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, backup.Full, info.Kind)
+	assert.Equal(t, 2, info.ID)
+	// a missing backup breaks the chain
+	assert.NoError(t, tracker.Put("n", []byte("b"), []byte("b")))
+	info, err = tracker.Backup(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, info.File)))
+	restored := memory.NewStore()
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	_, err = backup.Restore(dir, restored, time.Time{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,340 @@
+// Package backup provides full, incremental and point-in-time backups for
+// any storage.Storage. A Tracker wraps a store and journals the keys changed
+// by each write, so an incremental backup only copies the entries changed
+// since the previous backup instead of the whole store.
+package backup
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// JournalNamespace is the namespace in the tracked store which holds the
+// change journal. It is hidden by the Tracker, and cannot be written.
+const JournalNamespace = "__chestnut_journal"
+
+const (
+	opPut    byte = 'p'
+	opDelete byte = 'd'
+)
+
+// Tracker is a storage.Storage which journals changes to the store it
+// wraps with a sequence number, SEE: Track.
+type Tracker struct {
+	store storage.Storage
+	// mu is held for reading by writes and for writing by backups,
+	// so a backup sees the store at a single sequence number.
+	mu  sync.RWMutex
+	seq uint64
+	// seqMu guards seq, writes hold mu for reading concurrently.
+	seqMu sync.Mutex
+}
+
+var _ storage.StreamExporter = (*Tracker)(nil)
+
+// Track returns a Tracker which journals the changes made to store. Use
+// the Tracker as the store for Chestnut, and back it up with Backup.
+func Track(store storage.Storage) *Tracker {
+	return &Tracker{store: store}
+}
+
+// Seq returns the sequence number of the last change.
+func (t *Tracker) Seq() uint64 {
+	t.seqMu.Lock()
+	defer t.seqMu.Unlock()
+	return t.seq
+}
+
+// Open opens the store and reads the last sequence number from the journal.
+func (t *Tracker) Open() error {
+	if err := t.store.Open(); err != nil {
+		return err
+	}
+	keys, err := t.store.List(JournalNamespace)
+	if errors.Is(err, storage.ErrNamespaceNotFound) {
+		keys, err = nil, nil
+	} else if err != nil {
+		_ = t.store.Close()
+		return fmt.Errorf("journal: %w", err)
+	}
+	var seq uint64
+	for _, key := range keys {
+		if s, ok := decodeSeq(key); ok && s > seq {
+			seq = s
+		}
+	}
+	t.seqMu.Lock()
+	t.seq = seq
+	t.seqMu.Unlock()
+	return nil
+}
+
+// journal records a change to a key, before the change is made.
+func (t *Tracker) journal(op byte, name string, key []byte) error {
+	if err := validKey(name, key); err != nil {
+		return err
+	}
+	t.seqMu.Lock()
+	defer t.seqMu.Unlock()
+	if err := t.store.Put(JournalNamespace, encodeSeq(t.seq+1), encodeChange(op, name, key)); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	t.seq++
+	return nil
+}
+
+// Put an entry in the store.
+func (t *Tracker) Put(name string, key []byte, value []byte) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.journal(opPut, name, key); err != nil {
+		return err
+	}
+	return t.store.Put(name, key, value)
+}
+
+// Get a value from the store.
+func (t *Tracker) Get(name string, key []byte) ([]byte, error) {
+	return t.store.Get(name, key)
+}
+
+// Has checks for a key in the store.
+func (t *Tracker) Has(name string, key []byte) (bool, error) {
+	return t.store.Has(name, key)
+}
+
+// Save the value in v and store the result at key.
+func (t *Tracker) Save(name string, key []byte, v interface{}) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.journal(opPut, name, key); err != nil {
+		return err
+	}
+	return t.store.Save(name, key, v)
+}
+
+// Load the value at key and stores the result in v.
+func (t *Tracker) Load(name string, key []byte, v interface{}) error {
+	return t.store.Load(name, key, v)
+}
+
+// List returns a list of all keys in the namespace.
+func (t *Tracker) List(name string) ([][]byte, error) {
+	if name == JournalNamespace {
+		return nil, fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	}
+	return t.store.List(name)
+}
+
+// ListAll returns a mapped list of all keys in the store, without the journal.
+func (t *Tracker) ListAll() (map[string][][]byte, error) {
+	allKeys, err := t.store.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	delete(allKeys, JournalNamespace)
+	return allKeys, nil
+}
+
+// Delete removes a key from the store.
+func (t *Tracker) Delete(name string, key []byte) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.journal(opDelete, name, key); err != nil {
+		return err
+	}
+	return t.store.Delete(name, key)
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store, without the journal.
+func (t *Tracker) ListNamespaces() ([]string, error) {
+	names, err := t.store.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if name == JournalNamespace {
+			return append(names[:i], names[i+1:]...), nil
+		}
+	}
+	return names, nil
+}
+
+// DropNamespace removes a namespace and every key in it.
+func (t *Tracker) DropNamespace(name string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys, err := t.namespaceKeys(name, "")
+	if err != nil {
+		return err
+	}
+	if err = t.journalKeys(opDelete, name, keys); err != nil {
+		return err
+	}
+	return t.store.DropNamespace(name)
+}
+
+// RenameNamespace moves every key in namespace from to namespace to.
+func (t *Tracker) RenameNamespace(from, to string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys, err := t.namespaceKeys(from, to)
+	if err != nil {
+		return err
+	}
+	if err = t.journalKeys(opDelete, from, keys); err != nil {
+		return err
+	}
+	if err = t.journalKeys(opPut, to, keys); err != nil {
+		return err
+	}
+	return t.store.RenameNamespace(from, to)
+}
+
+// CopyNamespace copies every key in namespace from to namespace to.
+func (t *Tracker) CopyNamespace(from, to string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys, err := t.namespaceKeys(from, to)
+	if err != nil {
+		return err
+	}
+	if err = t.journalKeys(opPut, to, keys); err != nil {
+		return err
+	}
+	return t.store.CopyNamespace(from, to)
+}
+
+// namespaceKeys returns the keys in namespace from, which the namespace
+// operation will change. Neither from nor to may be the journal.
+func (t *Tracker) namespaceKeys(from, to string) ([][]byte, error) {
+	for _, name := range []string{from, to} {
+		if name == JournalNamespace {
+			return nil, fmt.Errorf("%w: reserved namespace: %s", storage.ErrInvalidKey, name)
+		}
+	}
+	return t.store.List(from)
+}
+
+// journalKeys records a change to each key in the namespace.
+func (t *Tracker) journalKeys(op byte, name string, keys [][]byte) error {
+	for _, key := range keys {
+		if err := t.journal(op, name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the store.
+func (t *Tracker) Close() error {
+	return t.store.Close()
+}
+
+// Export saves the store, with its journal, to path.
+func (t *Tracker) Export(path string) error {
+	return t.store.Export(path)
+}
+
+// ExportTo writes an export archive of the store, with its journal, to w.
+func (t *Tracker) ExportTo(w io.Writer) error {
+	return storage.ExportTo(t.store, w)
+}
+
+// changesSince returns the namespaces and keys changed after seq.
+func (t *Tracker) changesSince(seq uint64) (map[string][][]byte, error) {
+	journal, err := t.store.List(JournalNamespace)
+	if errors.Is(err, storage.ErrNamespaceNotFound) {
+		return map[string][][]byte{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	seen := map[string]bool{}
+	changes := map[string][][]byte{}
+	for _, jkey := range journal {
+		if s, ok := decodeSeq(jkey); !ok || s <= seq {
+			continue
+		}
+		b, err := t.store.Get(JournalNamespace, jkey)
+		if err != nil {
+			return nil, fmt.Errorf("journal: %w", err)
+		}
+		_, name, key, err := decodeChange(b)
+		if err != nil {
+			return nil, fmt.Errorf("journal: %w", err)
+		}
+		if id := name + "\x00" + string(key); !seen[id] {
+			seen[id] = true
+			changes[name] = append(changes[name], key)
+		}
+	}
+	return changes, nil
+}
+
+// truncate removes the journal entries before seq. The entry at seq is
+// kept, so the sequence continues from it when the store is reopened.
+func (t *Tracker) truncate(seq uint64) error {
+	journal, err := t.store.List(JournalNamespace)
+	if errors.Is(err, storage.ErrNamespaceNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	for _, jkey := range journal {
+		if s, ok := decodeSeq(jkey); ok && s < seq {
+			if err = t.store.Delete(JournalNamespace, jkey); err != nil {
+				return fmt.Errorf("journal: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func validKey(name string, key []byte) error {
+	if name == JournalNamespace {
+		return fmt.Errorf("%w: reserved namespace: %s", storage.ErrInvalidKey, name)
+	}
+	return storage.ValidKey(name, key)
+}
+
+// encodeSeq returns the journal key for a sequence number. Keys are
+// big endian so the journal lists in sequence order.
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func decodeSeq(b []byte) (uint64, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b), true
+}
+
+// encodeChange returns the journal value for a change: the operation,
+// the length of the namespace as a uvarint, the namespace, and the key.
+func encodeChange(op byte, name string, key []byte) []byte {
+	b := make([]byte, 0, 1+binary.MaxVarintLen64+len(name)+len(key))
+	b = append(b, op)
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	b = append(b, name...)
+	return append(b, key...)
+}
+
+func decodeChange(b []byte) (op byte, name string, key []byte, err error) {
+	if len(b) < 2 {
+		return 0, "", nil, storage.WrapError(storage.ErrCorrupt, errors.New("journal entry is too short"))
+	}
+	n, size := binary.Uvarint(b[1:])
+	if size <= 0 || uint64(len(b)-1-size) < n {
+		return 0, "", nil, storage.WrapError(storage.ErrCorrupt, errors.New("invalid journal entry"))
+	}
+	rest := b[1+size:]
+	return b[0], string(rest[:n]), rest[n:], nil
+}
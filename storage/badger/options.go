@@ -0,0 +1,65 @@
+package badger
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the badger store specific options.
+type options struct {
+	ttl    time.Duration
+	tuning func(badger.Options) badger.Options
+}
+
+var defaultOptions = options{}
+
+// badgerOption is implemented by StoreOptions that configure the badger store.
+type badgerOption interface {
+	storage.StoreOption
+	applyBadger(*options)
+}
+
+// badgerFuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type badgerFuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o badgerFuncOption) applyBadger(opts *options) {
+	o.f(opts)
+}
+
+func newBadgerOption(f func(*options)) storage.StoreOption {
+	return badgerFuncOption{f: f}
+}
+
+// applyBadgerOptions applies the badger store specific options in opt.
+func applyBadgerOptions(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if bo, ok := o.(badgerOption); ok {
+			bo.applyBadger(&opts)
+		}
+	}
+	return opts
+}
+
+// WithTTL returns a StoreOption which sets the time-to-live for every entry
+// put in the store. Entries put with PutTTL use their own ttl instead.
+// A ttl of zero, the default, means entries do not expire.
+func WithTTL(ttl time.Duration) storage.StoreOption {
+	return newBadgerOption(func(o *options) {
+		o.ttl = ttl
+	})
+}
+
+// WithBadgerOptions returns a StoreOption which tunes the options used to
+// open badger. The function is passed the default options for the store path.
+func WithBadgerOptions(fn func(badger.Options) badger.Options) storage.StoreOption {
+	return newBadgerOption(func(o *options) {
+		o.tuning = fn
+	})
+}
@@ -0,0 +1,641 @@
+// Package badger provides an implementation of the storage.Storage
+// interface for BadgerDB https://github.com/dgraph-io/badger.
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	logName = "badger"
+
+	// nsPrefix is the first byte of every key written by the store.
+	// Keys are nsPrefix, the uvarint length of the namespace, the
+	// namespace, and then the key. Since the namespace is length
+	// prefixed, one namespace is never a prefix of another.
+	nsPrefix byte = 'n'
+
+	// maxPendingWrites is the number of pending writes when loading a backup.
+	maxPendingWrites = 256
+)
+
+// badgerStore is an implementation the Storage interface for badger
+// https://github.com/dgraph-io/badger.
+type badgerStore struct {
+	opts  storage.StoreOptions
+	bopts options
+	path  string
+	db    *badger.DB
+	log   log.Logger
+}
+
+// Backuper is implemented by the badger store. Backups use badger's own
+// backup format, so they can also be restored with the badger cli.
+type Backuper interface {
+	// Backup writes the entries changed after version since to w and
+	// returns the version to pass to the next incremental backup.
+	// A version of zero writes a full backup.
+	Backup(w io.Writer, since uint64) (uint64, error)
+
+	// LoadBackup restores the entries in the backup read from r.
+	LoadBackup(r io.Reader) error
+}
+
+var (
+	_ storage.Storage         = (*badgerStore)(nil)
+	_ storage.ExpiringStorage = (*badgerStore)(nil)
+	_ storage.StatsStorage    = (*badgerStore)(nil)
+	_ Backuper                = (*badgerStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by badger.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	bopts := applyBadgerOptions(defaultOptions, opt...)
+	return &badgerStore{path: path, opts: opts, bopts: bopts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *badgerStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open opens the store.
+func (s *badgerStore) Open() (err error) {
+	s.log.Debugf("opening store at path: %s", s.path)
+	s.db, err = badger.Open(s.badgerOptions(s.path))
+	if err != nil {
+		s.db = nil
+		return s.logError("open", wrapError(err))
+	}
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store. If the store has a ttl the entry expires after it.
+func (s *badgerStore) Put(name string, key []byte, value []byte) error {
+	return s.logError("put", s.put(name, key, value, s.bopts.ttl))
+}
+
+// PutTTL puts an entry in the store which expires after ttl.
+func (s *badgerStore) PutTTL(name string, key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		err := fmt.Errorf("invalid ttl: %s", ttl)
+		return s.logError("put", err)
+	}
+	return s.logError("put", s.put(name, key, value, ttl))
+}
+
+func (s *badgerStore) put(name string, key []byte, value []byte, ttl time.Duration) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	} else if len(value) <= 0 {
+		return errors.New("value cannot be empty")
+	}
+	e := badger.NewEntry(dataKey(name, key), value)
+	if ttl > 0 {
+		s.log.Debugf("put: key: %s.%s expires in %s", name, key, ttl)
+		e = e.WithTTL(ttl)
+	}
+	return s.update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+// Get a value from the store.
+func (s *badgerStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	}
+	var value []byte
+	getValue := func(txn *badger.Txn) error {
+		item, err := txn.Get(dataKey(name, key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		} else if err != nil {
+			return err
+		}
+		// badger values are only valid for the life of the transaction
+		value, err = item.ValueCopy(nil)
+		return err
+	}
+	if err := s.view(getValue); err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *badgerStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *badgerStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *badgerStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	}
+	var has bool
+	hasKey := func(txn *badger.Txn) error {
+		_, err := txn.Get(dataKey(name, key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		has = err == nil
+		return err
+	}
+	if err := s.view(hasKey); err != nil {
+		return false, s.logError("has", err)
+	}
+	s.log.Debugf("has: found key %s: %t", key, has)
+	return has, nil
+}
+
+// Delete removes a key from the store.
+func (s *badgerStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	}
+	del := func(txn *badger.Txn) error {
+		return txn.Delete(dataKey(name, key))
+	}
+	return s.logError("delete", s.update(del))
+}
+
+// List returns a list of all keys in the namespace. Badger does not keep
+// empty namespaces, so a namespace without any keys is not found.
+func (s *badgerStore) List(name string) (keys [][]byte, err error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	prefix := nsKey(name)
+	listKeys := func(txn *badger.Txn) error {
+		iterate(txn, prefix, func(k []byte) {
+			keys = append(keys, k[len(prefix):])
+		})
+		return nil
+	}
+	if err = s.view(listKeys); err != nil {
+		return nil, s.logError("list", err)
+	}
+	if len(keys) <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *badgerStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	var total int
+	allKeys := map[string][][]byte{}
+	listKeys := func(txn *badger.Txn) error {
+		iterate(txn, []byte{nsPrefix}, func(k []byte) {
+			name, key, ok := splitKey(k)
+			if !ok {
+				s.log.Warnf("list: skipping invalid key: %x", k)
+				return
+			}
+			allKeys[name] = append(allKeys[name], key)
+			total++
+		})
+		return nil
+	}
+	if err := s.view(listKeys); err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+// The iterator skips to the end of each namespace it finds.
+func (s *badgerStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	names := []string{}
+	listNamespaces := func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte{nsPrefix}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); {
+			name, _, ok := splitKey(it.Item().Key())
+			if !ok {
+				s.log.Warnf("list: skipping invalid key: %x", it.Item().Key())
+				it.Next()
+				continue
+			}
+			names = append(names, name)
+			it.Seek(prefixEnd(nsKey(name)))
+		}
+		return nil
+	}
+	if err := s.view(listNamespaces); err != nil {
+		return nil, s.logError("list", err)
+	}
+	// keys are ordered by the length of the namespace first
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace drops every key with the prefix of the namespace.
+func (s *badgerStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	if err := s.hasNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	return s.logError("drop", wrapError(s.db.DropPrefix(nsKey(name))))
+}
+
+// RenameNamespace copies namespace from to namespace to, and then drops
+// it. The rename is not atomic, if it fails the keys copied so far are
+// left in namespace to.
+func (s *badgerStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	if err := s.copyNamespace(from, to); err != nil {
+		return s.logError("rename", err)
+	}
+	return s.logError("rename", wrapError(s.db.DropPrefix(nsKey(from))))
+}
+
+// CopyNamespace copies every entry in namespace from to namespace to,
+// with a write batch. Entries keep their expiry. The copy is not atomic.
+func (s *badgerStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return s.logError("copy", s.copyNamespace(from, to))
+}
+
+func (s *badgerStore) copyNamespace(from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	}
+	if err := s.hasNamespace(from); err != nil {
+		return err
+	}
+	if err := s.hasNamespace(to); err == nil {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	} else if !errors.Is(err, storage.ErrNamespaceNotFound) {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	prefix := nsKey(from)
+	copyEntries := func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			e := badger.NewEntry(dataKey(to, item.Key()[len(prefix):]), value)
+			e.ExpiresAt = item.ExpiresAt()
+			if err = wb.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := s.view(copyEntries); err != nil {
+		return err
+	}
+	return wrapError(wb.Flush())
+}
+
+// hasNamespace returns nil if the namespace has at least one key,
+// otherwise the error wraps ErrNamespaceNotFound.
+func (s *badgerStore) hasNamespace(name string) error {
+	var found bool
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = nsKey(name)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		found = it.Valid()
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the store, without reading the values.
+// The size of values kept in the value log is estimated by badger. The
+// backend counters are the sizes of the LSM tree and value log last
+// computed by badger, and the number of tables.
+func (s *badgerStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	collect := func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte{nsPrefix}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			name, _, ok := splitKey(item.Key())
+			if !ok {
+				s.log.Warnf("stats: skipping invalid key: %x", item.Key())
+				continue
+			}
+			stats.Add(name, storage.NamespaceStats{Keys: 1, ValueBytes: item.ValueSize()})
+		}
+		return nil
+	}
+	if err := s.view(collect); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	var err error
+	if stats.DiskBytes, err = storage.DirSize(s.path); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	lsm, vlog := s.db.Size()
+	stats.Backend = map[string]int64{
+		"lsm_bytes":  lsm,
+		"vlog_bytes": vlog,
+		"tables":     int64(len(s.db.Tables())),
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace, without reading the values.
+func (s *badgerStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	var count int64
+	countKeys := func(txn *badger.Txn) error {
+		iterate(txn, nsKey(name), func([]byte) {
+			count++
+		})
+		return nil
+	}
+	if err := s.view(countKeys); err != nil {
+		return 0, s.logError("count", err)
+	}
+	if count <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
+// Export copies the datastore to a new badger database in the directory
+// at path, by streaming a backup of the store into it. Export will not
+// write to a path that has data in it.
+func (s *badgerStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if s.path == path {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	} else if s.db == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		err = fmt.Errorf("path is not empty: %s", path)
+		return s.logError("export", err)
+	} else if err != nil && !os.IsNotExist(err) {
+		return s.logError("export", err)
+	}
+	db, err := badger.Open(s.badgerOptions(path))
+	if err != nil {
+		return s.logError("export", wrapError(err))
+	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := s.db.Backup(w, 0)
+		_ = w.CloseWithError(err)
+	}()
+	err = db.Load(r, maxPendingWrites)
+	_ = r.CloseWithError(err)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s.logError("export", wrapError(err))
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// Restore restores an export archive for NewStore(destPath). SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
+// Backup writes a backup of the entries changed after version since to w.
+func (s *badgerStore) Backup(w io.Writer, since uint64) (uint64, error) {
+	s.log.Debugf("backup: since version: %d", since)
+	if s.db == nil {
+		return 0, s.logError("backup", storage.ErrClosed)
+	}
+	version, err := s.db.Backup(w, since)
+	if err != nil {
+		return 0, s.logError("backup", wrapError(err))
+	}
+	s.log.Debugf("backup: complete at version: %d", version)
+	return version, nil
+}
+
+// LoadBackup restores the entries in the backup read from r.
+func (s *badgerStore) LoadBackup(r io.Reader) error {
+	s.log.Debug("load backup")
+	if s.db == nil {
+		return s.logError("load backup", storage.ErrClosed)
+	}
+	return s.logError("load backup", wrapError(s.db.Load(r, maxPendingWrites)))
+}
+
+// Close closes the datastore and releases all db resources.
+func (s *badgerStore) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	if s.db == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
+	err := s.db.Close()
+	s.db = nil
+	s.log.Info("store closed")
+	return s.logError("close", wrapError(err))
+}
+
+// badgerOptions returns the options used to open badger at path.
+func (s *badgerStore) badgerOptions(path string) badger.Options {
+	opts := badger.DefaultOptions(path).WithLogger(nil)
+	if s.log != nil {
+		opts = opts.WithLogger(badgerLogger{s.log})
+	}
+	if s.bopts.tuning != nil {
+		opts = s.bopts.tuning(opts)
+	}
+	return opts
+}
+
+// view runs fn in a read-only transaction.
+func (s *badgerStore) view(fn func(*badger.Txn) error) error {
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.View(fn))
+}
+
+// update runs fn in a read-write transaction.
+func (s *badgerStore) update(fn func(*badger.Txn) error) error {
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.Update(fn))
+}
+
+// iterate calls fn with a copy of each key that starts with prefix.
+func iterate(txn *badger.Txn, prefix []byte, fn func(k []byte)) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		fn(it.Item().KeyCopy(nil))
+	}
+}
+
+// prefixEnd returns the first key after every key that starts with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	// every byte was 0xff, so there is no upper bound
+	return nil
+}
+
+// nsKey returns the prefix for the keys in a namespace.
+func nsKey(name string) []byte {
+	b := make([]byte, 0, 1+binary.MaxVarintLen64+len(name))
+	b = append(b, nsPrefix)
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+// dataKey returns the badger key for a key in a namespace.
+func dataKey(name string, key []byte) []byte {
+	return append(nsKey(name), key...)
+}
+
+// splitKey returns the namespace and key for a badger key.
+func splitKey(k []byte) (name string, key []byte, ok bool) {
+	if len(k) <= 0 || k[0] != nsPrefix {
+		return "", nil, false
+	}
+	n, size := binary.Uvarint(k[1:])
+	if size <= 0 || uint64(len(k)-1-size) < n {
+		return "", nil, false
+	}
+	start := 1 + size
+	end := start + int(n)
+	return string(k[start:end]), k[end:], len(k) > end
+}
+
+// wrapError wraps badger errors with the matching storage error.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, badger.ErrDBClosed), errors.Is(err, badger.ErrBlockedWrites):
+		return storage.WrapError(storage.ErrClosed, err)
+	case errors.Is(err, badger.ErrReadOnlyTxn):
+		return storage.WrapError(storage.ErrReadOnly, err)
+	case errors.Is(err, badger.ErrEmptyKey), errors.Is(err, badger.ErrInvalidKey):
+		return storage.WrapError(storage.ErrInvalidKey, err)
+	case errors.Is(err, badger.ErrInvalidDump):
+		return storage.WrapError(storage.ErrCorrupt, err)
+	default:
+		return err
+	}
+}
+
+// badgerLogger adapts the store logger to the badger logger. Badger logs
+// a lot of routine maintenance at info level, so it is logged as debug.
+type badgerLogger struct {
+	log log.Logger
+}
+
+func (l badgerLogger) Errorf(format string, v ...interface{}) {
+	l.log.Error(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l badgerLogger) Warningf(format string, v ...interface{}) {
+	l.log.Warn(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l badgerLogger) Infof(format string, v ...interface{}) {
+	l.log.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l badgerLogger) Debugf(format string, v ...interface{}) {
+	l.log.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (s *badgerStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
@@ -0,0 +1,86 @@
+package badger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_TTL(t *testing.T) {
+	store := NewStore(t.TempDir(), WithTTL(time.Hour))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	ttlStore, ok := store.(storage.ExpiringStorage)
+	assert.True(t, ok)
+	assert.Error(t, ttlStore.PutTTL("a", []byte("b"), []byte("c"), 0))
+	assert.NoError(t, ttlStore.PutTTL("a", []byte("b"), []byte("c"), time.Second))
+	assert.NoError(t, store.Put("a", []byte("d"), []byte("e")))
+	has, err := store.Has("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+	// badger ttls have a resolution of one second
+	time.Sleep(2 * time.Second)
+	has, err = store.Has("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.False(t, has)
+	has, err = store.Has("a", []byte("d"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestStore_Backup(t *testing.T) {
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	var full bytes.Buffer
+	version, err := store.(Backuper).Backup(&full, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put("a", []byte("d"), []byte("e")))
+	var incr bytes.Buffer
+	_, err = store.(Backuper).Backup(&incr, version)
+	assert.NoError(t, err)
+	restored := NewStore(t.TempDir())
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	assert.NoError(t, restored.(Backuper).LoadBackup(&full))
+	has, err := restored.Has("a", []byte("d"))
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.NoError(t, restored.(Backuper).LoadBackup(&incr))
+	keys, err := restored.List("a")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("d")}, keys)
+	assert.Error(t, restored.(Backuper).LoadBackup(bytes.NewReader([]byte("nope"))))
+}
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"a", "b"},
+		{"c/c", "c/c"},
+		{".d", ".d"},
+		{string(make([]byte, 200)), "e"},
+	}
+	for _, test := range tests {
+		name, key, ok := splitKey(dataKey(test.name, []byte(test.key)))
+		assert.True(t, ok)
+		assert.Equal(t, test.name, name)
+		assert.Equal(t, test.key, string(key))
+	}
+	for _, k := range [][]byte{nil, []byte("x"), nsKey("a"), {nsPrefix, 0xff}} {
+		_, _, ok := splitKey(k)
+		assert.False(t, ok, "%x", k)
+	}
+}
@@ -0,0 +1,122 @@
+package bitcask
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"git.mills.io/prologic/bitcask"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// nsPrefix is the prefix of the directory of a namespace's bitcask, the
+// rest of the directory name is the hex encoding of the namespace, so
+// names which differ only in case do not share a directory.
+const nsPrefix = "ns-"
+
+// maxNamespaceLen is the longest namespace whose directory name is a
+// valid file name.
+const maxNamespaceLen = (255 - len(nsPrefix)) / 2
+
+// db keeps a bitcask for each namespace in the directories under path.
+type db struct {
+	path string
+	mu   sync.Mutex
+	// stores are the open bitcasks of the namespaces
+	stores map[string]*bitcask.Bitcask
+}
+
+// openDB opens the bitcask of every namespace in the directory at path.
+func openDB(path string) (*db, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	d := &db{path: path, stores: make(map[string]*bitcask.Bitcask)}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), nsPrefix) {
+			continue
+		}
+		name, err := hex.DecodeString(strings.TrimPrefix(entry.Name(), nsPrefix))
+		if err != nil {
+			continue
+		}
+		if _, err = d.open(string(name)); err != nil {
+			_ = d.closeAll()
+			return nil, fmt.Errorf("store: %s: %w", name, err)
+		}
+	}
+	return d, nil
+}
+
+// store returns the bitcask of the namespace, or nil if it has none.
+func (d *db) store(name string) *bitcask.Bitcask {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stores[name]
+}
+
+// withNew returns the bitcask of the namespace, which is created if needed.
+func (d *db) withNew(name string) (*bitcask.Bitcask, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if b, ok := d.stores[name]; ok {
+		return b, nil
+	}
+	return d.open(name)
+}
+
+// open opens the bitcask of the namespace, d.mu must be held.
+func (d *db) open(name string) (*bitcask.Bitcask, error) {
+	if len(name) > maxNamespaceLen {
+		return nil, fmt.Errorf("%w: namespace longer than %d bytes", storage.ErrInvalidKey, maxNamespaceLen)
+	}
+	dir := filepath.Join(d.path, nsPrefix+hex.EncodeToString([]byte(name)))
+	// keys and values are not limited by the store
+	b, err := bitcask.Open(dir, bitcask.WithMaxKeySize(0), bitcask.WithMaxValueSize(0))
+	if err != nil {
+		return nil, err
+	}
+	d.stores[name] = b
+	return b, nil
+}
+
+// allStores returns the bitcasks of every namespace.
+func (d *db) allStores() map[string]*bitcask.Bitcask {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stores := make(map[string]*bitcask.Bitcask, len(d.stores))
+	for name, b := range d.stores {
+		stores[name] = b
+	}
+	return stores
+}
+
+// closeAll closes the bitcask of every namespace, and returns the first error.
+func (d *db) closeAll() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, b := range d.stores {
+		if closeErr := b.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("%s: %w", name, closeErr)
+		}
+		delete(d.stores, name)
+	}
+	return err
+}
+
+// bitcaskKeys returns the keys in the bitcask.
+func bitcaskKeys(b *bitcask.Bitcask) [][]byte {
+	var keys [][]byte
+	for key := range b.Keys() {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -1,20 +1,17 @@
 package bitcask
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
 
-	"git.tcp.direct/tcp.direct/database/bitcask"
 	jsoniter "github.com/json-iterator/go"
 
-	"github.com/mholt/archiver/v4"
-
 	"git.tcp.direct/kayos/chestnut/log"
 	"git.tcp.direct/kayos/chestnut/storage"
 )
@@ -28,16 +25,19 @@ const (
 type bitcaskStore struct {
 	opts storage.StoreOptions
 	path string
-	db   *bitcask.DB
-	log  log.Logger
+	// mu is held for writing while db is opened, closed or archived
+	// by an export, and for reading while it is used.
+	mu  sync.RWMutex
+	db  *db
+	log log.Logger
 }
 
-var _ storage.Storage = (*bitcaskStore)(nil)
-
-var exportFormat = archiver.CompressedArchive{
-	Compression: archiver.Gz{},
-	Archival:    archiver.Tar{},
-}
+var (
+	_ storage.Storage        = (*bitcaskStore)(nil)
+	_ storage.Compactor      = (*bitcaskStore)(nil)
+	_ storage.StatsStorage   = (*bitcaskStore)(nil)
+	_ storage.StreamExporter = (*bitcaskStore)(nil)
+)
 
 // NewStore is used to instantiate a datastore backed by bitcask.
 func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
@@ -55,337 +55,563 @@ func (st *bitcaskStore) Options() storage.StoreOptions {
 	return st.opts
 }
 
-// Open opens the store.
-func (st *bitcaskStore) Open() (err error) {
+// Open opens the store and the bitcask of every namespace in it.
+func (st *bitcaskStore) Open() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.open()
+}
+
+// open opens the store, mu must be held for writing.
+func (st *bitcaskStore) open() (err error) {
 	st.log.Debugf("opening store at path: %s", st.path)
 	var path string
 	path, err = ensureDBPath(st.path)
 	if err != nil {
-		err = st.logError("open", err)
-		return
-	}
-	pathDir, pathFile := filepath.Split(path)
-	finfo, err1 := os.Stat(filepath.Join(pathDir, pathFile+".tar.gz"))
-	finfo2, err2 := os.Stat(filepath.Join(path, "bitcask.tar.gz"))
-	if err1 == nil {
-		if finfo.IsDir() {
-			st.log.Panic("NewStore: export file is a directory")
-		}
-		path = filepath.Join(pathDir, pathFile+".tar.gz")
+		return st.logError("open", err)
 	}
-	if err2 == nil {
-		if finfo2.IsDir() {
-			st.log.Panic("NewStore: export file is a directory")
-		}
-		path = filepath.Join(path, "bitcask.tar.gz")
-	}
-	var storeNames []string
-	_, fileName := filepath.Split(path)
-	if strings.HasSuffix(fileName, ".tar.gz") {
-		st.log.Infof("NewStore: preparing to extract tar.gz file: %s", path)
-		path = filepath.Dir(path)
-		if strings.HasSuffix(path, storeName) {
-			path = filepath.Join(path, "..")
-		}
-		importErr := os.MkdirAll(path, 0755)
-		if importErr != nil {
-			st.log.Fatalf("NewStore: failed to create directory to restore export: %s", importErr)
-			return nil
-		}
-		var f *os.File
-		f, importErr = os.Open(filepath.Join(path, fileName))
-		if importErr != nil {
-			st.log.Fatalf("NewStore: failed to open arcive to restore export: %s", importErr)
-			return nil
-		}
-		defer func() {
-			_ = f.Close()
-		}()
-		st.log.Debugf("NewStore: extracting archive: %s", f.Name())
-		importErr = exportFormat.Extract(
-			context.Background(), f, nil,
-			func(ctx context.Context, af archiver.File) error {
-				var afErr error
-				if af.IsDir() {
-					st.log.Debugf("NewStore: creating directory: %s", af.Name())
-					afErr = os.MkdirAll(filepath.Join(path, af.NameInArchive), 0755)
-					if afErr != nil {
-						return fmt.Errorf("MkdirAll: %w", afErr)
-					}
-					return nil
-				}
-				var afile io.Reader
-				afile, afErr = af.Open()
-				if afErr != nil {
-					return fmt.Errorf("archive.Open: %w", afErr)
-				}
-				var tf *os.File
-				extractTo := filepath.Join(path, af.NameInArchive)
-				targetDir, targetFile := filepath.Split(extractTo)
-				if targetFile == "lock" {
-					return nil
-				}
-				if targetFile == "stores.json" {
-					storesFile, err := af.Open()
-					if err != nil {
-						return fmt.Errorf("open stores.json: %w", err)
-					}
-					storesData, err := io.ReadAll(storesFile)
-					if err != nil {
-						return fmt.Errorf("io err stores.json: %w", err)
-					}
-					err = jsoniter.Unmarshal(storesData, &storeNames)
-					if err != nil {
-						return fmt.Errorf("unmarshal stores.json: %w", err)
-					}
-				}
-				err := os.MkdirAll(targetDir, 0755)
-				if err != nil {
-					return fmt.Errorf("MkdirAll: %w", err)
-				}
-				st.log.Debugf("NewStore: extracting %s to %s", af.NameInArchive, extractTo)
-				tf, afErr = os.Create(extractTo)
-				if afErr != nil {
-					return fmt.Errorf("os.Create: %w", afErr)
-				}
-				_, afErr = io.Copy(tf, afile)
-				if afErr != nil {
-					return fmt.Errorf("io.Copy: %w", afErr)
-				}
-				return nil
-			})
-		if importErr != nil {
-			st.log.Fatalf("NewStore: failed to restore export: %s", importErr)
-			return nil
-		}
-		if len(storeNames) == 0 {
-			st.log.Fatalf("NewStore: failed to restore export: no stores found")
-			return nil
-		}
-	}
-	st.db = bitcask.OpenDB(path)
-	if st.db == nil {
-		err = errors.New("unable to open backing store")
-		err = st.logError("open", err)
-		return
-	}
-	if len(storeNames) > 0 {
-		for _, sto := range storeNames {
-			st.log.Infof("NewStore: restoring store: %s", sto)
-			err = st.db.Init(sto)
-			if err != nil {
-				st.log.Errorf("NewStore: failed to restore store: %s: %s", sto, err)
-			}
-		}
-		restored, restoreErr := st.ListAll()
-		if restoreErr != nil {
-			st.log.Errorf("NewStore: failed to list restored: %s", restoreErr)
-			return nil
-		}
-		if len(restored) != len(storeNames) {
-			st.log.Errorf("NewStore: failed to restore all stores: %d stores restored", len(restored))
-			return nil
-		}
-		var count int
-		for _, sto := range restored {
-			count = count + len(sto)
-		}
-		st.log.Infof("NewStore: restored %d keys", count)
+	if st.db, err = openDB(path); err != nil {
+		return st.logError("open", err)
 	}
 	st.log.Infof("opened store at path: %s", st.path)
-	return
+	return nil
 }
 
 // Put an entry in the store.
 func (st *bitcaskStore) Put(name string, key []byte, value []byte) error {
-	if len(key) < 1 {
-		return st.logError("put", errors.New("key cannot be empty"))
+	if err := storage.ValidKey(name, key); err != nil {
+		return st.logError("put", err)
 	}
 	if len(value) < 1 {
 		return st.logError("put", errors.New("value cannot be empty"))
 	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return st.logError("put", storage.ErrClosed)
+	}
 	st.log.Debugf("put: %d value bytes to key: %s", len(value), key)
-	return st.logError("put", st.db.WithNew(name).Put(key, value))
+	ns, err := st.db.withNew(name)
+	if err != nil {
+		return st.logError("put", err)
+	}
+	return st.logError("put", ns.Put(key, value))
 }
 
 // Get a value from the store.
 func (st *bitcaskStore) Get(name string, key []byte) ([]byte, error) {
-	if len(key) < 1 {
-		return nil, st.logError("put", errors.New("key cannot be empty"))
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, st.logError("get", err)
 	}
-	var value []byte
-	var err error
-	if value, err = st.db.WithNew(name).Get(key); err != nil {
-		return value, st.logError("load", err)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return nil, st.logError("get", storage.ErrClosed)
+	}
+	ns := st.db.store(name)
+	if ns == nil || !ns.Has(key) {
+		err := fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		return nil, st.logError("get", err)
+	}
+	value, err := ns.Get(key)
+	if err != nil {
+		return nil, st.logError("get", err)
 	}
 	return value, nil
 }
 
 // Save the value in v and store the result at key.
 func (st *bitcaskStore) Save(name string, key []byte, v interface{}) error {
-	if len(key) < 1 {
-		return st.logError("save", errors.New("key cannot be empty"))
-	}
-	b, err := jsoniter.Marshal(v)
+	b, err := st.opts.Serializer().Marshal(v)
 	if err != nil {
 		return st.logError("save", err)
 	}
-	return st.db.WithNew(name).Put(key, b)
+	return st.Put(name, key, b)
 }
 
 // Load the value at key and stores the result in v.
 func (st *bitcaskStore) Load(name string, key []byte, v interface{}) error {
-	if len(key) < 1 {
-		return st.logError("load", errors.New("key cannot be empty"))
-	}
-	b, err := st.db.WithNew(name).Get(key)
+	b, err := st.Get(name, key)
 	if err != nil {
 		return st.logError("load", err)
 	}
-	return st.logError("load", jsoniter.Unmarshal(b, v))
+	return st.logError("load", st.opts.Serializer().Unmarshal(b, v))
 }
 
 // Has checks for a key in the store.
 func (st *bitcaskStore) Has(name string, key []byte) (bool, error) {
-	if len(key) < 1 {
-		return false, st.logError("has", errors.New("key cannot be empty"))
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, st.logError("has", err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return false, st.logError("has", storage.ErrClosed)
 	}
 	st.log.Debugf("has: key: %s", key)
-	return st.db.WithNew(name).Has(key), nil
+	ns := st.db.store(name)
+	return ns != nil && ns.Has(key), nil
 }
 
 // Delete removes a key from the store.
 func (st *bitcaskStore) Delete(name string, key []byte) error {
-	if len(key) < 1 {
-		return st.logError("delete", errors.New("key cannot be empty"))
+	if err := storage.ValidKey(name, key); err != nil {
+		return st.logError("delete", err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return st.logError("delete", storage.ErrClosed)
 	}
 	st.log.Debugf("delete: key: %s", key)
-	return st.db.WithNew(name).Delete(key)
+	ns := st.db.store(name)
+	if ns == nil {
+		return nil
+	}
+	return st.logError("delete", ns.Delete(key))
 }
 
 // List returns a list of all keys in the namespace.
 func (st *bitcaskStore) List(name string) (keys [][]byte, err error) {
 	st.log.Debugf("list: keys in bitcask store named: %s", name)
-	keys = st.db.WithNew(name).Keys()
-	st.log.Debugf("list: found %d keys: %s", st.db.WithNew(name).Len(), keys)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return nil, st.logError("list", storage.ErrClosed)
+	}
+	// bitcask namespaces are created on demand, so
+	// an empty namespace is treated as not found.
+	if ns := st.db.store(name); ns != nil {
+		keys = bitcaskKeys(ns)
+	}
+	if len(keys) <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, st.logError("list", err)
+	}
+	st.log.Debugf("list: found %d keys: %s", len(keys), keys)
 	return
 }
 
 // ListAll returns a mapped list of all keys in the store.
 func (st *bitcaskStore) ListAll() (map[string][][]byte, error) {
 	st.log.Debugf("list: all keys in bitcask storage")
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	keymap, err := st.listAll()
+	return keymap, st.logError("list", err)
+}
+
+// listAll returns a mapped list of all keys in the store, mu must be held.
+func (st *bitcaskStore) listAll() (map[string][][]byte, error) {
+	if st.db == nil {
+		return nil, storage.ErrClosed
+	}
 	keymap := make(map[string][][]byte)
-	var err error
-	for n, s := range st.db.AllStores() {
-		for _, k := range s.Keys() {
+	for n, s := range st.db.allStores() {
+		for _, k := range bitcaskKeys(s) {
 			keymap[n] = append(keymap[n], k)
 		}
 	}
-	return keymap, err
+	return keymap, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+func (st *bitcaskStore) ListNamespaces() ([]string, error) {
+	st.log.Debugf("list: all namespaces")
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return nil, st.logError("list", storage.ErrClosed)
+	}
+	names := []string{}
+	for n, s := range st.db.allStores() {
+		if s.Len() > 0 {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	st.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace removes every key in the namespace's store.
+func (st *bitcaskStore) DropNamespace(name string) error {
+	st.log.Debugf("drop: namespace: %s", name)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.checkNamespaces(name); err != nil {
+		return st.logError("drop", err)
+	}
+	if err := st.db.store(name).DeleteAll(); err != nil {
+		return st.logError("drop", err)
+	}
+	return st.logError("drop", st.writeAllStoreNames())
 }
 
-func (st *bitcaskStore) writeAllStoreNames() error {
-	all, err := st.ListAll()
+// RenameNamespace moves every key in namespace from to namespace to.
+func (st *bitcaskStore) RenameNamespace(from, to string) error {
+	st.log.Debugf("rename: namespace: %s to: %s", from, to)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.checkNamespaces(from, to); err != nil {
+		return st.logError("rename", err)
+	}
+	if err := st.copyNamespace(from, to); err != nil {
+		return st.logError("rename", err)
+	}
+	if err := st.db.store(from).DeleteAll(); err != nil {
+		return st.logError("rename", err)
+	}
+	return st.logError("rename", st.writeAllStoreNames())
+}
+
+// CopyNamespace copies every key in namespace from to namespace to.
+func (st *bitcaskStore) CopyNamespace(from, to string) error {
+	st.log.Debugf("copy: namespace: %s to: %s", from, to)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.checkNamespaces(from, to); err != nil {
+		return st.logError("copy", err)
+	}
+	if err := st.copyNamespace(from, to); err != nil {
+		return st.logError("copy", err)
+	}
+	return st.logError("copy", st.writeAllStoreNames())
+}
+
+// checkNamespaces checks namespace from is found and, if a target
+// namespace is given, that it is valid and not found.
+func (st *bitcaskStore) checkNamespaces(from string, to ...string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	}
+	if st.db == nil {
+		return storage.ErrClosed
+	}
+	if ns := st.db.store(from); ns == nil || ns.Len() <= 0 {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	}
+	for _, name := range to {
+		if err := storage.ValidNamespace(name); err != nil {
+			return err
+		}
+		if ns := st.db.store(name); from == name || (ns != nil && ns.Len() > 0) {
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, name)
+		}
+	}
+	return nil
+}
+
+// copyNamespace puts every key of the store of namespace from in the store of namespace to.
+func (st *bitcaskStore) copyNamespace(from, to string) error {
+	src := st.db.store(from)
+	dst, err := st.db.withNew(to)
 	if err != nil {
-		return st.logError("export", err)
+		return err
+	}
+	for _, key := range bitcaskKeys(src) {
+		value, err := src.Get(key)
+		if err != nil {
+			return err
+		}
+		if err = dst.Put(key, value); err != nil {
+			return err
+		}
 	}
-	var storeNames []string
+	return nil
+}
+
+// writeAllStoreNames writes the sorted names of the namespaces to
+// stores.json, which lists them for readers of an export. The names are
+// written to a temporary file which replaces stores.json, so a failed write
+// leaves the last list. mu must be held.
+func (st *bitcaskStore) writeAllStoreNames() (err error) {
+	all, err := st.listAll()
+	if err != nil {
+		return err
+	}
+	storeNames := make([]string, 0, len(all))
 	for n := range all {
 		storeNames = append(storeNames, n)
 	}
-	writeNamesTo, err := os.OpenFile(filepath.Join(st.path, "stores.json"), os.O_CREATE|os.O_WRONLY, 0644)
+	sort.Strings(storeNames)
+	namesJSON, err := jsoniter.Marshal(storeNames)
 	if err != nil {
-		return st.logError("export", err)
+		return err
 	}
-	var namesJSON []byte
-	namesJSON, err = jsoniter.Marshal(storeNames)
+	f, err := os.CreateTemp(st.path, ".stores-*.json")
 	if err != nil {
-		return st.logError("export", err)
+		return err
 	}
-	if len(namesJSON) < 1 {
-		return st.logError("export", errors.New("no store names found"))
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	_, err = f.Write(namesJSON)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	var written int
-	written, err = writeNamesTo.Write(namesJSON)
-	if written != len(namesJSON) {
-		return st.logError("export", errors.New("unable to write all store names"))
+	if err != nil {
+		return err
 	}
-	return writeNamesTo.Close()
+	return os.Rename(f.Name(), filepath.Join(st.path, "stores.json"))
 }
 
-// Export copies the datastore to directory at path.
-func (st *bitcaskStore) Export(path string) error {
+// Export writes the datastore to an export archive at path.tar.gz, which
+// is restored with Restore. SEE: ExportTo.
+func (st *bitcaskStore) Export(path string) (err error) {
 	st.log.Debugf("export: to path: %s", path)
 	if path == "" {
-		err := fmt.Errorf("invalid path: %s", path)
+		err = fmt.Errorf("invalid path: %s", path)
 		return st.logError("export", err)
 	} else if st.path == path {
-		err := fmt.Errorf("path cannot be store path: %s", path)
+		err = fmt.Errorf("path cannot be store path: %s", path)
 		return st.logError("export", err)
 	}
-	var err error
 	path, err = ensureDBPath(path)
 	if err != nil {
 		return st.logError("export", err)
 	}
-	if err = st.writeAllStoreNames(); err != nil {
+	target := path + ".tar.gz"
+	st.log.Debugf("export: creating archive: %s", target)
+	err = st.archive(func() error {
+		return writeArchiveFile(st.path, target)
+	})
+	if err != nil {
 		return st.logError("export", err)
 	}
-	err = st.Close()
+	st.log.Debugf("export: to path complete: %s", target)
+	return nil
+}
+
+// Restore restores an export archive, such as the tarball written by Export,
+// for NewStore(destPath). SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
+// ExportTo streams an export archive of the datastore to w. Bitcask only
+// writes a consistent index when it is closed, so the store is closed while
+// its files are archived, and other calls wait until it is reopened. If it
+// cannot be reopened the error says so, and calls fail with ErrClosed.
+func (st *bitcaskStore) ExportTo(w io.Writer) error {
+	st.log.Debug("export: to writer")
+	err := st.archive(func() error {
+		return writeArchive(st.path, w)
+	})
 	if err != nil {
 		return st.logError("export", err)
 	}
+	st.log.Debug("export: to writer complete")
+	return nil
+}
+
+// archive closes the store, runs write to archive its files, and reopens
+// it. mu is held for writing throughout, so other calls wait for it to be
+// reopened rather than see it closed.
+func (st *bitcaskStore) archive(write func() error) (err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.db == nil {
+		return storage.ErrClosed
+	}
+	if err = st.writeAllStoreNames(); err != nil {
+		return err
+	}
+	if err = st.close(); err != nil {
+		return err
+	}
 	defer func() {
-		if openErr := st.Open(); openErr != nil {
-			err = st.logError("export",
-				fmt.Errorf("unable to reopen bitcask store: %s", openErr))
+		if openErr := st.open(); openErr != nil {
+			err = fmt.Errorf("store is closed, unable to reopen: %w", openErr)
 		}
 	}()
-	filesystem := os.DirFS(st.path)
-	var files = make(map[string]string)
-	err = fs.WalkDir(filesystem, ".", func(walkPath string, d fs.DirEntry, err error) error {
-		if walkPath == "." {
-			return nil
-		}
-		if _, fileName := filepath.Split(walkPath); fileName == "lock" {
-			return nil
+	return write()
+}
+
+// writeArchiveFile writes the files of the store in dir to a new export
+// archive at path.
+func writeArchiveFile(dir, path string) (err error) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
 		}
-		st.log.Debugf("export: found file: %s", walkPath)
-		if err == nil {
-			files[filepath.Join(st.path, walkPath)] = strings.TrimPrefix(walkPath, storeName)
+		if err != nil {
+			_ = os.Remove(path)
 		}
+	}()
+	if err = writeArchive(dir, out); err != nil {
 		return err
+	}
+	return out.Sync()
+}
+
+// writeArchive writes the files of the store in dir, without its lock
+// files, to an export archive written to w.
+func writeArchive(dir string, w io.Writer) error {
+	aw := storage.NewArchiveWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || d.Name() == "lock" {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return aw.WriteFile(storage.ArchiveExportName+"/"+filepath.ToSlash(rel), info, f)
 	})
 	if err != nil {
-		return st.logError("export", err)
+		return err
 	}
-	var archiveFiles []archiver.File
-	var out *os.File
-	defer func() {
-		_ = out.Close()
-	}()
-	archiveFiles, err = archiver.FilesFromDisk(nil, files)
-	st.log.Debugf("export: found %d files", len(archiveFiles))
-	targetDir, targetName := filepath.Split(path)
-	target := filepath.Join(targetDir, targetName+".tar.gz")
-	st.log.Debugf("export: creating archive: %s", target)
-	out, err = os.Create(target)
-	err = exportFormat.Archive(context.Background(), out, archiveFiles)
-	if err != nil {
-		return st.logError("export", err)
+	return aw.Close()
+}
+
+// Compact merges every namespace, bitcask reclaims space by merging.
+func (st *bitcaskStore) Compact() error {
+	return st.Merge()
+}
+
+// Merge rewrites the data files of every namespace without the
+// deleted and overwritten entries.
+func (st *bitcaskStore) Merge() error {
+	st.log.Debugf("merge: store at path: %s", st.path)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return st.logError("merge", storage.ErrClosed)
+	}
+	for name, s := range st.db.allStores() {
+		st.log.Debugf("merge: namespace: %s", name)
+		if err := s.Merge(); err != nil {
+			return st.logError("merge", fmt.Errorf("%s: %w", name, err))
+		}
 	}
 	return nil
 }
 
+// DeadSpace returns the fraction of the data files of every
+// namespace which can be reclaimed by a merge.
+func (st *bitcaskStore) DeadSpace() (float64, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	dead, err := st.deadSpace()
+	return dead, st.logError("dead space", err)
+}
+
+// deadSpace returns the fraction of the data files which can be
+// reclaimed by a merge, mu must be held.
+func (st *bitcaskStore) deadSpace() (float64, error) {
+	if st.db == nil {
+		return 0, storage.ErrClosed
+	}
+	var size, reclaimable int64
+	for name, s := range st.db.allStores() {
+		stats, err := s.Stats()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		size += stats.Size
+		reclaimable += s.Reclaimable()
+	}
+	if size <= 0 {
+		return 0, nil
+	}
+	return float64(reclaimable) / float64(size), nil
+}
+
+// Stats returns the statistics of every namespace. The backend
+// counters are the number of data files of all the namespaces.
+func (st *bitcaskStore) Stats() (storage.Stats, error) {
+	st.log.Debugf("stats: all namespaces")
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return storage.Stats{}, st.logError("stats", storage.ErrClosed)
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	var datafiles int64
+	for name, s := range st.db.allStores() {
+		bs, err := s.Stats()
+		if err != nil {
+			return storage.Stats{}, st.logError("stats", fmt.Errorf("%s: %w", name, err))
+		}
+		datafiles += int64(bs.Datafiles)
+		var ns storage.NamespaceStats
+		for _, k := range bitcaskKeys(s) {
+			v, err := s.Get(k)
+			if err != nil {
+				return storage.Stats{}, st.logError("stats", fmt.Errorf("%s: %w", name, err))
+			}
+			ns.Keys++
+			ns.ValueBytes += int64(len(v))
+		}
+		if ns.Keys > 0 {
+			stats.Add(name, ns)
+		}
+	}
+	var err error
+	if stats.DiskBytes, err = storage.DirSize(st.path); err != nil {
+		return storage.Stats{}, st.logError("stats", err)
+	}
+	if stats.DeadSpace, err = st.deadSpace(); err != nil {
+		return storage.Stats{}, st.logError("stats", err)
+	}
+	stats.Backend = map[string]int64{"datafiles": datafiles}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace from the bitcask index.
+func (st *bitcaskStore) Count(name string) (int64, error) {
+	st.log.Debugf("count: keys in namespace: %s", name)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.db == nil {
+		return 0, st.logError("count", storage.ErrClosed)
+	}
+	var count int64
+	if ns := st.db.store(name); ns != nil {
+		count = int64(ns.Len())
+	}
+	if count <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, st.logError("count", err)
+	}
+	return count, nil
+}
+
 // Close closes the datastore and releases all db resources.
 func (st *bitcaskStore) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.close()
+}
+
+// close closes the store, mu must be held for writing.
+func (st *bitcaskStore) close() error {
 	st.log.Debugf("closing store at path: %s", st.path)
-	err := st.db.CloseAll()
+	if st.db == nil {
+		return st.logError("close", storage.ErrClosed)
+	}
+	err := st.db.closeAll()
 	st.db = nil
 	st.log.Info("store closed")
-	if errors.Is(err, bitcask.ErrNoStores) {
-		return nil
-	}
 	return st.logError("close", err)
 }
 
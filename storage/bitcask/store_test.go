@@ -1,11 +1,98 @@
 package bitcask
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
-	"git.tcp.direct/kayos/chestnut/storage/store_test"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
 )
 
 func TestStore(t *testing.T) {
-	store_test.TestStore(t, NewStore)
+	storagetest.RunConformance(t, NewStore,
+		storagetest.WithRestore(Restore),
+		storagetest.WithExportArchive(storeName+".tar.gz"))
+}
+
+func TestStore_Restore(t *testing.T) {
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	assert.NoError(t, store.Put("d", []byte("e"), []byte("f")))
+	dir := t.TempDir()
+	assert.NoError(t, store.Export(dir))
+	path := filepath.Join(dir, storeName+".tar.gz")
+	dest := filepath.Join(t.TempDir(), "restored")
+	assert.NoError(t, Restore(path, dest))
+	restored := NewStore(dest)
+	assert.NoError(t, restored.Open())
+	want, err := store.ListAll()
+	assert.NoError(t, err)
+	got, err := restored.ListAll()
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+	v, err := restored.Get("d", []byte("e"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("f"), v)
+	assert.NoError(t, restored.Close())
+	// a restore does not replace data unless asked to
+	assert.ErrorIs(t, Restore(path, dest), storage.ErrPathExists)
+	assert.NoError(t, Restore(path, dest, storage.WithOverwrite()))
+	restored = NewStore(dest)
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	v, err = restored.Get("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), v)
+}
+
+func TestStore_ExportConcurrency(t *testing.T) {
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	// calls made while the store is archived wait for it to be reopened
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := []byte(fmt.Sprint(i))
+			assert.NoError(t, store.Put("a", key, key))
+			v, err := store.Get("a", key)
+			assert.NoError(t, err)
+			assert.Equal(t, key, v)
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, storage.ExportTo(store, io.Discard))
+	}
+	wg.Wait()
+	keys, err := store.List("a")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 11)
+}
+
+func TestStore_StoreNames(t *testing.T) {
+	path := t.TempDir()
+	store := NewStore(path)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("b", []byte("k"), []byte("v")))
+	assert.NoError(t, store.Put("a", []byte("k"), []byte("v")))
+	assert.NoError(t, store.RenameNamespace("b", "c"))
+	data, err := os.ReadFile(filepath.Join(path, "stores.json"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["a","c"]`, string(data))
+	// the names are replaced, not left in temporary files
+	tmp, err := filepath.Glob(filepath.Join(path, ".stores-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, tmp)
 }
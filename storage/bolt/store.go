@@ -3,10 +3,11 @@ package bolt
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
-	jsoniter "github.com/json-iterator/go"
 	bolt "go.etcd.io/bbolt"
 
 	"git.tcp.direct/kayos/chestnut/log"
@@ -17,6 +18,9 @@ const (
 	logName   = "bolt"
 	storeName = "chest.db"
 	storeExt  = ".db"
+	// compactTxSize is the size of the transactions which copy
+	// the entries to the compacted store.
+	compactTxSize = 64 << 20
 )
 
 // boltStore is an implementation the Storage interface for bbolt
@@ -24,11 +28,19 @@ const (
 type boltStore struct {
 	opts storage.StoreOptions
 	path string
-	db   *bolt.DB
-	log  log.Logger
+	// mu is held for writing while db is opened, closed or
+	// replaced by Compact, and for reading while it is used.
+	mu  sync.RWMutex
+	db  *bolt.DB
+	log log.Logger
 }
 
-var _ storage.Storage = (*boltStore)(nil)
+var (
+	_ storage.Storage        = (*boltStore)(nil)
+	_ storage.Compactor      = (*boltStore)(nil)
+	_ storage.StatsStorage   = (*boltStore)(nil)
+	_ storage.StreamExporter = (*boltStore)(nil)
+)
 
 // NewStore is used to instantiate a datastore backed by bbolt.
 func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
@@ -48,6 +60,8 @@ func (s *boltStore) Options() storage.StoreOptions {
 // Open opens the store.
 func (s *boltStore) Open() (err error) {
 	s.log.Debugf("opening store at path: %s", s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var path string
 	path, err = ensureDBPath(s.path)
 	if err != nil {
@@ -56,7 +70,7 @@ func (s *boltStore) Open() (err error) {
 	}
 	s.db, err = bolt.Open(path, 0600, nil)
 	if err != nil {
-		err = s.logError("open", err)
+		err = s.logError("open", wrapError(err))
 		return
 	}
 	if s.db == nil {
@@ -86,7 +100,7 @@ func (s *boltStore) Put(name string, key []byte, value []byte) error {
 		}
 		return b.Put(key, value)
 	}
-	return s.logError("put", s.db.Update(putValue))
+	return s.logError("put", s.update(putValue))
 }
 
 // Get a value from the store.
@@ -100,18 +114,20 @@ func (s *boltStore) Get(name string, key []byte) ([]byte, error) {
 		s.log.Debugf("get: tx key: %s.%s", name, key)
 		b := tx.Bucket([]byte(name))
 		if b == nil {
-			return fmt.Errorf("bucket not found: %s", name)
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
 		}
 		v := b.Get(key)
 		if len(v) <= 0 {
-			return errors.New("nil value")
+			return fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
 		}
-		value = v
+		// bolt values are only valid for the life of the transaction
+		value = make([]byte, len(v))
+		copy(value, v)
 		s.log.Debugf("get: tx key: %s.%s value (%d bytes)",
 			name, string(key), len(value))
 		return nil
 	}
-	if err := s.db.View(getValue); err != nil {
+	if err := s.view(getValue); err != nil {
 		return nil, s.logError("get", err)
 	}
 	return value, nil
@@ -119,7 +135,7 @@ func (s *boltStore) Get(name string, key []byte) ([]byte, error) {
 
 // Save the value in v and store the result at key.
 func (s *boltStore) Save(name string, key []byte, v interface{}) error {
-	b, err := jsoniter.Marshal(v)
+	b, err := s.opts.Serializer().Marshal(v)
 	if err != nil {
 		return s.logError("save", err)
 	}
@@ -132,7 +148,7 @@ func (s *boltStore) Load(name string, key []byte, v interface{}) error {
 	if err != nil {
 		return s.logError("load", err)
 	}
-	return s.logError("load", jsoniter.Unmarshal(b, v))
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
 }
 
 // Has checks for a key in the store.
@@ -146,8 +162,8 @@ func (s *boltStore) Has(name string, key []byte) (bool, error) {
 		s.log.Debugf("has: tx get namespace: %s", name)
 		b := tx.Bucket([]byte(name))
 		if b == nil {
-			err := fmt.Errorf("bucket not found: %s", name)
-			return err
+			s.log.Debugf("has: tx namespace not found: %s", name)
+			return nil
 		}
 		v := b.Get(key)
 		has = len(v) > 0
@@ -156,7 +172,7 @@ func (s *boltStore) Has(name string, key []byte) (bool, error) {
 		}
 		return nil
 	}
-	if err := s.db.View(hasKey); err != nil {
+	if err := s.view(hasKey); err != nil {
 		return false, s.logError("has", err)
 	}
 	s.log.Debugf("has: found key %s: %t", key, has)
@@ -173,14 +189,13 @@ func (s *boltStore) Delete(name string, key []byte) error {
 		s.log.Debugf("delete: tx key: %s.%s", name, string(key))
 		b := tx.Bucket([]byte(name))
 		if b == nil {
-			err := fmt.Errorf("bucket not found: %s", name)
-			// an error just means we couldn't find the bucket
-			s.log.Warn(err)
+			// there is nothing to delete if we couldn't find the bucket
+			s.log.Debugf("delete: tx namespace not found: %s", name)
 			return nil
 		}
 		return b.Delete(key)
 	}
-	return s.logError("delete", s.db.Update(del))
+	return s.logError("delete", s.update(del))
 }
 
 // List returns a list of all keys in the namespace.
@@ -189,13 +204,12 @@ func (s *boltStore) List(name string) (keys [][]byte, err error) {
 	listKeys := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
 		if b == nil {
-			err = fmt.Errorf("bucket not found: %s", name)
-			return err
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
 		}
 		keys, err = s.listKeys(name, b)
 		return err
 	}
-	if err = s.db.View(listKeys); err != nil {
+	if err = s.view(listKeys); err != nil {
 		return nil, s.logError("list", err)
 	}
 	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
@@ -215,7 +229,7 @@ func (s *boltStore) listKeys(name string, b *bolt.Bucket) ([][]byte, error) {
 	var i int
 	_ = b.ForEach(func(k, _ []byte) error {
 		s.log.Debugf("list: tx found key: %s.%s", name, string(k))
-		keys[i] = k
+		keys[i] = append([]byte(nil), k...)
 		i++
 		return nil
 	})
@@ -242,13 +256,183 @@ func (s *boltStore) ListAll() (map[string][][]byte, error) {
 		})
 		return err
 	}
-	if err := s.db.View(listKeys); err != nil {
+	if err := s.view(listKeys); err != nil {
 		return nil, s.logError("list", err)
 	}
 	s.log.Debugf("list: found %d keys: %s", total, allKeys)
 	return allKeys, nil
 }
 
+// ListNamespaces returns the names of the buckets which have keys.
+func (s *boltStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	names := []string{}
+	listBuckets := func(tx *bolt.Tx) error {
+		// buckets are iterated in byte order, so the names are sorted
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if hasKeys(b) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	}
+	if err := s.view(listBuckets); err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace deletes the bucket of the namespace.
+func (s *boltStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	drop := func(tx *bolt.Tx) error {
+		if !hasKeys(tx.Bucket([]byte(name))) {
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		}
+		return tx.DeleteBucket([]byte(name))
+	}
+	return s.logError("drop", s.update(drop))
+}
+
+// RenameNamespace copies the bucket of namespace from to a new bucket and
+// deletes it, in a single transaction.
+func (s *boltStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	rename := func(tx *bolt.Tx) error {
+		if err := copyBucket(tx, from, to); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(from))
+	}
+	return s.logError("rename", s.update(rename))
+}
+
+// CopyNamespace copies the bucket of namespace from to a new bucket.
+func (s *boltStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	copyNamespace := func(tx *bolt.Tx) error {
+		return copyBucket(tx, from, to)
+	}
+	return s.logError("copy", s.update(copyNamespace))
+}
+
+// copyBucket copies every key in bucket from to a new bucket to. An
+// empty bucket to, which deletes can leave behind, is replaced.
+func copyBucket(tx *bolt.Tx, from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	}
+	src := tx.Bucket([]byte(from))
+	if !hasKeys(src) {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	}
+	if dst := tx.Bucket([]byte(to)); hasKeys(dst) {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	} else if dst != nil {
+		if err := tx.DeleteBucket([]byte(to)); err != nil {
+			return err
+		}
+	}
+	dst, err := tx.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	// keys are put in order, so the pages can be filled
+	dst.FillPercent = 1
+	return src.ForEach(func(k, v []byte) error {
+		return dst.Put(k, v)
+	})
+}
+
+// hasKeys returns true if the bucket is found and has at least one key.
+func hasKeys(b *bolt.Bucket) bool {
+	if b == nil {
+		return false
+	}
+	k, _ := b.Cursor().First()
+	return k != nil
+}
+
+// Stats returns the statistics of the store. The backend counters are
+// the page statistics of the buckets and of the database.
+func (s *boltStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	var buckets bolt.BucketStats
+	var db bolt.Stats
+	var path string
+	collect := func(tx *bolt.Tx) error {
+		path = tx.DB().Path()
+		db = tx.DB().Stats()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bs := b.Stats()
+			buckets.Add(bs)
+			ns := storage.NamespaceStats{Keys: int64(bs.KeyN)}
+			err := b.ForEach(func(_, v []byte) error {
+				ns.ValueBytes += int64(len(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if ns.Keys > 0 {
+				stats.Add(string(name), ns)
+			}
+			return nil
+		})
+	}
+	if err := s.view(collect); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	var err error
+	if stats.DiskBytes, err = storage.DirSize(path); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	if stats.DeadSpace, err = s.DeadSpace(); err != nil {
+		return storage.Stats{}, err
+	}
+	stats.Backend = map[string]int64{
+		"branch_pages":       int64(buckets.BranchPageN),
+		"branch_overflow":    int64(buckets.BranchOverflowN),
+		"leaf_pages":         int64(buckets.LeafPageN),
+		"leaf_overflow":      int64(buckets.LeafOverflowN),
+		"branch_alloc_bytes": int64(buckets.BranchAlloc),
+		"branch_inuse_bytes": int64(buckets.BranchInuse),
+		"leaf_alloc_bytes":   int64(buckets.LeafAlloc),
+		"leaf_inuse_bytes":   int64(buckets.LeafInuse),
+		"depth":              int64(buckets.Depth),
+		"free_pages":         int64(db.FreePageN),
+		"pending_pages":      int64(db.PendingPageN),
+		"free_alloc_bytes":   int64(db.FreeAlloc),
+		"read_txs":           int64(db.TxN),
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace from the bucket statistics.
+func (s *boltStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	var count int64
+	countKeys := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		}
+		count = int64(b.Stats().KeyN)
+		return nil
+	}
+	if err := s.view(countKeys); err != nil {
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
 // Export copies the datastore to directory at path.
 func (s *boltStore) Export(path string) error {
 	s.log.Debugf("export: to path: %s", path)
@@ -264,7 +448,7 @@ func (s *boltStore) Export(path string) error {
 	if err != nil {
 		return s.logError("export", err)
 	}
-	err = s.db.View(func(tx *bolt.Tx) error {
+	err = s.view(func(tx *bolt.Tx) error {
 		return tx.CopyFile(path, 0600)
 	})
 	if err != nil {
@@ -274,15 +458,167 @@ func (s *boltStore) Export(path string) error {
 	return nil
 }
 
+// ExportTo streams an export archive of the database to w, with the
+// database file written from a read transaction by bolt's tx.WriteTo.
+func (s *boltStore) ExportTo(w io.Writer) error {
+	s.log.Debug("export: to writer")
+	err := s.view(func(tx *bolt.Tx) error {
+		aw := storage.NewArchiveWriter(w)
+		err := aw.WriteStream(storage.ArchiveExportName+storeExt, tx.Size(), func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return aw.Close()
+	})
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debug("export: to writer complete")
+	return nil
+}
+
+// Restore restores an archive of a single database file for NewStore(destPath).
+// SEE: storage.RestoreArchiveFile.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	path, err := ensureDBPath(destPath)
+	if err != nil {
+		return err
+	}
+	return storage.RestoreArchiveFile(archivePath, path, opt...)
+}
+
 // Close closes the datastore and releases all db resources.
 func (s *boltStore) Close() error {
 	s.log.Debugf("closing store at path: %s", s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
 	err := s.db.Close()
 	s.db = nil
 	s.log.Info("store closed")
 	return s.logError("close", err)
 }
 
+// Compact rewrites the store to a new file without its free pages, and
+// replaces the store with it. Other calls wait until it is done.
+func (s *boltStore) Compact() error {
+	s.log.Debugf("compact: store at path: %s", s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return s.logError("compact", storage.ErrClosed)
+	}
+	path := s.db.Path()
+	before, err := os.Stat(path)
+	if err != nil {
+		return s.logError("compact", err)
+	}
+	tmp := path + ".compact"
+	if err = os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return s.logError("compact", err)
+	}
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return s.logError("compact", wrapError(err))
+	}
+	if err = bolt.Compact(dst, s.db, compactTxSize); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return s.logError("compact", wrapError(err))
+	}
+	if err = dst.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return s.logError("compact", err)
+	}
+	if err = s.db.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return s.logError("compact", err)
+	}
+	// the store is reopened, compacted or not, so it stays usable
+	if err = os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+	}
+	db, openErr := bolt.Open(path, 0600, nil)
+	if openErr != nil {
+		s.db = nil
+		return s.logError("compact", wrapError(openErr))
+	}
+	s.db = db
+	if err != nil {
+		return s.logError("compact", err)
+	}
+	if after, err := os.Stat(path); err == nil {
+		s.log.Infof("compact: reclaimed %d bytes", before.Size()-after.Size())
+	}
+	return nil
+}
+
+// Merge compacts the store, bolt keeps the store in a single file.
+func (s *boltStore) Merge() error {
+	return s.Compact()
+}
+
+// DeadSpace returns the fraction of the store file used by free pages.
+func (s *boltStore) DeadSpace() (float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return 0, s.logError("dead space", storage.ErrClosed)
+	}
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return 0, s.logError("dead space", err)
+	} else if info.Size() <= 0 {
+		return 0, nil
+	}
+	stats := s.db.Stats()
+	return float64(stats.FreeAlloc) / float64(info.Size()), nil
+}
+
+// view runs fn in a read-only transaction.
+func (s *boltStore) view(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.View(fn))
+}
+
+// update runs fn in a read-write transaction.
+func (s *boltStore) update(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.Update(fn))
+}
+
+// wrapError wraps bolt errors with the matching storage error.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, bolt.ErrDatabaseNotOpen):
+		return storage.WrapError(storage.ErrClosed, err)
+	case errors.Is(err, bolt.ErrDatabaseReadOnly),
+		errors.Is(err, bolt.ErrTxNotWritable):
+		return storage.WrapError(storage.ErrReadOnly, err)
+	case errors.Is(err, bolt.ErrInvalid),
+		errors.Is(err, bolt.ErrChecksum),
+		errors.Is(err, bolt.ErrVersionMismatch):
+		return storage.WrapError(storage.ErrCorrupt, err)
+	default:
+		return err
+	}
+}
+
 func (s *boltStore) logError(name string, err error) error {
 	if err == nil {
 		return nil
@@ -1,11 +1,72 @@
 package bolt
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
-	"git.tcp.direct/kayos/chestnut/storage/store_test"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/encryptor/crypto"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/archive"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
 )
 
 func TestStore(t *testing.T) {
-	store_test.TestStore(t, NewStore)
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_Compact(t *testing.T) {
+	store := NewStore(t.TempDir()).(storage.Compactor)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	value := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, store.Put("n", []byte(fmt.Sprint(i)), value))
+	}
+	for i := 10; i < 1000; i++ {
+		assert.NoError(t, store.Delete("n", []byte(fmt.Sprint(i))))
+	}
+	dead, err := store.DeadSpace()
+	assert.NoError(t, err)
+	assert.Greater(t, dead, 0.5)
+	path := store.(*boltStore).db.Path()
+	before, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Compact())
+	after, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+	dead, err = store.DeadSpace()
+	assert.NoError(t, err)
+	assert.Less(t, dead, 0.5)
+	keys, err := store.List("n")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 10)
+	assert.NoError(t, store.Put("n", []byte("new"), value))
+}
+
+func TestRestore(t *testing.T) {
+	secret := crypto.TextSecret("i-am-a-backup-secret")
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("n", []byte("k"), []byte("v")))
+	path := filepath.Join(t.TempDir(), "chest.arc")
+	assert.NoError(t, archive.Export(store, path, secret))
+	// the archive is restored to the file the store at a directory opens
+	dest := t.TempDir()
+	assert.NoError(t, Restore(path, dest, archive.WithSecret(secret)))
+	restored := NewStore(dest)
+	assert.NoError(t, restored.Open())
+	v, err := restored.Get("n", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+	assert.NoError(t, restored.Close())
+	err = Restore(path, dest, archive.WithSecret(secret))
+	assert.ErrorIs(t, err, storage.ErrPathExists)
+	err = Restore(path, dest, archive.WithSecret(crypto.TextSecret("wrong")), storage.WithOverwrite())
+	assert.ErrorIs(t, err, archive.ErrAuthentication)
 }
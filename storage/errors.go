@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by stores and by Chestnut. Stores wrap these errors so
+// callers can check for them with errors.Is rather than matching strings
+// returned by the backing store.
+var (
+	// ErrInvalidKey the storage key is invalid.
+	ErrInvalidKey = errors.New("invalid storage key")
+
+	// ErrNotFound the key was not found.
+	ErrNotFound = errors.New("not found")
+
+	// ErrNamespaceNotFound the namespace was not found. It wraps
+	// ErrNotFound, so errors.Is(err, ErrNotFound) is also true.
+	ErrNamespaceNotFound = fmt.Errorf("namespace %w", ErrNotFound)
+
+	// ErrNamespaceExists the namespace already exists.
+	ErrNamespaceExists = errors.New("namespace exists")
+
+	// ErrPathExists a restore would overwrite data at the path, or in the store.
+	ErrPathExists = errors.New("path exists")
+
+	// ErrClosed the store is closed, or was never opened.
+	ErrClosed = errors.New("store is closed")
+
+	// ErrReadOnly the store does not allow writes.
+	ErrReadOnly = errors.New("store is read only")
+
+	// ErrCorrupt the stored data is corrupt.
+	ErrCorrupt = errors.New("corrupt data")
+
+	// ErrDecrypt the stored data could not be decrypted.
+	ErrDecrypt = errors.New("decryption failed")
+
+	// ErrNotSupported the store does not support the operation.
+	ErrNotSupported = errors.New("operation not supported")
+)
+
+// WrapError returns err wrapped with the sentinel error kind, keeping the
+// message of the original error. If err is nil, or already is kind,
+// it is returned unchanged.
+func WrapError(kind, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", kind, err)
+}
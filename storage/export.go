@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// StreamExporter is implemented by stores which can stream an export
+// archive of the store, without staging a copy of it on disk.
+type StreamExporter interface {
+	Storage
+
+	// ExportTo writes an export archive of the store to w, which is
+	// restored with the Restore function of the store's package.
+	ExportTo(w io.Writer) error
+}
+
+// ExportTo writes an export archive of store to w, SEE: StreamExporter.
+// If the store is not a StreamExporter, it is exported to a temporary
+// directory which is archived to w.
+func ExportTo(store Storage, w io.Writer) error {
+	if s, ok := store.(StreamExporter); ok {
+		return s.ExportTo(w)
+	}
+	tmp, err := os.MkdirTemp("", "chestnut-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err = store.Export(filepath.Join(tmp, ArchiveExportName)); err != nil {
+		return err
+	}
+	aw := NewArchiveWriter(w)
+	if err = aw.WriteDir(tmp, ""); err != nil {
+		return err
+	}
+	return aw.Close()
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// maxNameLen is the longest file name most file systems allow.
+const maxNameLen = 255
+
+const hexDigits = "0123456789ABCDEF"
+
+// encodeName returns a file name for a namespace or key. Lower case letters,
+// digits, '-', '_', and '.' are kept so names stay readable, every other byte
+// is escaped as %XX. Upper case letters are escaped so names which differ only
+// in case do not share a file on case-insensitive file systems. A leading '.'
+// is also escaped so that names are never hidden, or the special "." and ".."
+// directories. Temporary files start with a '.' so they can never be mistaken
+// for a record. A name too long to be a file name wraps ErrInvalidKey.
+func encodeName(name []byte) (string, error) {
+	if len(name) <= 0 {
+		return "", errors.New("name cannot be empty")
+	}
+	var b strings.Builder
+	b.Grow(len(name))
+	for i, c := range name {
+		if shouldEscape(c, i == 0) {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if b.Len() > maxNameLen {
+		return "", fmt.Errorf("%w: encoded name is longer than %d bytes", storage.ErrInvalidKey, maxNameLen)
+	}
+	return b.String(), nil
+}
+
+// decodeName returns the namespace or key for a file name.
+func decodeName(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+	name := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			if shouldEscape(c, i == 0) {
+				return nil, fmt.Errorf("invalid name: %s", s)
+			}
+			name = append(name, c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("invalid escape in name: %s", s)
+		}
+		hi, ok1 := unhex(s[i+1])
+		lo, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid escape in name: %s", s)
+		}
+		name = append(name, hi<<4|lo)
+		i += 2
+	}
+	return name, nil
+}
+
+func shouldEscape(c byte, first bool) bool {
+	switch {
+	case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		return false
+	case c == '-', c == '_':
+		return false
+	case c == '.':
+		return first
+	default:
+		return true
+	}
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,744 @@
+// Package fs provides an implementation of the storage.Storage interface
+// which keeps each record in its own file. Each namespace is a directory
+// in the store path, and each key is a file in the namespace directory.
+// Since values stay encrypted, the store can be backed up with file
+// backup tools, or kept in git.
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	logName   = "fs"
+	tmpPrefix = ".tmp-"
+)
+
+// fsStore is an implementation the Storage interface for the file system.
+type fsStore struct {
+	opts storage.StoreOptions
+	path string
+	mu   sync.RWMutex
+	open bool
+	log  log.Logger
+}
+
+var (
+	_ storage.Storage        = (*fsStore)(nil)
+	_ storage.StatsStorage   = (*fsStore)(nil)
+	_ storage.StreamExporter = (*fsStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore in the directory at path.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	return &fsStore{path: path, opts: opts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *fsStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open opens the store, creating the store directory if needed.
+func (s *fsStore) Open() error {
+	s.log.Debugf("opening store at path: %s", s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return s.logError("open", err)
+	}
+	s.open = true
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store. The value is written to a temporary file
+// which is synced, and then renamed over the record, so a record is
+// never partially written.
+func (s *fsStore) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("put", err)
+	} else if len(value) <= 0 {
+		err = errors.New("value cannot be empty")
+		return s.logError("put", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return s.logError("put", storage.ErrClosed)
+	}
+	dir, path, err := s.recordPath(name, key)
+	if err != nil {
+		return s.logError("put", err)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return s.logError("put", err)
+	}
+	if err = writeFile(path, value); err != nil {
+		return s.logError("put", err)
+	}
+	return nil
+}
+
+// Get a value from the store.
+func (s *fsStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	dir, path, err := s.recordPath(name, key)
+	if err != nil {
+		return nil, s.logError("get", err)
+	}
+	value, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, dirErr := os.Stat(dir); os.IsNotExist(dirErr) {
+			err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		} else {
+			err = fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		}
+		return nil, s.logError("get", err)
+	} else if err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *fsStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *fsStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *fsStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	_, path, err := s.recordPath(name, key)
+	if err != nil {
+		return false, s.logError("has", err)
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		s.log.Debugf("has: found key %s: %t", key, false)
+		return false, nil
+	} else if err != nil {
+		return false, s.logError("has", err)
+	}
+	has := info.Mode().IsRegular()
+	s.log.Debugf("has: found key %s: %t", key, has)
+	return has, nil
+}
+
+// Delete removes a key from the store.
+func (s *fsStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	dir, path, err := s.recordPath(name, key)
+	if err != nil {
+		return s.logError("delete", err)
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		s.log.Debugf("delete: key not found: %s.%s", name, key)
+		return nil
+	} else if err != nil {
+		return s.logError("delete", err)
+	}
+	return s.logError("delete", syncDir(dir))
+}
+
+// List returns a list of all keys in the namespace.
+func (s *fsStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	dirName, err := encodeName([]byte(name))
+	if err != nil {
+		return nil, s.logError("list", storage.WrapError(storage.ErrInvalidKey, err))
+	}
+	keys, err := s.listKeys(filepath.Join(s.path, dirName))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	} else if err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *fsStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, s.logError("list", err)
+	}
+	var total int
+	allKeys := map[string][][]byte{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := decodeName(e.Name())
+		if err != nil {
+			s.log.Warnf("list: skipping directory: %s", err)
+			continue
+		}
+		keys, err := s.listKeys(filepath.Join(s.path, e.Name()))
+		if err != nil {
+			return nil, s.logError("list", err)
+		}
+		if len(keys) <= 0 {
+			continue
+		}
+		allKeys[string(name)] = keys
+		total += len(keys)
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespace directories
+// which have records.
+func (s *fsStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, s.logError("list", err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := decodeName(e.Name())
+		if err != nil {
+			s.log.Warnf("list: skipping directory: %s", err)
+			continue
+		}
+		has, err := hasRecords(filepath.Join(s.path, e.Name()))
+		if err != nil {
+			return nil, s.logError("list", err)
+		}
+		if has {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace removes the namespace directory and every record in it.
+func (s *fsStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	dir, err := s.namespacePath(name)
+	if err != nil {
+		return s.logError("drop", err)
+	}
+	if has, err := hasRecords(dir); err != nil {
+		return s.logError("drop", err)
+	} else if !has {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return s.logError("drop", err)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return s.logError("drop", err)
+	}
+	return s.logError("drop", syncDir(s.path))
+}
+
+// RenameNamespace renames the namespace directory.
+func (s *fsStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromDir, toDir, err := s.checkNamespaces(from, to)
+	if err != nil {
+		return s.logError("rename", err)
+	}
+	// the directory of an empty namespace may be left behind by deletes
+	if err = os.RemoveAll(toDir); err != nil {
+		return s.logError("rename", err)
+	}
+	if err = os.Rename(fromDir, toDir); err != nil {
+		return s.logError("rename", err)
+	}
+	return s.logError("rename", syncDir(s.path))
+}
+
+// CopyNamespace copies every record in the namespace directory to a new
+// namespace directory. If the copy fails the new directory is removed.
+func (s *fsStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromDir, toDir, err := s.checkNamespaces(from, to)
+	if err != nil {
+		return s.logError("copy", err)
+	}
+	if err = copyRecords(fromDir, toDir); err != nil {
+		_ = os.RemoveAll(toDir)
+		return s.logError("copy", err)
+	}
+	return nil
+}
+
+// checkNamespaces returns the directories of namespaces from and to, or an
+// error if from cannot be renamed or copied to to. The caller must hold the lock.
+func (s *fsStore) checkNamespaces(from, to string) (fromDir, toDir string, err error) {
+	if !s.open {
+		return "", "", storage.ErrClosed
+	}
+	if fromDir, err = s.namespacePath(from); err != nil {
+		return "", "", err
+	} else if toDir, err = s.namespacePath(to); err != nil {
+		return "", "", err
+	}
+	if has, err := hasRecords(fromDir); err != nil {
+		return "", "", err
+	} else if !has {
+		return "", "", fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	}
+	if has, err := hasRecords(toDir); err != nil {
+		return "", "", err
+	} else if has {
+		return "", "", fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	}
+	return fromDir, toDir, nil
+}
+
+// copyRecords copies the records in directory from to directory to.
+func copyRecords(from, to string) error {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(to, 0700); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), tmpPrefix) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(from, e.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = writeFile(filepath.Join(to, e.Name()), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRecords returns true if the directory dir has at least one record.
+func hasRecords(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), tmpPrefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Stats returns the statistics of the store from the sizes of the record
+// files, without reading them.
+func (s *fsStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := decodeName(e.Name())
+		if err != nil {
+			s.log.Warnf("stats: skipping directory: %s", err)
+			continue
+		}
+		ns, err := s.namespaceStats(filepath.Join(s.path, e.Name()))
+		if err != nil {
+			return storage.Stats{}, s.logError("stats", err)
+		}
+		if ns.Keys > 0 {
+			stats.Add(string(name), ns)
+		}
+	}
+	if stats.DiskBytes, err = storage.DirSize(s.path); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	return stats, nil
+}
+
+// Count returns the number of records in the namespace directory.
+func (s *fsStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	dirName, err := encodeName([]byte(name))
+	if err != nil {
+		return 0, s.logError("count", storage.WrapError(storage.ErrInvalidKey, err))
+	}
+	ns, err := s.namespaceStats(filepath.Join(s.path, dirName))
+	if os.IsNotExist(err) || err == nil && ns.Keys <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	} else if err != nil {
+		return 0, s.logError("count", err)
+	}
+	return ns.Keys, nil
+}
+
+// namespaceStats returns the number and total size of the records in dir.
+func (s *fsStore) namespaceStats(dir string) (storage.NamespaceStats, error) {
+	var ns storage.NamespaceStats
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ns, err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), tmpPrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			// deleted since the directory was read
+			continue
+		} else if err != nil {
+			return ns, err
+		}
+		ns.Keys++
+		ns.ValueBytes += info.Size()
+	}
+	return ns, nil
+}
+
+// listKeys returns the keys for the records in dir.
+func (s *fsStore) listKeys(dir string) ([][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), tmpPrefix) {
+			continue
+		}
+		key, err := decodeName(e.Name())
+		if err != nil {
+			s.log.Warnf("list: skipping file: %s", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// Export copies the store to path. If path ends with .tar.gz or .tgz the
+// store is written to a gzipped tarball, which is restored with Restore,
+// otherwise it is copied to the directory at path. Export will not write
+// to a path that has data in it.
+func (s *fsStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if filepath.Clean(s.path) == filepath.Clean(path) {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return s.logError("export", storage.ErrClosed)
+	}
+	var err error
+	if isTarball(path) {
+		err = s.exportTarball(path)
+	} else {
+		err = s.exportDir(path)
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// ExportTo streams an export archive of the records in the store to w,
+// the same archive Export writes to a tarball.
+func (s *fsStore) ExportTo(w io.Writer) error {
+	s.log.Debug("export: to writer")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return s.logError("export", storage.ErrClosed)
+	}
+	if err := s.exportTo(w); err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debug("export: to writer complete")
+	return nil
+}
+
+// Restore restores an export archive for NewStore(destPath). SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
+func (s *fsStore) exportDir(path string) error {
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return fmt.Errorf("path is not empty: %s", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.walkRecords(func(rel string, f *os.File, _ os.FileInfo) error {
+		target := filepath.Join(path, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		value, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return writeFile(target, value)
+	})
+}
+
+func (s *fsStore) exportTarball(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = s.exportTo(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// exportTo writes an export archive of the records in the store to w.
+func (s *fsStore) exportTo(w io.Writer) error {
+	aw := storage.NewArchiveWriter(w)
+	err := s.walkRecords(func(rel string, f *os.File, info os.FileInfo) error {
+		return aw.WriteFile(storage.ArchiveExportName+"/"+filepath.ToSlash(rel), info, f)
+	})
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// walkRecords calls fn with the path relative to the store, the open
+// file, and the file info of every record in the store.
+func (s *fsStore) walkRecords(fn func(rel string, f *os.File, info os.FileInfo) error) error {
+	return filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(rel, f, info)
+	})
+}
+
+// Close closes the store.
+func (s *fsStore) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("close", storage.ErrClosed)
+	}
+	s.open = false
+	s.log.Info("store closed")
+	return nil
+}
+
+// recordPath returns the namespace directory and record file for a key.
+func (s *fsStore) recordPath(name string, key []byte) (dir string, path string, err error) {
+	if dir, err = s.namespacePath(name); err != nil {
+		return "", "", err
+	}
+	fileName, err := encodeName(key)
+	if err != nil {
+		return "", "", storage.WrapError(storage.ErrInvalidKey, err)
+	}
+	return dir, filepath.Join(dir, fileName), nil
+}
+
+// namespacePath returns the directory of a namespace.
+func (s *fsStore) namespacePath(name string) (string, error) {
+	if err := storage.ValidNamespace(name); err != nil {
+		return "", err
+	}
+	dirName, err := encodeName([]byte(name))
+	if err != nil {
+		return "", storage.WrapError(storage.ErrInvalidKey, err)
+	}
+	return filepath.Join(s.path, dirName), nil
+}
+
+func isTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// writeFile atomically replaces the file at path with b. The data
+// and the rename are synced before writeFile returns.
+func writeFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, tmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs the directory so that renames and removes in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (s *fsStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
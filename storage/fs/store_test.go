@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_ExportTarball(t *testing.T) {
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("c/c"), []byte("d")))
+	assert.NoError(t, store.Put("a", []byte(".d"), []byte("e")))
+	path := filepath.Join(t.TempDir(), "chest.tar.gz")
+	assert.NoError(t, store.Export(path))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(0))
+	// an existing archive is not overwritten
+	assert.Error(t, store.Export(path))
+	dest := filepath.Join(t.TempDir(), "restored")
+	assert.NoError(t, Restore(path, dest))
+	restored := NewStore(dest)
+	assert.NoError(t, restored.Open())
+	v, err := restored.Get("a", []byte("c/c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), v)
+	assert.NoError(t, restored.Close())
+	// a restore does not replace data unless asked to
+	assert.ErrorIs(t, Restore(path, dest), storage.ErrPathExists)
+	assert.NoError(t, Restore(path, dest, storage.WithOverwrite()))
+}
+
+func TestEncodeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"a", "a"},
+		{"c/c", "c%2Fc"},
+		{".d", "%2Ed"},
+		{"..", "%2E."},
+		{"a.b", "a.b"},
+		{"%", "%25"},
+		{"a b", "a%20b"},
+		{"\x00\xff", "%00%FF"},
+		{"A", "%41"},
+		{"aZ", "a%5A"},
+	}
+	for _, test := range tests {
+		encoded, err := encodeName([]byte(test.name))
+		assert.NoError(t, err)
+		assert.Equal(t, test.encoded, encoded)
+		name, err := decodeName(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, test.name, string(name))
+	}
+	_, err := encodeName(nil)
+	assert.Error(t, err)
+	_, err = encodeName([]byte(strings.Repeat("/", maxNameLen)))
+	assert.ErrorIs(t, err, storage.ErrInvalidKey)
+	for _, name := range []string{"", ".d", "c/c", "%2", "%2e", "%G0", "A"} {
+		_, err = decodeName(name)
+		assert.Error(t, err, name)
+	}
+}
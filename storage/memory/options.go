@@ -0,0 +1,52 @@
+package memory
+
+import (
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the memory store specific options.
+type options struct {
+	snapshot string
+}
+
+var defaultOptions = options{}
+
+// memoryOption is implemented by StoreOptions that configure the memory store.
+type memoryOption interface {
+	storage.StoreOption
+	applyMemory(*options)
+}
+
+// memoryFuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type memoryFuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o memoryFuncOption) applyMemory(opts *options) {
+	o.f(opts)
+}
+
+func newMemoryOption(f func(*options)) storage.StoreOption {
+	return memoryFuncOption{f: f}
+}
+
+// applyMemoryOptions applies the memory store specific options in opt.
+func applyMemoryOptions(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if mo, ok := o.(memoryOption); ok {
+			mo.applyMemory(&opts)
+		}
+	}
+	return opts
+}
+
+// WithSnapshot returns a StoreOption which loads the store from the
+// export at path when the store is first opened. If there is no export
+// at path the store starts empty. The store cannot be exported to path.
+func WithSnapshot(path string) storage.StoreOption {
+	return newMemoryOption(func(o *options) {
+		o.snapshot = path
+	})
+}
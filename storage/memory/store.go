@@ -0,0 +1,556 @@
+// Package memory provides an in-memory implementation of the storage.Storage
+// interface. Nothing is written to disk unless the store is exported, which
+// makes it a good fit for tests and short-lived processes.
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	logName   = "memory"
+	storeName = "chest.json"
+	storeExt  = ".json"
+
+	snapshotVersion = 1
+)
+
+// snapshot is the file format used by Export and WithSnapshot.
+type snapshot struct {
+	Version    int                `json:"version"`
+	Namespaces map[string][]entry `json:"namespaces"`
+}
+
+type entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// memoryStore is an in-memory implementation the Storage interface.
+// Values are copied in and out of the store, so callers may reuse
+// the slices they pass to, or get from, the store.
+type memoryStore struct {
+	opts  storage.StoreOptions
+	mopts options
+	mu    sync.RWMutex
+	open  bool
+	data  map[string]map[string][]byte
+	log   log.Logger
+}
+
+var (
+	_ storage.Storage        = (*memoryStore)(nil)
+	_ storage.StatsStorage   = (*memoryStore)(nil)
+	_ storage.StreamExporter = (*memoryStore)(nil)
+)
+
+// NewStore is used to instantiate an in-memory datastore.
+func NewStore(opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	mopts := applyMemoryOptions(defaultOptions, opt...)
+	return &memoryStore{opts: opts, mopts: mopts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *memoryStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open opens the store. The first time the store is opened it is loaded
+// from the snapshot, if there is one. Closing the store does not discard
+// its data, so it can be opened again.
+func (s *memoryStore) Open() error {
+	s.log.Debug("opening store")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		data, err := s.load()
+		if err != nil {
+			return s.logError("open", err)
+		}
+		s.data = data
+	}
+	s.open = true
+	s.log.Info("opened store")
+	return nil
+}
+
+// Put an entry in the store.
+func (s *memoryStore) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("put", err)
+	} else if len(value) <= 0 {
+		err = errors.New("value cannot be empty")
+		return s.logError("put", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("put", storage.ErrClosed)
+	}
+	ns, ok := s.data[name]
+	if !ok {
+		ns = map[string][]byte{}
+		s.data[name] = ns
+	}
+	ns[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+// Get a value from the store.
+func (s *memoryStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	ns, ok := s.data[name]
+	if !ok {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("get", err)
+	}
+	v, ok := ns[string(key)]
+	if !ok {
+		err := fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(v))
+	return append([]byte(nil), v...), nil
+}
+
+// Save the value in v and store the result at key.
+func (s *memoryStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *memoryStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *memoryStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	_, has := s.data[name][string(key)]
+	s.log.Debugf("has: found key %s: %t", key, has)
+	return has, nil
+}
+
+// Delete removes a key from the store.
+func (s *memoryStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	// deleting from a nil map is a no-op if the namespace is not found
+	delete(s.data[name], string(key))
+	return nil
+}
+
+// List returns a list of all keys in the namespace, in byte order.
+func (s *memoryStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	ns, ok := s.data[name]
+	if !ok {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	keys := sortedKeys(ns)
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *memoryStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	var total int
+	allKeys := map[string][][]byte{}
+	for name, ns := range s.data {
+		if len(ns) <= 0 {
+			continue
+		}
+		allKeys[name] = sortedKeys(ns)
+		total += len(ns)
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+func (s *memoryStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	names := make([]string, 0, len(s.data))
+	for name, ns := range s.data {
+		if len(ns) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace removes a namespace and every key in it.
+func (s *memoryStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	if len(s.data[name]) <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return s.logError("drop", err)
+	}
+	delete(s.data, name)
+	return nil
+}
+
+// RenameNamespace moves every key in namespace from to namespace to.
+func (s *memoryStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkNamespaces(from, to); err != nil {
+		return s.logError("rename", err)
+	}
+	s.data[to] = s.data[from]
+	delete(s.data, from)
+	return nil
+}
+
+// CopyNamespace copies every key in namespace from to namespace to.
+func (s *memoryStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkNamespaces(from, to); err != nil {
+		return s.logError("copy", err)
+	}
+	// values are never changed in place, so they can be shared
+	ns := make(map[string][]byte, len(s.data[from]))
+	for k, v := range s.data[from] {
+		ns[k] = v
+	}
+	s.data[to] = ns
+	return nil
+}
+
+// checkNamespaces returns an error if namespace from cannot be renamed or
+// copied to namespace to. The caller must hold the lock.
+func (s *memoryStore) checkNamespaces(from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	} else if !s.open {
+		return storage.ErrClosed
+	} else if len(s.data[from]) <= 0 {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	} else if len(s.data[to]) > 0 {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the store. The snapshot
+// file, if there is one, is counted as the disk size.
+func (s *memoryStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	for name, ns := range s.data {
+		if len(ns) <= 0 {
+			continue
+		}
+		nsStats := storage.NamespaceStats{Keys: int64(len(ns))}
+		for _, v := range ns {
+			nsStats.ValueBytes += int64(len(v))
+		}
+		stats.Add(name, nsStats)
+	}
+	if s.mopts.snapshot != "" {
+		path, err := snapshotPath(s.mopts.snapshot)
+		if err == nil {
+			stats.DiskBytes, err = storage.DirSize(path)
+		}
+		if err != nil {
+			return storage.Stats{}, s.logError("stats", err)
+		}
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace.
+func (s *memoryStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.open {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	ns, ok := s.data[name]
+	if !ok {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return int64(len(ns)), nil
+}
+
+// Export writes a snapshot of the store to path. If path is a directory
+// the snapshot is written to a file in it. The snapshot can be loaded
+// into a new store with WithSnapshot.
+func (s *memoryStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if s.mopts.snapshot == path {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	}
+	b, err := s.snapshot()
+	if err != nil {
+		return s.logError("export", err)
+	}
+	if path, err = snapshotPath(path); err != nil {
+		return s.logError("export", err)
+	}
+	if err = writeFile(path, b); err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// ExportTo streams an export archive of a snapshot of the store to w.
+func (s *memoryStore) ExportTo(w io.Writer) error {
+	s.log.Debug("export: to writer")
+	b, err := s.snapshot()
+	if err != nil {
+		return s.logError("export", err)
+	}
+	aw := storage.NewArchiveWriter(w)
+	err = aw.WriteStream(storage.ArchiveExportName+storeExt, int64(len(b)), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debug("export: to writer complete")
+	return nil
+}
+
+// snapshot returns the marshaled snapshot of the store.
+func (s *memoryStore) snapshot() ([]byte, error) {
+	s.mu.RLock()
+	if !s.open {
+		s.mu.RUnlock()
+		return nil, storage.ErrClosed
+	}
+	snap := snapshot{
+		Version:    snapshotVersion,
+		Namespaces: make(map[string][]entry, len(s.data)),
+	}
+	for name, ns := range s.data {
+		entries := make([]entry, 0, len(ns))
+		for _, k := range sortedKeys(ns) {
+			entries = append(entries, entry{k, ns[string(k)]})
+		}
+		snap.Namespaces[name] = entries
+	}
+	// the values are never modified in place, so they
+	// can be marshaled without holding the lock
+	s.mu.RUnlock()
+	return jsoniter.Marshal(snap)
+}
+
+// Restore restores an archive of a single snapshot for WithSnapshot(destPath).
+// SEE: storage.RestoreArchiveFile.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	path, err := snapshotPath(destPath)
+	if err != nil {
+		return err
+	}
+	return storage.RestoreArchiveFile(archivePath, path, opt...)
+}
+
+// Close closes the store. The data is kept until the store is garbage collected.
+func (s *memoryStore) Close() error {
+	s.log.Debug("closing store")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return s.logError("close", storage.ErrClosed)
+	}
+	s.open = false
+	s.log.Info("store closed")
+	return nil
+}
+
+// load returns the data in the snapshot, or an empty
+// store if there is no snapshot to load.
+func (s *memoryStore) load() (map[string]map[string][]byte, error) {
+	data := map[string]map[string][]byte{}
+	if s.mopts.snapshot == "" {
+		return data, nil
+	}
+	path, err := snapshotPath(s.mopts.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.log.Debugf("open: no snapshot at path: %s", path)
+		return data, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err = jsoniter.Unmarshal(b, &snap); err != nil {
+		return nil, storage.WrapError(storage.ErrCorrupt, err)
+	} else if snap.Version != snapshotVersion {
+		err = fmt.Errorf("%w: unsupported snapshot version: %d",
+			storage.ErrCorrupt, snap.Version)
+		return nil, err
+	}
+	var total int
+	for name, entries := range snap.Namespaces {
+		ns := make(map[string][]byte, len(entries))
+		for _, e := range entries {
+			ns[string(e.Key)] = e.Value
+		}
+		data[name] = ns
+		total += len(ns)
+	}
+	s.log.Infof("loaded %d keys from snapshot at path: %s", total, path)
+	return data, nil
+}
+
+func sortedKeys(ns map[string][]byte) [][]byte {
+	keys := make([][]byte, 0, len(ns))
+	for k := range ns {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// snapshotPath returns the snapshot file for path. If path is
+// a directory then the default snapshot name is appended.
+func snapshotPath(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && info.IsDir() {
+		path = filepath.Join(path, storeName)
+	}
+	if filepath.Ext(path) == "" {
+		path += storeExt
+	}
+	return path, nil
+}
+
+// writeFile atomically replaces the file at path with b.
+func writeFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *memoryStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
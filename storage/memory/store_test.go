@@ -0,0 +1,48 @@
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestStore returns a memory store which loads the snapshot at path.
+// The memory store does not need a path, but the conformance suite
+// expects the store to require one.
+func newTestStore(path string, opt ...storage.StoreOption) storage.Storage {
+	if path == "" {
+		panic("store path required")
+	}
+	return NewStore(append(opt, WithSnapshot(path))...)
+}
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, newTestStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	store := NewStore()
+	assert.NoError(t, store.Open())
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	assert.NoError(t, store.Export(path))
+	assert.NoError(t, store.Close())
+	// a store loaded from the snapshot does not change the snapshot
+	store = NewStore(WithSnapshot(path))
+	assert.NoError(t, store.Open())
+	v, err := store.Get("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(v))
+	assert.NoError(t, store.Put("a", []byte("d"), []byte("e")))
+	assert.Error(t, store.Export(path))
+	assert.NoError(t, store.Close())
+	// a corrupt snapshot fails to load
+	assert.NoError(t, os.WriteFile(path, []byte("nope"), 0600))
+	store = NewStore(WithSnapshot(path))
+	assert.ErrorIs(t, store.Open(), storage.ErrCorrupt)
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Op is a storage operation, SEE: Wrap.
+type Op string
+
+// The operations of the Storage interface.
+const (
+	OpOpen            Op = "open"
+	OpPut             Op = "put"
+	OpGet             Op = "get"
+	OpHas             Op = "has"
+	OpSave            Op = "save"
+	OpLoad            Op = "load"
+	OpList            Op = "list"
+	OpListAll         Op = "list_all"
+	OpDelete          Op = "delete"
+	OpListNamespaces  Op = "list_namespaces"
+	OpDropNamespace   Op = "drop_namespace"
+	OpRenameNamespace Op = "rename_namespace"
+	OpCopyNamespace   Op = "copy_namespace"
+	OpClose           Op = "close"
+	OpExport          Op = "export"
+	OpExportTo        Op = "export_to"
+)
+
+// Call is a call to a wrapped store. Middleware can inspect and change the
+// arguments before the call is handled, and the results after.
+type Call struct {
+	// Op is the operation called.
+	Op Op
+	// Namespace is the namespace argument.
+	Namespace string
+	// Target is the namespace to rename or copy the namespace to.
+	Target string
+	// Key is the key argument.
+	Key []byte
+	// Value is the value to put, or the value returned by get.
+	Value []byte
+	// V is the value to save, or to load into.
+	V interface{}
+	// Path is the export path.
+	Path string
+	// Writer is the writer an export archive is streamed to.
+	Writer io.Writer
+	// Has is the result of has.
+	Has bool
+	// Keys is the result of list.
+	Keys [][]byte
+	// AllKeys is the result of list all.
+	AllKeys map[string][][]byte
+	// Namespaces is the result of list namespaces.
+	Namespaces []string
+}
+
+// Handler handles a call to a store.
+type Handler func(call *Call) error
+
+// Middleware returns a Handler which adds behavior to next. It can
+// return an error without calling next, to stop the call.
+type Middleware func(next Handler) Handler
+
+// Chain returns a Middleware which applies the middlewares in order,
+// the first middleware is the outermost.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// ForOps returns a Middleware which applies mw to the calls for ops,
+// other calls are passed to the next handler unchanged.
+func ForOps(mw Middleware, ops ...Op) Middleware {
+	return func(next Handler) Handler {
+		wrapped := mw(next)
+		return func(call *Call) error {
+			for _, op := range ops {
+				if call.Op == op {
+					return wrapped(call)
+				}
+			}
+			return next(call)
+		}
+	}
+}
+
+// wrappedStore is an implementation of the Storage
+// interface which passes every call through a Handler.
+type wrappedStore struct {
+	store   Storage
+	handler Handler
+}
+
+var _ StreamExporter = (*wrappedStore)(nil)
+
+// Wrap returns a store which passes every call to store through the
+// middlewares, the first middleware is the outermost. The wrapped store
+// only implements the Storage interface, optional interfaces such as
+// ExpiringStorage are not passed through.
+func Wrap(store Storage, middlewares ...Middleware) Storage {
+	w := &wrappedStore{store: store}
+	w.handler = Chain(middlewares...)(w.handle)
+	return w
+}
+
+// handle calls the wrapped store.
+func (w *wrappedStore) handle(call *Call) (err error) {
+	switch call.Op {
+	case OpOpen:
+		return w.store.Open()
+	case OpPut:
+		return w.store.Put(call.Namespace, call.Key, call.Value)
+	case OpGet:
+		call.Value, err = w.store.Get(call.Namespace, call.Key)
+		return err
+	case OpHas:
+		call.Has, err = w.store.Has(call.Namespace, call.Key)
+		return err
+	case OpSave:
+		return w.store.Save(call.Namespace, call.Key, call.V)
+	case OpLoad:
+		return w.store.Load(call.Namespace, call.Key, call.V)
+	case OpList:
+		call.Keys, err = w.store.List(call.Namespace)
+		return err
+	case OpListAll:
+		call.AllKeys, err = w.store.ListAll()
+		return err
+	case OpDelete:
+		return w.store.Delete(call.Namespace, call.Key)
+	case OpListNamespaces:
+		call.Namespaces, err = w.store.ListNamespaces()
+		return err
+	case OpDropNamespace:
+		return w.store.DropNamespace(call.Namespace)
+	case OpRenameNamespace:
+		return w.store.RenameNamespace(call.Namespace, call.Target)
+	case OpCopyNamespace:
+		return w.store.CopyNamespace(call.Namespace, call.Target)
+	case OpClose:
+		return w.store.Close()
+	case OpExport:
+		return w.store.Export(call.Path)
+	case OpExportTo:
+		return ExportTo(w.store, call.Writer)
+	default:
+		return fmt.Errorf("unknown operation: %s", call.Op)
+	}
+}
+
+// Open opens the store.
+func (w *wrappedStore) Open() error {
+	return w.handler(&Call{Op: OpOpen})
+}
+
+// Put a value in the store.
+func (w *wrappedStore) Put(name string, key []byte, value []byte) error {
+	return w.handler(&Call{Op: OpPut, Namespace: name, Key: key, Value: value})
+}
+
+// Get a value from the store.
+func (w *wrappedStore) Get(name string, key []byte) ([]byte, error) {
+	call := &Call{Op: OpGet, Namespace: name, Key: key}
+	err := w.handler(call)
+	if err != nil {
+		return nil, err
+	}
+	return call.Value, nil
+}
+
+// Has checks for a key in the store.
+func (w *wrappedStore) Has(name string, key []byte) (bool, error) {
+	call := &Call{Op: OpHas, Namespace: name, Key: key}
+	err := w.handler(call)
+	return call.Has, err
+}
+
+// Save the value in v and store the result at key.
+func (w *wrappedStore) Save(name string, key []byte, v interface{}) error {
+	return w.handler(&Call{Op: OpSave, Namespace: name, Key: key, V: v})
+}
+
+// Load the value at key and stores the result in v.
+func (w *wrappedStore) Load(name string, key []byte, v interface{}) error {
+	return w.handler(&Call{Op: OpLoad, Namespace: name, Key: key, V: v})
+}
+
+// List returns a list of all keys in the namespace.
+func (w *wrappedStore) List(name string) ([][]byte, error) {
+	call := &Call{Op: OpList, Namespace: name}
+	err := w.handler(call)
+	if err != nil {
+		return nil, err
+	}
+	return call.Keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (w *wrappedStore) ListAll() (map[string][][]byte, error) {
+	call := &Call{Op: OpListAll}
+	err := w.handler(call)
+	if err != nil {
+		return nil, err
+	}
+	return call.AllKeys, nil
+}
+
+// Delete removes a key from the store.
+func (w *wrappedStore) Delete(name string, key []byte) error {
+	return w.handler(&Call{Op: OpDelete, Namespace: name, Key: key})
+}
+
+// ListNamespaces returns the names of the namespaces in the store.
+func (w *wrappedStore) ListNamespaces() ([]string, error) {
+	call := &Call{Op: OpListNamespaces}
+	err := w.handler(call)
+	if err != nil {
+		return nil, err
+	}
+	return call.Namespaces, nil
+}
+
+// DropNamespace removes a namespace and every key in it.
+func (w *wrappedStore) DropNamespace(name string) error {
+	return w.handler(&Call{Op: OpDropNamespace, Namespace: name})
+}
+
+// RenameNamespace moves every key in namespace from to namespace to.
+func (w *wrappedStore) RenameNamespace(from, to string) error {
+	return w.handler(&Call{Op: OpRenameNamespace, Namespace: from, Target: to})
+}
+
+// CopyNamespace copies every key in namespace from to namespace to.
+func (w *wrappedStore) CopyNamespace(from, to string) error {
+	return w.handler(&Call{Op: OpCopyNamespace, Namespace: from, Target: to})
+}
+
+// Close closes the store.
+func (w *wrappedStore) Close() error {
+	return w.handler(&Call{Op: OpClose})
+}
+
+// Export saves the store to path.
+func (w *wrappedStore) Export(path string) error {
+	return w.handler(&Call{Op: OpExport, Path: path})
+}
+
+// ExportTo writes an export archive of the store to writer.
+func (w *wrappedStore) ExportTo(writer io.Writer) error {
+	return w.handler(&Call{Op: OpExportTo, Writer: writer})
+}
+
+// Fault is an error injected by InjectFaults.
+type Fault struct {
+	// Op is the operation which fails, or every operation if it is empty.
+	Op Op
+	// Namespace is the namespace which fails, or every namespace if it is empty.
+	Namespace string
+	// Key is the key which fails, or every key if it is nil.
+	Key []byte
+	// Err is the error returned by the failing calls.
+	Err error
+	// Skip is the number of matching calls which succeed before the fault.
+	Skip int
+	// Times is the number of matching calls which fail after Skip. If it is
+	// zero every matching call after Skip fails.
+	Times int
+}
+
+// matches returns true if the fault applies to call.
+func (f Fault) matches(call *Call) bool {
+	return (f.Op == "" || f.Op == call.Op) &&
+		(f.Namespace == "" || f.Namespace == call.Namespace) &&
+		(f.Key == nil || bytes.Equal(f.Key, call.Key))
+}
+
+// InjectFaults returns a Middleware which fails the calls matched by the
+// faults with their errors, without calling the store. Faults are matched
+// in order, and count the calls they match, so the calls which fail are
+// the same on every run. It is intended for testing error handling.
+func InjectFaults(faults ...Fault) Middleware {
+	var mu sync.Mutex
+	seen := make([]int, len(faults))
+	inject := func(call *Call) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, f := range faults {
+			if !f.matches(call) {
+				continue
+			}
+			seen[i]++
+			n := seen[i] - f.Skip
+			if n > 0 && (f.Times <= 0 || n <= f.Times) {
+				return f.Err
+			}
+		}
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(call *Call) error {
+			if err := inject(call); err != nil {
+				return err
+			}
+			return next(call)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// recordOps returns a Middleware which appends the name
+// and operation of every call to calls.
+func recordOps(name string, calls *[]string) storage.Middleware {
+	return func(next storage.Handler) storage.Handler {
+		return func(call *storage.Call) error {
+			*calls = append(*calls, name+":"+string(call.Op))
+			return next(call)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	storagetest.RunConformance(t, func(path string, opt ...storage.StoreOption) storage.Storage {
+		var calls []string
+		return storage.Wrap(fs.NewStore(path, opt...), recordOps("a", &calls), recordOps("b", &calls))
+	})
+}
+
+func TestWrap_Chain(t *testing.T) {
+	var calls []string
+	store := storage.Wrap(memory.NewStore(),
+		storage.Chain(recordOps("a", &calls), recordOps("b", &calls)),
+		storage.ForOps(recordOps("c", &calls), storage.OpGet))
+	assert.NoError(t, store.Open())
+	assert.NoError(t, store.Put("n", []byte("k"), []byte("v")))
+	v, err := store.Get("n", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v", string(v))
+	assert.Equal(t, []string{
+		"a:open", "b:open",
+		"a:put", "b:put",
+		"a:get", "b:get", "c:get",
+	}, calls)
+}
+
+func TestWrap_Results(t *testing.T) {
+	// middleware can change the results of a call
+	upper := func(next storage.Handler) storage.Handler {
+		return func(call *storage.Call) error {
+			if err := next(call); err != nil {
+				return err
+			}
+			call.Value = []byte("V")
+			return nil
+		}
+	}
+	store := storage.Wrap(memory.NewStore(), storage.ForOps(upper, storage.OpGet))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("n", []byte("k"), []byte("v")))
+	v, err := store.Get("n", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "V", string(v))
+	keys, err := store.List("n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("k")}, keys)
+}
+
+func TestInjectFaults(t *testing.T) {
+	errFault := errors.New("fault")
+	store := storage.Wrap(memory.NewStore(), storage.InjectFaults(
+		storage.Fault{Op: storage.OpPut, Err: storage.ErrReadOnly, Skip: 1, Times: 2},
+		storage.Fault{Op: storage.OpGet, Key: []byte("b"), Err: errFault},
+		storage.Fault{Namespace: "m", Err: storage.ErrCorrupt},
+	))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	putErrs := make([]error, 4)
+	for i := range putErrs {
+		putErrs[i] = store.Put("n", []byte("a"), []byte("v"))
+	}
+	assert.NoError(t, putErrs[0])
+	assert.ErrorIs(t, putErrs[1], storage.ErrReadOnly)
+	assert.ErrorIs(t, putErrs[2], storage.ErrReadOnly)
+	assert.NoError(t, putErrs[3])
+	_, err := store.Get("n", []byte("a"))
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = store.Get("n", []byte("b"))
+		assert.ErrorIs(t, err, errFault)
+	}
+	_, err = store.List("m")
+	assert.ErrorIs(t, err, storage.ErrCorrupt)
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// MirroredStorage is a Storage which keeps a copy of every entry in each
+// of its stores, SEE: Mirror.
+type MirroredStorage interface {
+	Storage
+
+	// Repair reconciles the key sets of the stores. A key missing from a
+	// store is copied to it from the first store that has the key, starting
+	// with the primary. Keys are never deleted by Repair, so a delete that
+	// failed on a store must be retried. Repair returns the number of
+	// entries copied.
+	Repair() (int, error)
+}
+
+// mirrorStore is an implementation of the Storage interface which fans
+// writes out to a primary store and its replicas.
+type mirrorStore struct {
+	stores []Storage
+}
+
+var (
+	_ MirroredStorage = (*mirrorStore)(nil)
+	_ StatsStorage    = (*mirrorStore)(nil)
+)
+
+// Mirror returns a store which writes and deletes entries in the primary
+// store and every replica. Reads are served by the primary, and fall back
+// to each replica in turn if the read fails, including when the key is not
+// found. A write is attempted on every store even if some of them fail, and
+// the first error is returned. Opening and closing the mirror opens and
+// closes every store.
+func Mirror(primary Storage, replicas ...Storage) MirroredStorage {
+	stores := make([]Storage, 0, len(replicas)+1)
+	stores = append(stores, primary)
+	stores = append(stores, replicas...)
+	return &mirrorStore{stores: stores}
+}
+
+// Open opens every store. If a store cannot be opened,
+// the stores that were opened are closed.
+func (m *mirrorStore) Open() error {
+	for i, s := range m.stores {
+		if err := s.Open(); err != nil {
+			for _, opened := range m.stores[:i] {
+				_ = opened.Close()
+			}
+			return m.wrapError(i, err)
+		}
+	}
+	return nil
+}
+
+// Put an entry in every store.
+func (m *mirrorStore) Put(name string, key []byte, value []byte) error {
+	return m.write(func(s Storage) error {
+		return s.Put(name, key, value)
+	})
+}
+
+// Get a value from the first store that has it.
+func (m *mirrorStore) Get(name string, key []byte) (value []byte, err error) {
+	err = m.read(func(s Storage) (err error) {
+		value, err = s.Get(name, key)
+		return err
+	})
+	return value, err
+}
+
+// Has checks for a key in the first store that can be read.
+func (m *mirrorStore) Has(name string, key []byte) (has bool, err error) {
+	err = m.read(func(s Storage) (err error) {
+		has, err = s.Has(name, key)
+		return err
+	})
+	return has, err
+}
+
+// Save the value in v and store the result at key in every store.
+func (m *mirrorStore) Save(name string, key []byte, v interface{}) error {
+	return m.write(func(s Storage) error {
+		return s.Save(name, key, v)
+	})
+}
+
+// Load the value at key from the first store that has it and stores the result in v.
+func (m *mirrorStore) Load(name string, key []byte, v interface{}) error {
+	return m.read(func(s Storage) error {
+		return s.Load(name, key, v)
+	})
+}
+
+// List returns a list of all keys in the namespace
+// from the first store that has the namespace.
+func (m *mirrorStore) List(name string) (keys [][]byte, err error) {
+	err = m.read(func(s Storage) (err error) {
+		keys, err = s.List(name)
+		return err
+	})
+	return keys, err
+}
+
+// ListAll returns a mapped list of all keys from the first store that can be read.
+func (m *mirrorStore) ListAll() (keys map[string][][]byte, err error) {
+	err = m.read(func(s Storage) (err error) {
+		keys, err = s.ListAll()
+		return err
+	})
+	return keys, err
+}
+
+// ListNamespaces returns the namespaces from the first store that can be read.
+func (m *mirrorStore) ListNamespaces() (names []string, err error) {
+	err = m.read(func(s Storage) (err error) {
+		names, err = s.ListNamespaces()
+		return err
+	})
+	return names, err
+}
+
+// DropNamespace removes a namespace from every store.
+func (m *mirrorStore) DropNamespace(name string) error {
+	return m.write(func(s Storage) error {
+		return s.DropNamespace(name)
+	})
+}
+
+// RenameNamespace renames a namespace in every store.
+func (m *mirrorStore) RenameNamespace(from, to string) error {
+	return m.write(func(s Storage) error {
+		return s.RenameNamespace(from, to)
+	})
+}
+
+// CopyNamespace copies a namespace in every store.
+func (m *mirrorStore) CopyNamespace(from, to string) error {
+	return m.write(func(s Storage) error {
+		return s.CopyNamespace(from, to)
+	})
+}
+
+// Stats returns the statistics of the first store that can be read.
+func (m *mirrorStore) Stats() (stats Stats, err error) {
+	err = m.read(func(s Storage) (err error) {
+		stats, err = CollectStats(s)
+		return err
+	})
+	return stats, err
+}
+
+// Count returns the number of keys in the namespace
+// from the first store that has the namespace.
+func (m *mirrorStore) Count(name string) (count int64, err error) {
+	err = m.read(func(s Storage) (err error) {
+		count, err = CountKeys(s, name)
+		return err
+	})
+	return count, err
+}
+
+// Delete removes a key from every store.
+func (m *mirrorStore) Delete(name string, key []byte) error {
+	return m.write(func(s Storage) error {
+		return s.Delete(name, key)
+	})
+}
+
+// Close closes every store.
+func (m *mirrorStore) Close() error {
+	return m.write(func(s Storage) error {
+		return s.Close()
+	})
+}
+
+// Export saves the first store that can be exported to path.
+func (m *mirrorStore) Export(path string) error {
+	return m.read(func(s Storage) error {
+		return s.Export(path)
+	})
+}
+
+// Repair reconciles the key sets of the stores.
+func (m *mirrorStore) Repair() (int, error) {
+	all := make([]map[string][][]byte, len(m.stores))
+	for i, s := range m.stores {
+		keys, err := s.ListAll()
+		if err != nil {
+			return 0, m.wrapError(i, fmt.Errorf("repair: %w", err))
+		}
+		all[i] = keys
+	}
+	has := make([]map[string]bool, len(m.stores))
+	for i, keys := range all {
+		has[i] = map[string]bool{}
+		for name, nsKeys := range keys {
+			for _, key := range nsKeys {
+				has[i][recordID(name, key)] = true
+			}
+		}
+	}
+	var repaired int
+	for src, keys := range all {
+		for name, nsKeys := range keys {
+			for _, key := range nsKeys {
+				id := recordID(name, key)
+				var value []byte
+				for dst := range m.stores {
+					if has[dst][id] {
+						continue
+					}
+					if value == nil {
+						var err error
+						if value, err = m.stores[src].Get(name, key); err != nil {
+							return repaired, m.wrapError(src, fmt.Errorf("repair: %w", err))
+						}
+					}
+					if err := m.stores[dst].Put(name, key, value); err != nil {
+						return repaired, m.wrapError(dst, fmt.Errorf("repair: %w", err))
+					}
+					has[dst][id] = true
+					repaired++
+				}
+			}
+		}
+	}
+	return repaired, nil
+}
+
+// recordID returns an identifier for a namespace and key.
+func recordID(name string, key []byte) string {
+	return fmt.Sprintf("%q.%q", name, key)
+}
+
+// read calls fn for each store in turn until it succeeds.
+// If fn fails for every store the error for the primary is returned.
+func (m *mirrorStore) read(fn func(s Storage) error) error {
+	var first error
+	for i, s := range m.stores {
+		err := fn(s)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = m.wrapError(i, err)
+		}
+	}
+	return first
+}
+
+// write calls fn for every store and returns the first error.
+func (m *mirrorStore) write(fn func(s Storage) error) error {
+	var first error
+	for i, s := range m.stores {
+		if err := fn(s); err != nil && first == nil {
+			first = m.wrapError(i, err)
+		}
+	}
+	return first
+}
+
+// wrapError adds the store which returned err to the message.
+func (m *mirrorStore) wrapError(i int, err error) error {
+	if i == 0 {
+		return fmt.Errorf("primary: %w", err)
+	}
+	return fmt.Errorf("replica %d: %w", i, err)
+}
@@ -0,0 +1,76 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestMirror mirrors the fs store at path to a replica next to it,
+// so an export of the mirror can be opened as the primary of a mirror.
+func newTestMirror(path string, opt ...storage.StoreOption) storage.Storage {
+	return storage.Mirror(fs.NewStore(path, opt...), fs.NewStore(path+".replica", opt...))
+}
+
+func TestMirror(t *testing.T) {
+	storagetest.RunConformance(t, newTestMirror)
+}
+
+func TestMirror_Fallback(t *testing.T) {
+	primary, replica := memory.NewStore(), memory.NewStore()
+	store := storage.Mirror(primary, replica)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	assert.NoError(t, primary.Delete("a", []byte("b")))
+	// a key lost by the primary is read from the replica
+	v, err := store.Get("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(v))
+	assert.NoError(t, primary.Close())
+	keys, err := store.List("a")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b")}, keys)
+	// writes are attempted on every store
+	err = store.Put("a", []byte("d"), []byte("e"))
+	assert.ErrorIs(t, err, storage.ErrClosed)
+	has, err := replica.Has("a", []byte("d"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.NoError(t, primary.Open())
+}
+
+func TestMirror_Repair(t *testing.T) {
+	primary, replica1, replica2 := memory.NewStore(), memory.NewStore(), memory.NewStore()
+	store := storage.Mirror(primary, replica1, replica2)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	assert.NoError(t, primary.Put("a", []byte("d"), []byte("e")))
+	assert.NoError(t, replica1.Delete("a", []byte("b")))
+	assert.NoError(t, replica2.Put("f", []byte("g"), []byte("h")))
+	repaired, err := store.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, repaired)
+	want := map[string][][]byte{
+		"a": {[]byte("b"), []byte("d")},
+		"f": {[]byte("g")},
+	}
+	for _, s := range []storage.Storage{primary, replica1, replica2} {
+		got, err := s.ListAll()
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	v, err := replica1.Get("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(v))
+	// the stores are in sync
+	repaired, err = store.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, repaired)
+}
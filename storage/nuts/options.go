@@ -0,0 +1,57 @@
+package nuts
+
+import (
+	"github.com/xujiajun/nutsdb"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the nutsdb store specific options.
+type options struct {
+	segmentSize int64
+}
+
+var defaultOptions = options{
+	segmentSize: nutsdb.DefaultOptions.SegmentSize,
+}
+
+// nutsOption is implemented by StoreOptions that configure the nutsdb store.
+type nutsOption interface {
+	storage.StoreOption
+	applyNuts(*options)
+}
+
+// nutsFuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type nutsFuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o nutsFuncOption) applyNuts(opts *options) {
+	o.f(opts)
+}
+
+func newNutsOption(f func(*options)) storage.StoreOption {
+	return nutsFuncOption{f: f}
+}
+
+// applyNutsOptions applies the nutsdb store specific options in opt.
+func applyNutsOptions(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if no, ok := o.(nutsOption); ok {
+			no.applyNuts(&opts)
+		}
+	}
+	return opts
+}
+
+// WithSegmentSize returns a StoreOption which sets the size of the nutsdb
+// data files. Merge only reclaims space in data files which are full, so
+// smaller data files reclaim space sooner. The default is 256MB. The size
+// cannot be changed once the store has been created.
+func WithSegmentSize(size int64) storage.StoreOption {
+	return newNutsOption(func(o *options) {
+		o.segmentSize = size
+	})
+}
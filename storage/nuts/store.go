@@ -1,13 +1,18 @@
 package nuts
 
 import (
-	"bytes"
+	"archive/tar"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"git.tcp.direct/kayos/chestnut/log"
 	"git.tcp.direct/kayos/chestnut/storage"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/xujiajun/nutsdb"
 )
 
@@ -16,13 +21,19 @@ const logName = "nutsdb"
 // nutsDBStore is an implementation the Storage interface for nutsdb
 // https://github.com/xujiajun/nutsdb.
 type nutsDBStore struct {
-	opts storage.StoreOptions
-	path string
-	db   *nutsdb.DB
-	log  log.Logger
+	opts  storage.StoreOptions
+	nopts options
+	path  string
+	db    *nutsdb.DB
+	log   log.Logger
 }
 
-var _ storage.Storage = (*nutsDBStore)(nil)
+var (
+	_ storage.Storage        = (*nutsDBStore)(nil)
+	_ storage.Compactor      = (*nutsDBStore)(nil)
+	_ storage.StatsStorage   = (*nutsDBStore)(nil)
+	_ storage.StreamExporter = (*nutsDBStore)(nil)
+)
 
 // NewStore is used to instantiate a datastore backed by nutsdb.
 func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
@@ -31,7 +42,8 @@ func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
 	if path == "" {
 		logger.Panic("store path required")
 	}
-	return &nutsDBStore{path: path, opts: opts, log: logger}
+	nopts := applyNutsOptions(defaultOptions, opt...)
+	return &nutsDBStore{path: path, opts: opts, nopts: nopts, log: logger}
 }
 
 // Options returns the configuration options for the store.
@@ -44,8 +56,9 @@ func (s *nutsDBStore) Open() (err error) {
 	s.log.Debugf("opening store at path: %s", s.path)
 	opt := nutsdb.DefaultOptions
 	opt.Dir = s.path
+	opt.SegmentSize = s.nopts.segmentSize
 	if s.db, err = nutsdb.Open(opt); err != nil {
-		err = s.logError("open", err)
+		err = s.logError("open", wrapError(err))
 		return
 	}
 	if s.db == nil {
@@ -71,7 +84,7 @@ func (s *nutsDBStore) Put(name string, key []byte, value []byte) error {
 			len(value), name, string(key))
 		return tx.Put(name, key, value, 0)
 	}
-	return s.logError("put", s.db.Update(putValue))
+	return s.logError("put", s.update(putValue))
 }
 
 // Get a value from the store.
@@ -85,14 +98,14 @@ func (s *nutsDBStore) Get(name string, key []byte) ([]byte, error) {
 		s.log.Debugf("get: tx key: %s.%s", name, key)
 		e, err := tx.Get(name, key)
 		if err != nil {
-			return err
+			return notFound(name, key, err)
 		}
 		value = e.Value
 		s.log.Debugf("get: tx key: %s.%s value (%d bytes)",
 			name, string(key), len(value))
 		return nil
 	}
-	if err := s.db.View(getValue); err != nil {
+	if err := s.view(getValue); err != nil {
 		return nil, s.logError("get", err)
 	}
 	return value, nil
@@ -100,7 +113,7 @@ func (s *nutsDBStore) Get(name string, key []byte) ([]byte, error) {
 
 // Save the value in v and store the result at key.
 func (s *nutsDBStore) Save(name string, key []byte, v interface{}) error {
-	b, err := jsoniter.Marshal(v)
+	b, err := s.opts.Serializer().Marshal(v)
 	if err != nil {
 		return s.logError("save", err)
 	}
@@ -113,7 +126,7 @@ func (s *nutsDBStore) Load(name string, key []byte, v interface{}) error {
 	if err != nil {
 		return s.logError("load", err)
 	}
-	return s.logError("load", jsoniter.Unmarshal(b, v))
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
 }
 
 // Has checks for a key in the store.
@@ -125,21 +138,18 @@ func (s *nutsDBStore) Has(name string, key []byte) (bool, error) {
 	var has bool
 	hasKey := func(tx *nutsdb.Tx) error {
 		s.log.Debugf("has: tx get namespace: %s", name)
-		entries, err := tx.GetAll(name)
-		if err != nil {
+		_, err := tx.Get(name, key)
+		if err = notFound(name, key, err); errors.Is(err, storage.ErrNotFound) {
+			s.log.Debugf("has: tx key not found: %s.%s", name, string(key))
+			return nil
+		} else if err != nil {
 			return err
 		}
-		s.log.Debugf("has: tx found %d keys in: %s", len(entries), name)
-		for _, entry := range entries {
-			has = bytes.Equal(key, entry.Key)
-			if has {
-				s.log.Debugf("has: tx key found: %s.%s", name, string(key))
-				break
-			}
-		}
+		has = true
+		s.log.Debugf("has: tx key found: %s.%s", name, string(key))
 		return nil
 	}
-	if err := s.db.View(hasKey); err != nil {
+	if err := s.view(hasKey); err != nil {
 		return false, s.logError("has", err)
 	}
 	s.log.Debugf("has: found key %s: %t", key, has)
@@ -156,7 +166,7 @@ func (s *nutsDBStore) Delete(name string, key []byte) error {
 		s.log.Debugf("delete: tx key: %s.%s", name, string(key))
 		return tx.Delete(name, key)
 	}
-	return s.logError("delete", s.db.Update(del))
+	return s.logError("delete", s.update(del))
 }
 
 // List returns a list of all keys in the namespace.
@@ -166,7 +176,7 @@ func (s *nutsDBStore) List(name string) (keys [][]byte, err error) {
 		keys, err = s.listKeys(name, tx)
 		return err
 	}
-	if err = s.db.View(listKeys); err != nil {
+	if err = s.view(listKeys); err != nil {
 		return nil, s.logError("list", err)
 	}
 	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
@@ -177,7 +187,9 @@ func (s *nutsDBStore) listKeys(name string, tx *nutsdb.Tx) ([][]byte, error) {
 	var keys [][]byte
 	s.log.Debugf("list: tx scan namespace: %s", name)
 	entries, err := tx.GetAll(name)
-	if err != nil {
+	if nutsdb.IsBucketEmpty(err) || nutsdb.IsBucketNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	} else if err != nil {
 		return nil, err
 	}
 	keys = make([][]byte, len(entries))
@@ -197,7 +209,10 @@ func (s *nutsDBStore) ListAll() (map[string][][]byte, error) {
 	listKeys := func(tx *nutsdb.Tx) error {
 		for name := range s.db.BPTreeIdx {
 			keys, err := s.listKeys(name, tx)
-			if err != nil {
+			if errors.Is(err, storage.ErrNamespaceNotFound) {
+				// every key in the namespace has been deleted
+				continue
+			} else if err != nil {
 				return err
 			}
 			if len(keys) <= 0 {
@@ -208,13 +223,154 @@ func (s *nutsDBStore) ListAll() (map[string][][]byte, error) {
 		}
 		return nil
 	}
-	if err := s.db.View(listKeys); err != nil {
+	if err := s.view(listKeys); err != nil {
 		return nil, s.logError("list", err)
 	}
 	s.log.Debugf("list: found %d keys: %s", total, allKeys)
 	return allKeys, nil
 }
 
+// ListNamespaces returns the sorted names of the buckets which have keys.
+func (s *nutsDBStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	names := []string{}
+	listBuckets := func(tx *nutsdb.Tx) error {
+		for name, idx := range s.db.BPTreeIdx {
+			if idx.ValidKeyCount > 0 {
+				names = append(names, name)
+			}
+		}
+		return nil
+	}
+	if err := s.view(listBuckets); err != nil {
+		return nil, s.logError("list", err)
+	}
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace deletes the bucket of the namespace.
+func (s *nutsDBStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	drop := func(tx *nutsdb.Tx) error {
+		if _, err := s.listKeys(name, tx); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(nutsdb.DataStructureBPTree, name)
+	}
+	return s.logError("drop", s.update(drop))
+}
+
+// RenameNamespace copies the bucket of namespace from to namespace
+// to and deletes it, in a single transaction.
+func (s *nutsDBStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	rename := func(tx *nutsdb.Tx) error {
+		if err := s.copyBucket(tx, from, to); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(nutsdb.DataStructureBPTree, from)
+	}
+	return s.logError("rename", s.update(rename))
+}
+
+// CopyNamespace copies the bucket of namespace from to namespace to.
+func (s *nutsDBStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	copyNamespace := func(tx *nutsdb.Tx) error {
+		return s.copyBucket(tx, from, to)
+	}
+	return s.logError("copy", s.update(copyNamespace))
+}
+
+// copyBucket puts every entry in bucket from in bucket to.
+func (s *nutsDBStore) copyBucket(tx *nutsdb.Tx, from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	}
+	entries, err := tx.GetAll(from)
+	if nutsdb.IsBucketEmpty(err) || nutsdb.IsBucketNotFound(err) {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	} else if err != nil {
+		return err
+	}
+	if _, err = s.listKeys(to, tx); err == nil {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	} else if !errors.Is(err, storage.ErrNamespaceNotFound) {
+		return err
+	}
+	for _, entry := range entries {
+		if err = tx.Put(to, entry.Key, entry.Value, nutsdb.Persistent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the statistics of the store.
+func (s *nutsDBStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	collect := func(tx *nutsdb.Tx) error {
+		for name := range s.db.BPTreeIdx {
+			entries, err := tx.GetAll(name)
+			if nutsdb.IsBucketEmpty(err) || nutsdb.IsBucketNotFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			ns := storage.NamespaceStats{Keys: int64(len(entries))}
+			for _, entry := range entries {
+				ns.ValueBytes += int64(len(entry.Value))
+			}
+			stats.Add(name, ns)
+		}
+		return nil
+	}
+	if err := s.view(collect); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	files, err := s.dataFiles()
+	if err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	if stats.DiskBytes, err = storage.DirSize(s.path); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	if stats.DeadSpace, err = s.DeadSpace(); err != nil {
+		return storage.Stats{}, err
+	}
+	stats.Backend = map[string]int64{
+		"data_files":   int64(len(files)),
+		"segment_size": s.nopts.segmentSize,
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace from its index.
+func (s *nutsDBStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	var count int64
+	countKeys := func(tx *nutsdb.Tx) error {
+		idx, ok := s.db.BPTreeIdx[name]
+		if !ok || idx.ValidKeyCount <= 0 {
+			return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		}
+		count = int64(idx.ValidKeyCount)
+		return nil
+	}
+	if err := s.view(countKeys); err != nil {
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
 // Export copies the datastore to directory at path.
 func (s *nutsDBStore) Export(path string) error {
 	s.log.Debugf("export: to path: %s", path)
@@ -225,6 +381,9 @@ func (s *nutsDBStore) Export(path string) error {
 		err := fmt.Errorf("path cannot be store path: %s", path)
 		return s.logError("export", err)
 	}
+	if s.db == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
 	if err := s.db.Backup(path); err != nil {
 		return s.logError("export", err)
 	}
@@ -232,15 +391,214 @@ func (s *nutsDBStore) Export(path string) error {
 	return nil
 }
 
+// ExportTo streams an export archive of the database to w. The tarball
+// written by nutsdb's BackupTarGZ is read as it is written, and its files
+// are added to the archive.
+func (s *nutsDBStore) ExportTo(w io.Writer) error {
+	s.log.Debug("export: to writer")
+	if s.db == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	r, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.db.BackupTarGZ(pw)
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+	err := archiveBackup(r, w)
+	// unblock the backup if the archive failed
+	_ = r.CloseWithError(err)
+	if backupErr := <-done; err == nil {
+		err = backupErr
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debug("export: to writer complete")
+	return nil
+}
+
+// archiveBackup writes the files in the backup tarball read from r to an
+// export archive written to w. The names in the backup are under the name
+// of the store directory, which is replaced by the name of the export.
+func archiveBackup(r io.Reader, w io.Writer) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	aw := storage.NewArchiveWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		parts := strings.SplitN(filepath.ToSlash(hdr.Name), "/", 2)
+		if hdr.Typeflag != tar.TypeReg || len(parts) != 2 {
+			continue
+		}
+		if err = aw.WriteFile(storage.ArchiveExportName+"/"+parts[1], hdr.FileInfo(), tr); err != nil {
+			return err
+		}
+	}
+	if _, err = io.Copy(io.Discard, gz); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// Restore restores an export archive for NewStore(destPath). SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
 // Close closes the datastore and releases all db resources.
 func (s *nutsDBStore) Close() error {
 	s.log.Debugf("closing store at path: %s", s.path)
+	if s.db == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
 	err := s.db.Close()
 	s.db = nil
 	s.log.Info("store closed")
 	return s.logError("close", err)
 }
 
+// Compact merges the store, nutsdb reclaims space by merging data files.
+func (s *nutsDBStore) Compact() error {
+	return s.Merge()
+}
+
+// Merge rewrites the entries in the full data files to the active data
+// file, without the deleted and overwritten entries, and removes them.
+func (s *nutsDBStore) Merge() error {
+	s.log.Debugf("merge: store at path: %s", s.path)
+	if s.db == nil {
+		return s.logError("merge", storage.ErrClosed)
+	}
+	files, err := s.dataFiles()
+	if err != nil {
+		return s.logError("merge", err)
+	}
+	// nutsdb only merges full data files, and fails without any
+	if len(files) < 2 {
+		s.log.Debug("merge: no full data files to merge")
+		return nil
+	}
+	if err = s.db.Merge(); err != nil {
+		return s.logError("merge", wrapError(err))
+	}
+	s.log.Infof("merge: merged %d data files", len(files)-1)
+	return nil
+}
+
+// DeadSpace returns the fraction of the data files used by deleted and
+// overwritten entries. The full data files are counted at the segment
+// size, and the active data file at the size written to it.
+func (s *nutsDBStore) DeadSpace() (float64, error) {
+	if s.db == nil {
+		return 0, s.logError("dead space", storage.ErrClosed)
+	}
+	files, err := s.dataFiles()
+	if err != nil {
+		return 0, s.logError("dead space", err)
+	}
+	var size, live int64
+	if len(files) > 0 {
+		size = int64(len(files)-1) * s.nopts.segmentSize
+	}
+	sumLive := func(tx *nutsdb.Tx) error {
+		// the active file is written by transactions
+		if s.db.ActiveFile != nil {
+			size += s.db.ActiveFile.ActualSize
+		}
+		for name := range s.db.BPTreeIdx {
+			entries, err := tx.GetAll(name)
+			if nutsdb.IsBucketEmpty(err) || nutsdb.IsBucketNotFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				live += entry.Size()
+			}
+		}
+		return nil
+	}
+	if err = s.view(sumLive); err != nil {
+		return 0, s.logError("dead space", err)
+	}
+	if size <= 0 || live >= size {
+		return 0, nil
+	}
+	return float64(size-live) / float64(size), nil
+}
+
+// dataFiles returns the paths of the data files of the store.
+func (s *nutsDBStore) dataFiles() ([]string, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == nutsdb.DataSuffix {
+			files = append(files, filepath.Join(s.path, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// view runs fn in a read-only transaction.
+func (s *nutsDBStore) view(fn func(*nutsdb.Tx) error) error {
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.View(fn))
+}
+
+// update runs fn in a read-write transaction.
+func (s *nutsDBStore) update(fn func(*nutsdb.Tx) error) error {
+	if s.db == nil {
+		return storage.ErrClosed
+	}
+	return wrapError(s.db.Update(fn))
+}
+
+// notFound returns a storage not found error if err is a nutsdb
+// key or bucket not found error, otherwise it returns err.
+func notFound(name string, key []byte, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case nutsdb.IsBucketNotFound(err), nutsdb.IsBucketEmpty(err):
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	case nutsdb.IsKeyNotFound(err), errors.Is(err, nutsdb.ErrNotFoundKey):
+		return fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+	default:
+		return err
+	}
+}
+
+// wrapError wraps nutsdb errors with the matching storage error.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case nutsdb.IsDBClosed(err):
+		return storage.WrapError(storage.ErrClosed, err)
+	case errors.Is(err, nutsdb.ErrTxNotWritable):
+		return storage.WrapError(storage.ErrReadOnly, err)
+	case errors.Is(err, nutsdb.ErrCrc), errors.Is(err, nutsdb.ErrCrcZero):
+		return storage.WrapError(storage.ErrCorrupt, err)
+	default:
+		return err
+	}
+}
+
 func (s *nutsDBStore) logError(name string, err error) error {
 	if err == nil {
 		return nil
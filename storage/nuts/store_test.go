@@ -1,11 +1,43 @@
 package nuts
 
 import (
+	"fmt"
 	"testing"
 
-	"git.tcp.direct/kayos/chestnut/storage/store_test"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
 )
 
 func TestStore(t *testing.T) {
-	store_test.TestStore(t, NewStore)
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_Merge(t *testing.T) {
+	const segmentSize = 64 << 10
+	store := NewStore(t.TempDir(), WithSegmentSize(segmentSize)).(storage.Compactor)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	value := make([]byte, 1024)
+	// overwrite a few keys until there are several full data files
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, store.Put("n", []byte(fmt.Sprint(i%10)), value))
+	}
+	files, err := store.(*nutsDBStore).dataFiles()
+	assert.NoError(t, err)
+	assert.Greater(t, len(files), 2)
+	dead, err := store.DeadSpace()
+	assert.NoError(t, err)
+	assert.Greater(t, dead, 0.5)
+	assert.NoError(t, store.Merge())
+	merged, err := store.(*nutsDBStore).dataFiles()
+	assert.NoError(t, err)
+	assert.Less(t, len(merged), len(files))
+	keys, err := store.List("n")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 10)
+	v, err := store.Get("n", []byte("9"))
+	assert.NoError(t, err)
+	assert.Equal(t, value, v)
 }
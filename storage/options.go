@@ -4,7 +4,8 @@ import "git.tcp.direct/kayos/chestnut/log"
 
 // StoreOptions provides a default implementation for common storage Options stores should support.
 type StoreOptions struct {
-	log log.Logger
+	log        log.Logger
+	serializer Serializer
 }
 
 // Logger returns the configured logger for the store.
@@ -12,9 +13,19 @@ func (o StoreOptions) Logger() log.Logger {
 	return o.log
 }
 
+// Serializer returns the configured serializer for the values saved
+// and loaded by the store, which defaults to JSON.
+func (o StoreOptions) Serializer() Serializer {
+	if o.serializer == nil {
+		return JSON
+	}
+	return o.serializer
+}
+
 // DefaultStoreOptions represents the recommended default StoreOptions for a store.
 var DefaultStoreOptions = StoreOptions{
-	log: log.NewZerologLoggerWithLevel(log.DebugLevel),
+	log:        log.NewZerologLoggerWithLevel(log.DebugLevel),
+	serializer: JSON,
 }
 
 // A StoreOption sets options such disabling overwrite, and other parameters, etc.
@@ -60,6 +71,16 @@ func WithLogger(l log.Logger) StoreOption {
 	})
 }
 
+// WithSerializer returns a StoreOption which sets the serializer the store's
+// Save and Load use to encode and decode values, e.g. storage.Gob,
+// msgpack.Serializer, cbor.Serializer or a custom Serializer. Values must be
+// loaded with the serializer they were saved with.
+func WithSerializer(s Serializer) StoreOption {
+	return newFuncOption(func(o *StoreOptions) {
+		o.serializer = s
+	})
+}
+
 // WithStdLogger is a convenience that returns a StoreOption for a standard err logger.
 func WithStdLogger(lvl log.Level) StoreOption {
 	return WithLogger(log.NewZerologLoggerWithLevel(lvl))
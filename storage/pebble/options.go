@@ -0,0 +1,66 @@
+package pebble
+
+import (
+	"github.com/cockroachdb/pebble"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the pebble store specific options.
+type options struct {
+	sync   bool
+	tuning func(*pebble.Options)
+}
+
+var defaultOptions = options{
+	sync: true,
+}
+
+// pebbleOption is implemented by StoreOptions that configure the pebble store.
+type pebbleOption interface {
+	storage.StoreOption
+	applyPebble(*options)
+}
+
+// pebbleFuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type pebbleFuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o pebbleFuncOption) applyPebble(opts *options) {
+	o.f(opts)
+}
+
+func newPebbleOption(f func(*options)) storage.StoreOption {
+	return pebbleFuncOption{f: f}
+}
+
+// applyPebbleOptions applies the pebble store specific options in opt.
+func applyPebbleOptions(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if po, ok := o.(pebbleOption); ok {
+			po.applyPebble(&opts)
+		}
+	}
+	return opts
+}
+
+// WithSync returns a StoreOption which sets whether writes are synced to disk
+// before they return. Writes are synced by default, disabling it trades
+// durability of the most recent writes for throughput.
+func WithSync(sync bool) storage.StoreOption {
+	return newPebbleOption(func(o *options) {
+		o.sync = sync
+	})
+}
+
+// WithPebbleOptions returns a StoreOption which tunes the options used to
+// open pebble. The function is passed the options after the store has set
+// its defaults.
+func WithPebbleOptions(fn func(*pebble.Options)) storage.StoreOption {
+	return newPebbleOption(func(o *options) {
+		o.tuning = fn
+	})
+}
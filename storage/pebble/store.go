@@ -0,0 +1,599 @@
+// Package pebble provides an implementation of the storage.Storage
+// interface for Pebble https://github.com/cockroachdb/pebble.
+package pebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	logName = "pebble"
+
+	// nsPrefix is the first byte of every key written by the store.
+	// Keys are nsPrefix, the uvarint length of the namespace, the
+	// namespace, and then the key. Since the namespace is length
+	// prefixed, one namespace is never a prefix of another.
+	nsPrefix byte = 'n'
+)
+
+// pebbleStore is an implementation the Storage interface for pebble
+// https://github.com/cockroachdb/pebble.
+type pebbleStore struct {
+	opts  storage.StoreOptions
+	popts options
+	path  string
+	db    *pebble.DB
+	log   log.Logger
+}
+
+var (
+	_ storage.Storage              = (*pebbleStore)(nil)
+	_ storage.TransactionalStorage = (*pebbleStore)(nil)
+	_ storage.StatsStorage         = (*pebbleStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by pebble.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	popts := applyPebbleOptions(defaultOptions, opt...)
+	return &pebbleStore{path: path, opts: opts, popts: popts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *pebbleStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open opens the store.
+func (s *pebbleStore) Open() (err error) {
+	s.log.Debugf("opening store at path: %s", s.path)
+	opts := &pebble.Options{}
+	if s.log != nil {
+		opts.Logger = pebbleLogger{s.log}
+	}
+	if s.popts.tuning != nil {
+		s.popts.tuning(opts)
+	}
+	s.db, err = pebble.Open(s.path, opts)
+	if err != nil {
+		s.db = nil
+		return s.logError("open", wrapError(err))
+	}
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store.
+func (s *pebbleStore) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if s.db == nil {
+		return s.logError("put", storage.ErrClosed)
+	}
+	return s.logError("put", put(s.db, name, key, value, s.writeOptions()))
+}
+
+// Get a value from the store.
+func (s *pebbleStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if s.db == nil {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	value, err := get(s.db, name, key)
+	if err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *pebbleStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *pebbleStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *pebbleStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	} else if s.db == nil {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	_, closer, err := s.db.Get(dataKey(name, key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		s.log.Debugf("has: found key %s: %t", key, false)
+		return false, nil
+	} else if err != nil {
+		return false, s.logError("has", wrapError(err))
+	}
+	_ = closer.Close()
+	s.log.Debugf("has: found key %s: %t", key, true)
+	return true, nil
+}
+
+// Delete removes a key from the store.
+func (s *pebbleStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if s.db == nil {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	return s.logError("delete", del(s.db, name, key, s.writeOptions()))
+}
+
+// List returns a list of all keys in the namespace, in key order. Pebble
+// does not keep empty namespaces, so a namespace without any keys is not found.
+func (s *pebbleStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	var keys [][]byte
+	prefix := nsKey(name)
+	err := iterate(s.db, prefix, func(k []byte) {
+		keys = append(keys, k[len(prefix):])
+	})
+	if err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	if len(keys) <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *pebbleStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	var total int
+	allKeys := map[string][][]byte{}
+	err := iterate(s.db, []byte{nsPrefix}, func(k []byte) {
+		name, key, ok := splitKey(k)
+		if !ok {
+			s.log.Warnf("list: skipping invalid key: %x", k)
+			return
+		}
+		allKeys[name] = append(allKeys[name], key)
+		total++
+	})
+	if err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+// The iterator skips to the end of each namespace it finds.
+func (s *pebbleStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	prefix := []byte{nsPrefix}
+	it := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	names := []string{}
+	for it.First(); it.Valid(); {
+		name, _, ok := splitKey(it.Key())
+		if !ok {
+			s.log.Warnf("list: skipping invalid key: %x", it.Key())
+			it.Next()
+			continue
+		}
+		names = append(names, name)
+		it.SeekGE(prefixEnd(nsKey(name)))
+	}
+	if err := it.Close(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	// keys are ordered by the length of the namespace first
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace deletes the range of keys in the namespace.
+func (s *pebbleStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	} else if s.db == nil {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	if err := s.hasNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	prefix := nsKey(name)
+	err := s.db.DeleteRange(prefix, prefixEnd(prefix), s.writeOptions())
+	return s.logError("drop", wrapError(err))
+}
+
+// RenameNamespace copies every entry in namespace from to namespace to,
+// and deletes namespace from, in a single batch.
+func (s *pebbleStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	return s.logError("rename", s.copyNamespace(from, to, true))
+}
+
+// CopyNamespace copies every entry in namespace from to
+// namespace to, in a single batch.
+func (s *pebbleStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return s.logError("copy", s.copyNamespace(from, to, false))
+}
+
+func (s *pebbleStore) copyNamespace(from, to string, move bool) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	} else if s.db == nil {
+		return storage.ErrClosed
+	}
+	if err := s.hasNamespace(from); err != nil {
+		return err
+	}
+	if err := s.hasNamespace(to); err == nil {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	} else if !errors.Is(err, storage.ErrNamespaceNotFound) {
+		return err
+	}
+	b := s.db.NewBatch()
+	defer b.Close()
+	prefix := nsKey(from)
+	it := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	for it.First(); it.Valid(); it.Next() {
+		// the batch copies the key and value
+		if err := b.Set(dataKey(to, it.Key()[len(prefix):]), it.Value(), nil); err != nil {
+			_ = it.Close()
+			return wrapError(err)
+		}
+	}
+	if err := it.Close(); err != nil {
+		return wrapError(err)
+	}
+	if move {
+		if err := b.DeleteRange(prefix, prefixEnd(prefix), nil); err != nil {
+			return wrapError(err)
+		}
+	}
+	return wrapError(b.Commit(s.writeOptions()))
+}
+
+// hasNamespace returns nil if the namespace has at least one key,
+// otherwise the error wraps ErrNamespaceNotFound.
+func (s *pebbleStore) hasNamespace(name string) error {
+	prefix := nsKey(name)
+	it := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	found := it.First()
+	if err := it.Close(); err != nil {
+		return wrapError(err)
+	} else if !found {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the store. The backend counters are
+// from the pebble metrics of the LSM tree.
+func (s *pebbleStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	if s.db == nil {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	prefix := []byte{nsPrefix}
+	it := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	for it.First(); it.Valid(); it.Next() {
+		name, _, ok := splitKey(it.Key())
+		if !ok {
+			s.log.Warnf("stats: skipping invalid key: %x", it.Key())
+			continue
+		}
+		stats.Add(name, storage.NamespaceStats{Keys: 1, ValueBytes: int64(len(it.Value()))})
+	}
+	if err := it.Close(); err != nil {
+		return storage.Stats{}, s.logError("stats", wrapError(err))
+	}
+	var err error
+	if stats.DiskBytes, err = storage.DirSize(s.path); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	m := s.db.Metrics()
+	total := m.Total()
+	stats.Backend = map[string]int64{
+		"tables":         total.NumFiles,
+		"table_bytes":    total.Size,
+		"memtable_bytes": int64(m.MemTable.Size),
+		"wal_bytes":      int64(m.WAL.PhysicalSize),
+		"compactions":    m.Compact.Count,
+		"tombstones":     int64(m.Keys.TombstoneCount),
+		"read_amp":       int64(m.ReadAmp()),
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace.
+func (s *pebbleStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	if s.db == nil {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	prefix := nsKey(name)
+	it := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	var count int64
+	for it.First(); it.Valid(); it.Next() {
+		count++
+	}
+	if err := it.Close(); err != nil {
+		return 0, s.logError("count", wrapError(err))
+	}
+	if count <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
+// Update runs fn in a transaction backed by an indexed pebble batch. The
+// batch is committed atomically if fn returns nil, otherwise it is discarded.
+func (s *pebbleStore) Update(fn func(tx storage.Tx) error) error {
+	s.log.Debug("update: begin batch")
+	if s.db == nil {
+		return s.logError("update", storage.ErrClosed)
+	}
+	b := s.db.NewIndexedBatch()
+	defer b.Close()
+	if err := fn(&pebbleTx{b}); err != nil {
+		s.log.Debugf("update: discard batch: %s", err)
+		return s.logError("update", err)
+	}
+	s.log.Debugf("update: commit batch of %d ops", b.Count())
+	return s.logError("update", wrapError(b.Commit(s.writeOptions())))
+}
+
+// Export copies the datastore to a pebble checkpoint in the directory
+// at path. Export will not write to a path that has data in it.
+func (s *pebbleStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if s.path == path {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	} else if s.db == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	// pebble creates the checkpoint directory, so an empty one is removed
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		err = fmt.Errorf("path is not empty: %s", path)
+		return s.logError("export", err)
+	} else if err == nil {
+		if err = os.Remove(path); err != nil {
+			return s.logError("export", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return s.logError("export", err)
+	}
+	if err := s.db.Checkpoint(path, pebble.WithFlushedWAL()); err != nil {
+		return s.logError("export", wrapError(err))
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// Restore restores an export archive for NewStore(destPath). SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
+// Close closes the datastore and releases all db resources.
+func (s *pebbleStore) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	if s.db == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
+	err := s.db.Close()
+	s.db = nil
+	s.log.Info("store closed")
+	return s.logError("close", wrapError(err))
+}
+
+func (s *pebbleStore) writeOptions() *pebble.WriteOptions {
+	if s.popts.sync {
+		return pebble.Sync
+	}
+	return pebble.NoSync
+}
+
+// pebbleTx is a storage transaction for an indexed pebble batch.
+type pebbleTx struct {
+	b *pebble.Batch
+}
+
+func (t *pebbleTx) Put(name string, key []byte, value []byte) error {
+	return put(t.b, name, key, value, nil)
+}
+
+func (t *pebbleTx) Get(name string, key []byte) ([]byte, error) {
+	return get(t.b, name, key)
+}
+
+func (t *pebbleTx) Delete(name string, key []byte) error {
+	return del(t.b, name, key, nil)
+}
+
+// readWriter is implemented by both *pebble.DB and *pebble.Batch.
+type readWriter interface {
+	pebble.Reader
+	pebble.Writer
+}
+
+func put(rw readWriter, name string, key []byte, value []byte, opts *pebble.WriteOptions) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	} else if len(value) <= 0 {
+		return errors.New("value cannot be empty")
+	}
+	return wrapError(rw.Set(dataKey(name, key), value, opts))
+}
+
+func get(rw readWriter, name string, key []byte) ([]byte, error) {
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, err
+	}
+	v, closer, err := rw.Get(dataKey(name, key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+	} else if err != nil {
+		return nil, wrapError(err)
+	}
+	// pebble values are only valid until the closer is closed
+	value := append([]byte(nil), v...)
+	return value, closer.Close()
+}
+
+func del(rw readWriter, name string, key []byte, opts *pebble.WriteOptions) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	}
+	return wrapError(rw.Delete(dataKey(name, key), opts))
+}
+
+// iterate calls fn with a copy of each key that starts with prefix.
+func iterate(r pebble.Reader, prefix []byte, fn func(k []byte)) error {
+	it := r.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	for it.First(); it.Valid(); it.Next() {
+		fn(append([]byte(nil), it.Key()...))
+	}
+	return it.Close()
+}
+
+// prefixEnd returns the first key after every key that starts with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	// every byte was 0xff, so there is no upper bound
+	return nil
+}
+
+// nsKey returns the prefix for the keys in a namespace.
+func nsKey(name string) []byte {
+	b := make([]byte, 0, 1+binary.MaxVarintLen64+len(name))
+	b = append(b, nsPrefix)
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+// dataKey returns the pebble key for a key in a namespace.
+func dataKey(name string, key []byte) []byte {
+	return append(nsKey(name), key...)
+}
+
+// splitKey returns the namespace and key for a pebble key.
+func splitKey(k []byte) (name string, key []byte, ok bool) {
+	if len(k) <= 0 || k[0] != nsPrefix {
+		return "", nil, false
+	}
+	n, size := binary.Uvarint(k[1:])
+	if size <= 0 || uint64(len(k)-1-size) < n {
+		return "", nil, false
+	}
+	start := 1 + size
+	end := start + int(n)
+	return string(k[start:end]), k[end:], len(k) > end
+}
+
+// wrapError wraps pebble errors with the matching storage error.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pebble.ErrClosed):
+		return storage.WrapError(storage.ErrClosed, err)
+	case errors.Is(err, pebble.ErrReadOnly):
+		return storage.WrapError(storage.ErrReadOnly, err)
+	default:
+		return err
+	}
+}
+
+// pebbleLogger adapts the store logger to the pebble logger. Pebble logs
+// routine maintenance at info level, so it is logged as debug.
+type pebbleLogger struct {
+	log log.Logger
+}
+
+func (l pebbleLogger) Infof(format string, v ...interface{}) {
+	l.log.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l pebbleLogger) Fatalf(format string, v ...interface{}) {
+	l.log.Fatal(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (s *pebbleStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
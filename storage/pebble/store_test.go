@@ -0,0 +1,28 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		end    []byte
+	}{
+		{[]byte{'a'}, []byte{'b'}},
+		{[]byte{'a', 0xff}, []byte{'b'}},
+		{[]byte{0xff, 0xff}, nil},
+		{nsKey("a"), []byte{nsPrefix, 1, 'b'}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.end, prefixEnd(test.prefix), "%x", test.prefix)
+	}
+}
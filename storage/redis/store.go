@@ -0,0 +1,593 @@
+// Package redis provides an implementation of the storage.Storage interface
+// for Redis, so stateless services can share a chest. Each namespace is a
+// redis hash, and each key is a field in the hash.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+)
+
+const logName = "redis"
+
+// ErrExpiryNotSupported is returned when an entry is put with a ttl and the
+// server does not support hash field expiry, which requires Redis 7.4.
+var ErrExpiryNotSupported = errors.New("server does not support hash field expiry")
+
+// redisStore is an implementation the Storage interface for redis.
+type redisStore struct {
+	opts   storage.StoreOptions
+	ropts  options
+	path   string
+	client *redis.Client
+	log    log.Logger
+}
+
+var (
+	_ storage.ExpiringStorage = (*redisStore)(nil)
+	_ storage.StatsStorage    = (*redisStore)(nil)
+	_ storage.Restorer        = (*redisStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by redis. The path is
+// the prefix of the redis keys for the store, the hash for a namespace is
+// the key "path:namespace". Stores sharing a server should not use a path
+// which is a prefix of the path of another store.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	ropts := applyRedisOptions(defaultOptions, opt...)
+	return &redisStore{path: path, opts: opts, ropts: ropts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *redisStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open connects to the redis server.
+func (s *redisStore) Open() error {
+	s.log.Debugf("opening store at path: %s", s.path)
+	opts, err := redis.ParseURL(s.ropts.url)
+	if err != nil {
+		return s.logError("open", err)
+	}
+	if s.ropts.tuning != nil {
+		s.ropts.tuning(opts)
+	}
+	client := redis.NewClient(opts)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return s.logError("open", err)
+	}
+	s.client = client
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store. If the store has a ttl the entry expires after it.
+func (s *redisStore) Put(name string, key []byte, value []byte) error {
+	return s.logError("put", s.put(name, key, value, s.ropts.ttl))
+}
+
+// PutTTL puts an entry in the store which expires after ttl. Redis
+// expires hash fields in whole seconds, so ttl is rounded up.
+func (s *redisStore) PutTTL(name string, key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		err := fmt.Errorf("invalid ttl: %s", ttl)
+		return s.logError("put", err)
+	}
+	return s.logError("put", s.put(name, key, value, ttl))
+}
+
+func (s *redisStore) put(name string, key []byte, value []byte, ttl time.Duration) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	} else if len(value) <= 0 {
+		return errors.New("value cannot be empty")
+	} else if s.client == nil {
+		return storage.ErrClosed
+	}
+	ctx := context.Background()
+	if ttl <= 0 {
+		return wrapError(s.client.HSet(ctx, s.hashKey(name), key, value).Err())
+	}
+	s.log.Debugf("put: key: %s.%s expires in %s", name, key, ttl)
+	// the value and its expiry are set atomically, an older server
+	// rejects the unknown command and discards the transaction
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.hashKey(name), key, value)
+		pipe.HExpire(ctx, s.hashKey(name), ceilSeconds(ttl), string(key))
+		return nil
+	})
+	if isUnknownCommand(err) {
+		return fmt.Errorf("%w: %s", ErrExpiryNotSupported, err)
+	}
+	return wrapError(err)
+}
+
+// ceilSeconds rounds ttl up to whole seconds.
+func ceilSeconds(ttl time.Duration) time.Duration {
+	if t := ttl.Truncate(time.Second); t < ttl {
+		return t + time.Second
+	}
+	return ttl
+}
+
+// Get a value from the store.
+func (s *redisStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	} else if s.client == nil {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	value, err := s.client.HGet(context.Background(), s.hashKey(name), string(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		err = fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		return nil, s.logError("get", err)
+	} else if err != nil {
+		return nil, s.logError("get", wrapError(err))
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *redisStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *redisStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *redisStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	} else if s.client == nil {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	has, err := s.client.HExists(context.Background(), s.hashKey(name), string(key)).Result()
+	if err != nil {
+		return false, s.logError("has", wrapError(err))
+	}
+	s.log.Debugf("has: found key %s: %t", key, has)
+	return has, nil
+}
+
+// Delete removes a key from the store.
+func (s *redisStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	} else if s.client == nil {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	err := s.client.HDel(context.Background(), s.hashKey(name), string(key)).Err()
+	return s.logError("delete", wrapError(err))
+}
+
+// List returns a list of all keys in the namespace. The keys are
+// scanned with HSCAN, so large namespaces do not block the server.
+func (s *redisStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	ctx := context.Background()
+	var keys [][]byte
+	var cursor uint64
+	for {
+		page, next, err := s.client.HScan(ctx, s.hashKey(name), cursor, "", s.ropts.pageSize).Result()
+		if err != nil {
+			return nil, s.logError("list", wrapError(err))
+		}
+		keys = appendFields(keys, page)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(keys) <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	keys = uniqueKeys(keys)
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store. The namespaces
+// are scanned, and then the keys of every namespace are scanned in one
+// pipeline per page.
+func (s *redisStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	ctx := context.Background()
+	cursors := map[string]uint64{}
+	iter := s.client.ScanType(ctx, 0, s.keyPattern(), s.ropts.pageSize, "hash").Iterator()
+	for iter.Next(ctx) {
+		cursors[strings.TrimPrefix(iter.Val(), s.path+":")] = 0
+	}
+	if err := iter.Err(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	allKeys := map[string][][]byte{}
+	for len(cursors) > 0 {
+		cmds := map[string]*redis.ScanCmd{}
+		_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for name, cursor := range cursors {
+				cmds[name] = pipe.HScan(ctx, s.hashKey(name), cursor, "", s.ropts.pageSize)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, s.logError("list", wrapError(err))
+		}
+		for name, cmd := range cmds {
+			page, next := cmd.Val()
+			allKeys[name] = appendFields(allKeys[name], page)
+			if next == 0 {
+				delete(cursors, name)
+			} else {
+				cursors[name] = next
+			}
+		}
+	}
+	var total int
+	for name, keys := range allKeys {
+		// a hash can expire while it is scanned
+		if len(keys) <= 0 {
+			delete(allKeys, name)
+			continue
+		}
+		allKeys[name] = uniqueKeys(keys)
+		total += len(allKeys[name])
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the hashes of the store.
+func (s *redisStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	ctx := context.Background()
+	// SCAN may return a key more than once
+	seen := map[string]bool{}
+	names := []string{}
+	iter := s.client.ScanType(ctx, 0, s.keyPattern(), s.ropts.pageSize, "hash").Iterator()
+	for iter.Next(ctx) {
+		name := strings.TrimPrefix(iter.Val(), s.path+":")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace deletes the hash of the namespace.
+func (s *redisStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	} else if s.client == nil {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	n, err := s.client.Del(context.Background(), s.hashKey(name)).Result()
+	if err != nil {
+		return s.logError("drop", wrapError(err))
+	} else if n <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return s.logError("drop", err)
+	}
+	return nil
+}
+
+// RenameNamespace renames the hash of the namespace with RENAMENX,
+// so the rename is atomic.
+func (s *redisStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	err := s.moveNamespace(from, to, func(ctx context.Context) (bool, error) {
+		return s.client.RenameNX(ctx, s.hashKey(from), s.hashKey(to)).Result()
+	})
+	return s.logError("rename", err)
+}
+
+// CopyNamespace copies the hash of the namespace with COPY, which
+// needs redis 6.2 or later. The expiry of the fields is copied too.
+func (s *redisStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	err := s.moveNamespace(from, to, func(ctx context.Context) (bool, error) {
+		n, err := s.client.Copy(ctx, s.hashKey(from), s.hashKey(to), 0, false).Result()
+		return n > 0, err
+	})
+	return s.logError("copy", err)
+}
+
+// moveNamespace checks the namespaces, then calls fn to rename or copy
+// namespace from to namespace to. fn returns false if to exists.
+func (s *redisStore) moveNamespace(from, to string, fn func(ctx context.Context) (bool, error)) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	} else if s.client == nil {
+		return storage.ErrClosed
+	}
+	ctx := context.Background()
+	n, err := s.client.Exists(ctx, s.hashKey(from)).Result()
+	if err != nil {
+		return wrapError(err)
+	} else if n <= 0 {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	} else if from == to {
+		// redis rejects copying a key to itself
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	}
+	ok, err := fn(ctx)
+	if isUnknownCommand(err) {
+		return fmt.Errorf("%w: %s", storage.ErrNotSupported, err)
+	} else if err != nil {
+		return wrapError(err)
+	} else if !ok {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the store by scanning the hashes of
+// the store. The store has no files, so the disk size is zero.
+func (s *redisStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	if s.client == nil {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	ctx := context.Background()
+	var names []string
+	iter := s.client.ScanType(ctx, 0, s.keyPattern(), s.ropts.pageSize, "hash").Iterator()
+	for iter.Next(ctx) {
+		names = append(names, strings.TrimPrefix(iter.Val(), s.path+":"))
+	}
+	if err := iter.Err(); err != nil {
+		return storage.Stats{}, s.logError("stats", wrapError(err))
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	for _, name := range names {
+		// HSCAN may return a field more than once
+		sizes := map[string]int64{}
+		var cursor uint64
+		for {
+			page, next, err := s.client.HScan(ctx, s.hashKey(name), cursor, "", s.ropts.pageSize).Result()
+			if err != nil {
+				return storage.Stats{}, s.logError("stats", wrapError(err))
+			}
+			for i := 0; i+1 < len(page); i += 2 {
+				sizes[page[i]] = int64(len(page[i+1]))
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		ns := storage.NamespaceStats{Keys: int64(len(sizes))}
+		for _, size := range sizes {
+			ns.ValueBytes += size
+		}
+		if ns.Keys > 0 {
+			stats.Add(name, ns)
+		}
+	}
+	stats.Backend = map[string]int64{"hashes": int64(len(names))}
+	return stats, nil
+}
+
+// Count returns the number of fields in the hash of the namespace.
+func (s *redisStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	if s.client == nil {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	count, err := s.client.HLen(context.Background(), s.hashKey(name)).Result()
+	if err != nil {
+		return 0, s.logError("count", wrapError(err))
+	}
+	if count <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
+// Export copies the records in the store to the directory at path. The
+// directory is written in the layout of the fs store, so an export can be
+// opened with fs.NewStore. Export will not write to a path that has data.
+func (s *redisStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if filepath.Clean(s.path) == filepath.Clean(path) {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	} else if s.client == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		err = fmt.Errorf("path is not empty: %s", path)
+		return s.logError("export", err)
+	} else if err != nil && !os.IsNotExist(err) {
+		return s.logError("export", err)
+	}
+	allKeys, err := s.ListAll()
+	if err != nil {
+		return s.logError("export", err)
+	}
+	dst := fs.NewStore(path, storage.WithLogger(s.opts.Logger()))
+	if err = dst.Open(); err != nil {
+		return s.logError("export", err)
+	}
+	ctx := context.Background()
+	for name, keys := range allKeys {
+		for _, key := range keys {
+			var value []byte
+			value, err = s.client.HGet(ctx, s.hashKey(name), string(key)).Bytes()
+			if errors.Is(err, redis.Nil) {
+				// the key expired or was deleted since it was listed
+				err = nil
+				continue
+			} else if err != nil {
+				err = wrapError(err)
+				break
+			}
+			if err = dst.Put(name, key, value); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// Restore restores the export archive at archivePath into the store. An
+// export is written in the layout of the fs store, which is opened to put
+// its entries in the store. SEE: storage.RestoreArchiveTo.
+func (s *redisStore) Restore(archivePath string, opt ...storage.RestoreOption) error {
+	open := func(path string) storage.Storage {
+		return fs.NewStore(path, storage.WithLogger(s.opts.Logger()))
+	}
+	return s.logError("restore", storage.RestoreArchiveTo(s, archivePath, open, opt...))
+}
+
+// Close closes the connection to the server.
+func (s *redisStore) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	if s.client == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
+	err := s.client.Close()
+	s.client = nil
+	s.log.Info("store closed")
+	return s.logError("close", err)
+}
+
+// hashKey returns the redis key of the hash for a namespace.
+func (s *redisStore) hashKey(name string) string {
+	return s.path + ":" + name
+}
+
+// keyPattern returns the pattern which matches the hashes for the store.
+func (s *redisStore) keyPattern() string {
+	var b strings.Builder
+	for i := 0; i < len(s.path); i++ {
+		switch c := s.path[i]; c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString(":*")
+	return b.String()
+}
+
+// appendFields appends the fields of the field value pairs
+// returned by HSCAN to keys.
+func appendFields(keys [][]byte, page []string) [][]byte {
+	for i := 0; i < len(page); i += 2 {
+		keys = append(keys, []byte(page[i]))
+	}
+	return keys
+}
+
+// uniqueKeys sorts keys and removes duplicates, which
+// HSCAN may return if the hash changes while it is scanned.
+func uniqueKeys(keys [][]byte) [][]byte {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	unique := keys[:0]
+	for i, key := range keys {
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			continue
+		}
+		unique = append(unique, key)
+	}
+	return unique
+}
+
+func isUnknownCommand(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
+
+// wrapError maps redis errors to the storage errors.
+func wrapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, redis.ErrClosed):
+		return storage.WrapError(storage.ErrClosed, err)
+	case strings.HasPrefix(err.Error(), "READONLY"):
+		return storage.WrapError(storage.ErrReadOnly, err)
+	default:
+		return err
+	}
+}
+
+func (s *redisStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
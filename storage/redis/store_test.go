@@ -0,0 +1,114 @@
+package redis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestFactory returns a factory for stores on an in-process redis.
+// The conformance suite opens exports with the factory, so an exported
+// directory is loaded into the store before it is returned.
+func newTestFactory(t *testing.T) (*miniredis.Miniredis, storagetest.Factory) {
+	mr := miniredis.RunT(t)
+	url := WithURL("redis://" + mr.Addr())
+	return mr, func(path string, opt ...storage.StoreOption) storage.Storage {
+		store := NewStore(path, append(opt, url)...)
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			assert.NoError(t, load(path, store))
+		}
+		return store
+	}
+}
+
+// load puts the records from the fs store at path in store.
+func load(path string, store storage.Storage) error {
+	src := fs.NewStore(path)
+	if err := src.Open(); err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := store.Open(); err != nil {
+		return err
+	}
+	defer store.Close()
+	all, err := src.ListAll()
+	if err != nil {
+		return err
+	}
+	for name, keys := range all {
+		for _, key := range keys {
+			value, err := src.Get(name, key)
+			if err != nil {
+				return err
+			}
+			if err = store.Put(name, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	_, factory := newTestFactory(t)
+	storagetest.RunConformance(t, factory, storagetest.WithRestorer())
+}
+
+func TestStore_PutTTL(t *testing.T) {
+	mr, factory := newTestFactory(t)
+	store := factory("chestnut")
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	exStore, ok := store.(storage.ExpiringStorage)
+	assert.True(t, ok)
+	assert.Error(t, exStore.PutTTL("a", []byte("b"), []byte("c"), 0))
+	assert.NoError(t, exStore.PutTTL("a", []byte("b"), []byte("c"), 1500*time.Millisecond))
+	assert.NoError(t, store.Put("a", []byte("d"), []byte("e")))
+	mr.FastForward(time.Second)
+	has, err := store.Has("a", []byte("b"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+	// the ttl is rounded up to whole seconds
+	mr.FastForward(time.Second)
+	_, err = store.Get("a", []byte("b"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	keys, err := store.List("a")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("d")}, keys)
+}
+
+func TestStore_ListAll(t *testing.T) {
+	_, factory := newTestFactory(t)
+	store := factory("chest[1]*", WithPageSize(2))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	// a store with a path that matches the pattern of the first store
+	other := factory("chest1x")
+	assert.NoError(t, other.Open())
+	defer other.Close()
+	assert.NoError(t, other.Put("a", []byte("z"), []byte("z")))
+	want := map[string][][]byte{}
+	for _, name := range []string{"a", "b", "c"} {
+		for _, key := range []string{"1", "2", "3", "4", "5"} {
+			assert.NoError(t, store.Put(name, []byte(key), []byte(key)))
+			want[name] = append(want[name], []byte(key))
+		}
+	}
+	got, err := store.ListAll()
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestCeilSeconds(t *testing.T) {
+	assert.Equal(t, time.Second, ceilSeconds(time.Millisecond))
+	assert.Equal(t, time.Second, ceilSeconds(time.Second))
+	assert.Equal(t, 2*time.Second, ceilSeconds(1001*time.Millisecond))
+}
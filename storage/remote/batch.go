@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"errors"
+	"net/http"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/remote/server"
+)
+
+// Batcher is implemented by the remote store. It groups puts and deletes
+// so they are sent to the server in as few requests as possible.
+//
+//	b := store.(remote.Batcher).NewBatch()
+type Batcher interface {
+	NewBatch() *Batch
+}
+
+var _ Batcher = (*remoteStore)(nil)
+
+// Batch is a list of puts and deletes that are sent to the server together.
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	s   *remoteStore
+	ops []server.Op
+}
+
+// NewBatch returns a new empty Batch for the store.
+func (s *remoteStore) NewBatch() *Batch {
+	return &Batch{s: s}
+}
+
+// Put adds a put of value at key to the batch.
+func (b *Batch) Put(name string, key []byte, value []byte) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return b.s.logError("batch put", err)
+	} else if len(value) <= 0 {
+		err = errors.New("value cannot be empty")
+		return b.s.logError("batch put", err)
+	}
+	b.ops = append(b.ops, server.Op{Type: server.OpPut, Namespace: name, Key: key, Value: value})
+	return nil
+}
+
+// Delete adds a delete of key to the batch.
+func (b *Batch) Delete(name string, key []byte) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return b.s.logError("batch delete", err)
+	}
+	b.ops = append(b.ops, server.Op{Type: server.OpDelete, Namespace: name, Key: key})
+	return nil
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit sends the batch to the server. Operations are applied in order,
+// large batches are split into requests of at most the configured batch
+// limit. If Commit fails the operations that were not acknowledged by the
+// server are left in the batch, so Commit can be called again.
+func (b *Batch) Commit() error {
+	limit := b.s.ropts.batchLimit
+	if limit <= 0 {
+		limit = len(b.ops)
+	}
+	b.s.log.Debugf("batch: commit %d operations", len(b.ops))
+	for len(b.ops) > 0 {
+		n := limit
+		if n > len(b.ops) {
+			n = len(b.ops)
+		}
+		body, err := jsoniter.Marshal(b.ops[:n])
+		if err != nil {
+			return b.s.logError("batch", err)
+		}
+		res, err := b.s.do(http.MethodPost, server.BatchPath, body)
+		if err != nil {
+			return b.s.logError("batch", err)
+		}
+		_ = res.Body.Close()
+		b.ops = b.ops[n:]
+	}
+	b.ops = nil
+	return nil
+}
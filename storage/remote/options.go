@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"net/http"
+	"time"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the remote store specific options.
+type options struct {
+	token      string
+	client     *http.Client
+	retries    int
+	backoff    time.Duration
+	batchLimit int
+}
+
+var defaultOptions = options{
+	client:     http.DefaultClient,
+	retries:    3,
+	backoff:    100 * time.Millisecond,
+	batchLimit: 1000,
+}
+
+// remoteOption is implemented by StoreOptions that configure the remote store.
+type remoteOption interface {
+	storage.StoreOption
+	applyRemote(*options)
+}
+
+// remoteFuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type remoteFuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o remoteFuncOption) applyRemote(opts *options) {
+	o.f(opts)
+}
+
+func newRemoteOption(f func(*options)) storage.StoreOption {
+	return remoteFuncOption{f: f}
+}
+
+// applyRemoteOptions applies the remote store specific options in opt.
+func applyRemoteOptions(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if ro, ok := o.(remoteOption); ok {
+			ro.applyRemote(&opts)
+		}
+	}
+	return opts
+}
+
+// WithToken returns a StoreOption which sets the bearer token sent to the server.
+func WithToken(token string) storage.StoreOption {
+	return newRemoteOption(func(o *options) {
+		o.token = token
+	})
+}
+
+// WithHTTPClient returns a StoreOption which sets the http client used to reach the server.
+func WithHTTPClient(c *http.Client) storage.StoreOption {
+	return newRemoteOption(func(o *options) {
+		o.client = c
+	})
+}
+
+// WithRetries returns a StoreOption which sets the number of times a failed
+// request is retried, and the initial backoff between attempts. The backoff
+// doubles after each attempt. Only network errors and 429, 502, 503, and 504
+// responses are retried, and only for GET, HEAD, PUT and DELETE requests.
+// Batches and namespace renames and copies are sent once.
+func WithRetries(retries int, backoff time.Duration) storage.StoreOption {
+	return newRemoteOption(func(o *options) {
+		o.retries = retries
+		o.backoff = backoff
+	})
+}
+
+// WithBatchLimit returns a StoreOption which sets the maximum number of
+// operations sent in a single batch request. Larger batches are split.
+func WithBatchLimit(n int) storage.StoreOption {
+	return newRemoteOption(func(o *options) {
+		o.batchLimit = n
+	})
+}
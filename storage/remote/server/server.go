@@ -0,0 +1,562 @@
+// Package server provides a reference server for the remote storage backend.
+// The server only ever sees the ciphertext produced by the client-side
+// Chestnut, it stores whatever bytes it is given in a backing storage.Storage.
+//
+// The handler can be served directly, or in tests with net/http/httptest:
+//
+//	srv := httptest.NewServer(server.NewHandler(bolt.NewStore(path)))
+//	store := remote.NewStore(srv.URL)
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const logName = "remote-server"
+
+// api paths
+const (
+	HealthPath = "/v1/health"
+	DataPath   = "/v1/data"
+	BatchPath  = "/v1/batch"
+	ExportPath = "/v1/export"
+	StatsPath  = "/v1/stats"
+	// NamespacesPath lists namespaces, and renames or copies them.
+	// A namespace is dropped by deleting its data path.
+	NamespacesPath = "/v1/namespaces"
+	// ArchivePath streams an export archive of the backing store,
+	// which is restored with the Restore of the store's package.
+	ArchivePath = "/v1/archive"
+)
+
+// MaxBodySize is the largest request body the server will accept.
+const MaxBodySize = 64 << 20
+
+// OpType is the type of operation in a batch.
+type OpType string
+
+// batch operation types
+const (
+	OpPut    OpType = "put"
+	OpDelete OpType = "delete"
+)
+
+// Op is a single operation in a batch request.
+type Op struct {
+	Type      OpType `json:"op"`
+	Namespace string `json:"namespace"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+// namespace operation types
+const (
+	OpRename OpType = "rename"
+	OpCopy   OpType = "copy"
+)
+
+// NamespaceOp is the request body to rename or copy a namespace.
+type NamespaceOp struct {
+	Type OpType `json:"op"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// NamespaceList is the response body for a namespaces list request.
+type NamespaceList struct {
+	Namespaces []string `json:"namespaces"`
+}
+
+// Error is the response body for a failed request.
+type Error struct {
+	Error string `json:"error"`
+	// Code identifies the storage error, SEE: ErrorCode.
+	Code string `json:"code,omitempty"`
+}
+
+// error codes for the storage errors a client can expect
+const (
+	CodeInvalidKey        = "invalid_key"
+	CodeNotFound          = "not_found"
+	CodeNamespaceNotFound = "namespace_not_found"
+	CodeNamespaceExists   = "namespace_exists"
+	CodeReadOnly          = "read_only"
+	CodeClosed            = "closed"
+	CodeCorrupt           = "corrupt"
+	CodeNotSupported      = "not_supported"
+)
+
+var errorCodes = []struct {
+	code string
+	err  error
+}{
+	// ErrNamespaceNotFound wraps ErrNotFound so it must come first
+	{CodeNamespaceNotFound, storage.ErrNamespaceNotFound},
+	{CodeNotFound, storage.ErrNotFound},
+	{CodeNamespaceExists, storage.ErrNamespaceExists},
+	{CodeInvalidKey, storage.ErrInvalidKey},
+	{CodeReadOnly, storage.ErrReadOnly},
+	{CodeClosed, storage.ErrClosed},
+	{CodeCorrupt, storage.ErrCorrupt},
+	{CodeNotSupported, storage.ErrNotSupported},
+}
+
+// ErrorCode returns the error code for a storage error, or
+// an empty string if err is not a known storage error.
+func ErrorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return ""
+}
+
+// CodeError returns the storage error for an error code, or nil if
+// the code is not known. It is the inverse of ErrorCode.
+func CodeError(code string) error {
+	for _, ec := range errorCodes {
+		if ec.code == code {
+			return ec.err
+		}
+	}
+	return nil
+}
+
+// KeyList is the response body for a namespace list request.
+type KeyList struct {
+	Keys [][]byte `json:"keys"`
+}
+
+// KeyCount is the response body for a namespace count request.
+type KeyCount struct {
+	Count int64 `json:"count"`
+}
+
+// Options provides the configuration for the reference server.
+type Options struct {
+	token string
+	log   log.Logger
+}
+
+// Option sets options for the reference server.
+type Option func(*Options)
+
+// WithToken requires clients to present token as a bearer token.
+func WithToken(token string) Option {
+	return func(o *Options) {
+		o.token = token
+	}
+}
+
+// WithLogger sets the logger to use for the server.
+func WithLogger(l log.Logger) Option {
+	return func(o *Options) {
+		o.log = l
+	}
+}
+
+type handler struct {
+	store storage.Storage
+	token [sha256.Size]byte
+	auth  bool
+	log   log.Logger
+}
+
+// NewHandler returns an http.Handler which serves the opened store to
+// remote storage clients. The caller is responsible for opening and
+// closing the store.
+func NewHandler(store storage.Storage, opt ...Option) http.Handler {
+	opts := Options{log: log.Log}
+	for _, o := range opt {
+		o(&opts)
+	}
+	logger := log.Named(opts.log, logName)
+	if store == nil {
+		logger.Panic("store required")
+	}
+	h := &handler{store: store, log: logger}
+	if opts.token != "" {
+		h.token = sha256.Sum256([]byte(opts.token))
+		h.auth = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthPath, h.health)
+	mux.HandleFunc(DataPath, h.withAuth(h.listAll))
+	mux.HandleFunc(DataPath+"/", h.withAuth(h.data))
+	mux.HandleFunc(BatchPath, h.withAuth(h.batch))
+	mux.HandleFunc(ExportPath, h.withAuth(h.export))
+	mux.HandleFunc(ArchivePath, h.withAuth(h.archive))
+	mux.HandleFunc(StatsPath, h.withAuth(h.stats))
+	mux.HandleFunc(StatsPath+"/", h.withAuth(h.count))
+	mux.HandleFunc(NamespacesPath, h.withAuth(h.namespaces))
+	return mux
+}
+
+func (h *handler) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.auth {
+			const prefix = "Bearer "
+			a := r.Header.Get("Authorization")
+			sum := sha256.Sum256([]byte(strings.TrimPrefix(a, prefix)))
+			if !strings.HasPrefix(a, prefix) ||
+				subtle.ConstantTimeCompare(sum[:], h.token[:]) != 1 {
+				h.writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (h *handler) health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// DataURL returns the escaped api path for a namespace, or a key in the namespace.
+func DataURL(name string, key []byte) string {
+	p := DataPath + "/" + url.PathEscape(name)
+	if key != nil {
+		p += "/" + url.PathEscape(string(key))
+	}
+	return p
+}
+
+// parseDataPath returns the namespace and key for an escaped data path.
+func parseDataPath(escapedPath string) (name string, key []byte, ok bool) {
+	p := strings.TrimPrefix(escapedPath, DataPath+"/")
+	parts := strings.Split(p, "/")
+	if len(parts) > 2 {
+		return "", nil, false
+	}
+	var err error
+	if name, err = url.PathUnescape(parts[0]); err != nil || name == "" {
+		return "", nil, false
+	}
+	if len(parts) == 1 {
+		return name, nil, true
+	}
+	k, err := url.PathUnescape(parts[1])
+	if err != nil || k == "" {
+		return "", nil, false
+	}
+	return name, []byte(k), true
+}
+
+func (h *handler) data(w http.ResponseWriter, r *http.Request) {
+	name, key, ok := parseDataPath(r.URL.EscapedPath())
+	if !ok {
+		h.writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if key == nil {
+		switch r.Method {
+		case http.MethodGet:
+			h.list(w, name)
+		case http.MethodDelete:
+			if err := h.store.DropNamespace(name); err != nil {
+				h.writeStoreError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w, name, key)
+	case http.MethodHead:
+		if has, _ := h.store.Has(name, key); !has {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+		if err != nil {
+			h.writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err = h.store.Put(name, key, value); err != nil {
+			h.writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.store.Delete(name, key); err != nil {
+			h.writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h *handler) get(w http.ResponseWriter, name string, key []byte) {
+	value, err := h.store.Get(name, key)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(value); err != nil {
+		h.log.Warnf("write response: %s", err)
+	}
+}
+
+func (h *handler) list(w http.ResponseWriter, name string) {
+	keys, err := h.store.List(name)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, KeyList{keys})
+}
+
+func (h *handler) listAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	keys, err := h.store.ListAll()
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, keys)
+}
+
+// StatsURL returns the escaped api path to count the keys in a namespace.
+func StatsURL(name string) string {
+	return StatsPath + "/" + url.PathEscape(name)
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	stats, err := storage.CollectStats(h.store)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *handler) count(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	p := strings.TrimPrefix(r.URL.EscapedPath(), StatsPath+"/")
+	name, err := url.PathUnescape(p)
+	if err != nil || name == "" || strings.Contains(p, "/") {
+		h.writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	count, err := storage.CountKeys(h.store, name)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, KeyCount{count})
+}
+
+// namespaces lists the namespaces, or renames or copies a namespace.
+func (h *handler) namespaces(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names, err := h.store.ListNamespaces()
+		if err != nil {
+			h.writeStoreError(w, err)
+			return
+		}
+		h.writeJSON(w, http.StatusOK, NamespaceList{names})
+		return
+	case http.MethodPost:
+	default:
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		h.writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var op NamespaceOp
+	if err = jsoniter.Unmarshal(body, &op); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch op.Type {
+	case OpRename:
+		err = h.store.RenameNamespace(op.From, op.To)
+	case OpCopy:
+		err = h.store.CopyNamespace(op.From, op.To)
+	default:
+		err = fmt.Errorf("%w: unknown op: %s", errBadRequest, op.Type)
+	}
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batch applies the operations in order. If an operation fails the
+// operations before it have already been applied. Since puts and
+// deletes are idempotent a client can safely retry the whole batch.
+func (h *handler) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		h.writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var ops []Op
+	if err = jsoniter.Unmarshal(body, &ops); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for i, op := range ops {
+		switch op.Type {
+		case OpPut:
+			err = h.store.Put(op.Namespace, op.Key, op.Value)
+		case OpDelete:
+			err = h.store.Delete(op.Namespace, op.Key)
+		default:
+			err = fmt.Errorf("%w: unknown op: %s", errBadRequest, op.Type)
+		}
+		if err != nil {
+			h.writeStoreError(w, fmt.Errorf("op %d: %w", i, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// export streams the backing store's native export as an export archive,
+// with a manifest of its files. SEE: storage.RestoreArchive.
+func (h *handler) export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	dir, err := os.MkdirTemp("", "chestnut-export-*")
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err = h.store.Export(dir); err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+	aw := storage.NewArchiveWriter(w)
+	if err = aw.WriteDir(dir, storage.ArchiveExportName); err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		// the status has already been sent, the client will
+		// see a truncated archive and fail to extract it.
+		h.log.Errorf("export: %s", err)
+	}
+}
+
+// archive streams an export archive of the backing store.
+func (h *handler) archive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	sw := &startWriter{w: w}
+	if err := storage.ExportTo(h.store, sw); err != nil {
+		if !sw.started {
+			h.writeStoreError(w, err)
+			return
+		}
+		// the status has already been sent, the client will
+		// see a truncated archive which fails to restore.
+		h.log.Errorf("archive: %s", err)
+	}
+}
+
+// startWriter records if anything was written to w.
+type startWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+var errBadRequest = errors.New("bad request")
+
+// writeStoreError maps an error returned by the store to a status code.
+func (h *handler) writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrInvalidKey), errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, storage.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, storage.ErrNamespaceExists):
+		status = http.StatusConflict
+	case errors.Is(err, storage.ErrNotSupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, storage.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, storage.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+	h.writeError(w, status, err)
+}
+
+func (h *handler) writeError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		h.log.Error(err)
+	}
+	h.writeJSON(w, status, Error{err.Error(), ErrorCode(err)})
+}
+
+func (h *handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		h.log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(b); err != nil {
+		h.log.Warnf("write response: %s", err)
+	}
+}
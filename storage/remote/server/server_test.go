@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage/bolt"
+)
+
+func TestParseDataPath(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		key  []byte
+		ok   bool
+	}{
+		{DataURL("a", nil), "a", nil, true},
+		{DataURL("a", []byte("b")), "a", []byte("b"), true},
+		{DataURL("c/c", []byte("c/c")), "c/c", []byte("c/c"), true},
+		{DataURL(".d", []byte(".d")), ".d", []byte(".d"), true},
+		{DataPath + "/", "", nil, false},
+		{DataPath + "/a/", "", nil, false},
+		{DataPath + "/a/b/c", "", nil, false},
+	}
+	for _, test := range tests {
+		name, key, ok := parseDataPath(test.path)
+		assert.Equal(t, test.ok, ok, test.path)
+		assert.Equal(t, test.name, name, test.path)
+		assert.Equal(t, test.key, key, test.path)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	const token = "test-token"
+	store := bolt.NewStore(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.Panics(t, func() {
+		_ = NewHandler(nil)
+	})
+	srv := httptest.NewServer(NewHandler(store, WithToken(token)))
+	defer srv.Close()
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{http.MethodGet, HealthPath, "", "", http.StatusOK},
+		{http.MethodGet, DataPath, "", "", http.StatusUnauthorized},
+		{http.MethodGet, DataPath, "bad-token", "", http.StatusUnauthorized},
+		{http.MethodGet, DataPath, token, "", http.StatusOK},
+		{http.MethodPut, DataURL("a", []byte("b")), token, "c", http.StatusNoContent},
+		{http.MethodGet, DataURL("a", []byte("b")), token, "", http.StatusOK},
+		{http.MethodHead, DataURL("a", []byte("x")), token, "", http.StatusNotFound},
+		{http.MethodGet, DataURL("a", []byte("x")), token, "", http.StatusNotFound},
+		{http.MethodPost, DataURL("a", []byte("b")), token, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, BatchPath, token, `[{"op":"nope"}]`, http.StatusBadRequest},
+		{http.MethodPost, BatchPath, token, `nope`, http.StatusBadRequest},
+		{http.MethodPost, ExportPath, token, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, ExportPath, token, "", http.StatusOK},
+		{http.MethodGet, ArchivePath, "", "", http.StatusUnauthorized},
+		{http.MethodPost, ArchivePath, token, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, ArchivePath, token, "", http.StatusOK},
+		{http.MethodGet, StatsPath, "", "", http.StatusUnauthorized},
+		{http.MethodGet, StatsPath, token, "", http.StatusOK},
+		{http.MethodPost, StatsPath, token, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, StatsURL("a"), token, "", http.StatusOK},
+		{http.MethodGet, StatsURL("x"), token, "", http.StatusNotFound},
+		{http.MethodGet, StatsPath + "/a/b", token, "", http.StatusNotFound},
+		{http.MethodGet, NamespacesPath, "", "", http.StatusUnauthorized},
+		{http.MethodGet, NamespacesPath, token, "", http.StatusOK},
+		{http.MethodPut, NamespacesPath, token, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, NamespacesPath, token, `{"op":"nope","from":"a","to":"b"}`, http.StatusBadRequest},
+		{http.MethodPost, NamespacesPath, token, `{"op":"copy","from":"x","to":"b"}`, http.StatusNotFound},
+		{http.MethodPost, NamespacesPath, token, `{"op":"copy","from":"a","to":"b"}`, http.StatusNoContent},
+		{http.MethodPost, NamespacesPath, token, `{"op":"rename","from":"a","to":"b"}`, http.StatusConflict},
+		{http.MethodPost, NamespacesPath, token, `{"op":"rename","from":"a","to":""}`, http.StatusBadRequest},
+		{http.MethodDelete, DataURL("b", nil), token, "", http.StatusNoContent},
+		{http.MethodDelete, DataURL("b", nil), token, "", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		assert.NoError(t, err)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, test.status, res.StatusCode, "%d %s %s", i, test.method, test.path)
+	}
+}
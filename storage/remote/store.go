@@ -0,0 +1,454 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/remote/server"
+)
+
+const logName = "remote"
+
+// remoteStore is an implementation the Storage interface for a remote
+// ciphertext-only server. Encryption stays with the client-side Chestnut,
+// the server never sees plaintext, or the secrets used to encrypt it.
+type remoteStore struct {
+	opts   storage.StoreOptions
+	ropts  options
+	url    string
+	client *http.Client
+	log    log.Logger
+}
+
+var (
+	_ storage.Storage        = (*remoteStore)(nil)
+	_ storage.StatsStorage   = (*remoteStore)(nil)
+	_ storage.StreamExporter = (*remoteStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by a remote server at url.
+func NewStore(url string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if url == "" {
+		logger.Panic("store url required")
+	}
+	ropts := applyRemoteOptions(defaultOptions, opt...)
+	url = strings.TrimSuffix(url, "/")
+	return &remoteStore{url: url, opts: opts, ropts: ropts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *remoteStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open checks that the remote server is reachable.
+func (s *remoteStore) Open() error {
+	s.log.Debugf("opening store at url: %s", s.url)
+	s.client = s.ropts.client
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	res, err := s.do(http.MethodGet, server.HealthPath, nil)
+	if err != nil {
+		s.client = nil
+		return s.logError("open", err)
+	}
+	_ = res.Body.Close()
+	s.log.Infof("opened store at url: %s", s.url)
+	return nil
+}
+
+// Put an entry in the store.
+func (s *remoteStore) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("put", err)
+	} else if len(value) <= 0 {
+		err = errors.New("value cannot be empty")
+		return s.logError("put", err)
+	}
+	res, err := s.do(http.MethodPut, server.DataURL(name, key), value)
+	if err != nil {
+		return s.logError("put", err)
+	}
+	return s.logError("put", res.Body.Close())
+}
+
+// Get a value from the store.
+func (s *remoteStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	}
+	res, err := s.do(http.MethodGet, server.DataURL(name, key), nil)
+	if err != nil {
+		return nil, s.logError("get", err)
+	}
+	defer res.Body.Close()
+	value, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *remoteStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *remoteStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *remoteStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	}
+	res, err := s.do(http.MethodHead, server.DataURL(name, key), nil)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, s.logError("has", err)
+	}
+	_ = res.Body.Close()
+	s.log.Debugf("has: found key %s", key)
+	return true, nil
+}
+
+// Delete removes a key from the store.
+func (s *remoteStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	}
+	res, err := s.do(http.MethodDelete, server.DataURL(name, key), nil)
+	if err != nil {
+		return s.logError("delete", err)
+	}
+	return s.logError("delete", res.Body.Close())
+}
+
+// List returns a list of all keys in the namespace.
+func (s *remoteStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	var list server.KeyList
+	if err := s.getJSON(server.DataURL(name, nil), &list); err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", len(list.Keys), list.Keys)
+	return list.Keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *remoteStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	allKeys := map[string][][]byte{}
+	if err := s.getJSON(server.DataPath, &allKeys); err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found keys in %d namespaces", len(allKeys))
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+func (s *remoteStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	var list server.NamespaceList
+	if err := s.getJSON(server.NamespacesPath, &list); err != nil {
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d namespaces: %s", len(list.Namespaces), list.Namespaces)
+	if list.Namespaces == nil {
+		return []string{}, nil
+	}
+	return list.Namespaces, nil
+}
+
+// DropNamespace removes a namespace and every key in it.
+func (s *remoteStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	res, err := s.do(http.MethodDelete, server.DataURL(name, nil), nil)
+	if err != nil {
+		return s.logError("drop", err)
+	}
+	return s.logError("drop", res.Body.Close())
+}
+
+// RenameNamespace moves every key in namespace from to namespace to.
+func (s *remoteStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	return s.logError("rename", s.namespaceOp(server.OpRename, from, to))
+}
+
+// CopyNamespace copies every key in namespace from to namespace to.
+func (s *remoteStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return s.logError("copy", s.namespaceOp(server.OpCopy, from, to))
+}
+
+// namespaceOp sends a rename or copy of namespace from to namespace to.
+func (s *remoteStore) namespaceOp(op server.OpType, from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	}
+	body, err := jsoniter.Marshal(server.NamespaceOp{Type: op, From: from, To: to})
+	if err != nil {
+		return err
+	}
+	res, err := s.do(http.MethodPost, server.NamespacesPath, body)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Stats returns the statistics of the backing store of the server.
+func (s *remoteStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	var stats storage.Stats
+	if err := s.getJSON(server.StatsPath, &stats); err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace.
+func (s *remoteStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	var count server.KeyCount
+	if err := s.getJSON(server.StatsURL(name), &count); err != nil {
+		return 0, s.logError("count", err)
+	}
+	return count.Count, nil
+}
+
+// Export downloads a snapshot of the remote store to the directory at path.
+// The snapshot is the backing store's own export, so it can be opened
+// locally with the same kind of store the server uses. The snapshot only
+// contains ciphertext. Export will not write to a path that has data in it.
+func (s *remoteStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if s.url == path {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	}
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		err = fmt.Errorf("path is not empty: %s", path)
+		return s.logError("export", err)
+	} else if err != nil && !os.IsNotExist(err) {
+		return s.logError("export", err)
+	}
+	res, err := s.do(http.MethodGet, server.ExportPath, nil)
+	if err != nil {
+		return s.logError("export", err)
+	}
+	defer res.Body.Close()
+	// the export archive is downloaded, then checked and extracted like any
+	// other export archive
+	f, err := os.CreateTemp("", ".chestnut-export-*")
+	if err != nil {
+		return s.logError("export", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, res.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	if err = storage.RestoreArchive(f.Name(), path); err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// ExportTo streams an export archive of the backing store of the server to
+// w. The archive is restored with the Restore of the backing store's package.
+func (s *remoteStore) ExportTo(w io.Writer) error {
+	s.log.Debug("export: to writer")
+	res, err := s.do(http.MethodGet, server.ArchivePath, nil)
+	if err != nil {
+		return s.logError("export", err)
+	}
+	defer res.Body.Close()
+	if _, err = io.Copy(w, res.Body); err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debug("export: to writer complete")
+	return nil
+}
+
+// Restore restores an export archive for the kind of store the server uses,
+// a remote export is the export of that store. SEE: storage.RestoreArchive.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	return storage.RestoreArchive(archivePath, destPath, opt...)
+}
+
+// Close releases any idle connections to the remote server.
+func (s *remoteStore) Close() error {
+	s.log.Debugf("closing store at url: %s", s.url)
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	s.client = nil
+	s.log.Info("store closed")
+	return nil
+}
+
+// do sends the request, retrying idempotent requests on network errors and
+// retryable status codes. If the server responds with an error the body is
+// closed and the error is returned, otherwise the caller must close the body.
+func (s *remoteStore) do(method, path string, body []byte) (*http.Response, error) {
+	if s.client == nil {
+		return nil, storage.ErrClosed
+	}
+	retries := s.ropts.retries
+	if !idempotent(method) {
+		// a lost response may hide a request the server applied, which
+		// would fail when it is sent again, e.g. a namespace rename
+		retries = 0
+	}
+	backoff := s.ropts.backoff
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			s.log.Debugf("%s %s: retry %d after %s: %s", method, path, attempt, backoff, lastErr)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		res, err := s.send(method, path, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.StatusCode < http.StatusBadRequest {
+			return res, nil
+		}
+		err = responseError(res)
+		_ = res.Body.Close()
+		if !retryable(res.StatusCode) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *remoteStore) send(method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, s.url+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if s.ropts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.ropts.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return s.client.Do(req)
+}
+
+func (s *remoteStore) getJSON(path string, v interface{}) error {
+	res, err := s.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return jsoniter.Unmarshal(b, v)
+}
+
+// idempotent reports whether sending a request with method more
+// than once has the same effect on the server as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// responseError returns the error for a failed response, wrapping
+// the storage error the server reported (if there is one).
+func responseError(res *http.Response) error {
+	var e server.Error
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err := jsoniter.Unmarshal(b, &e); err != nil || e.Error == "" {
+		if res.StatusCode == http.StatusNotFound {
+			// HEAD responses do not have a body
+			return fmt.Errorf("%w: remote: %s", storage.ErrNotFound, res.Status)
+		}
+		return fmt.Errorf("remote: %s", res.Status)
+	}
+	if kind := server.CodeError(e.Code); kind != nil {
+		return fmt.Errorf("%w: remote: %s", kind, e.Error)
+	}
+	return fmt.Errorf("remote: %s: %s", res.Status, e.Error)
+}
+
+func (s *remoteStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
@@ -0,0 +1,123 @@
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/bolt"
+	"git.tcp.direct/kayos/chestnut/storage/remote/server"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+const testToken = "test-token"
+
+var (
+	serversMu sync.Mutex
+	servers   = map[string]string{}
+)
+
+// newTestStore serves a bolt store at path with the reference server
+// and returns a remote store connected to it. Stores for the same path
+// share a server since bolt only allows the file to be opened once.
+func newTestStore(path string, opt ...storage.StoreOption) storage.Storage {
+	if path == "" {
+		return NewStore(path, opt...)
+	}
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	url, ok := servers[path]
+	if !ok {
+		backend := bolt.NewStore(path)
+		if err := backend.Open(); err != nil {
+			panic(err)
+		}
+		srv := httptest.NewServer(server.NewHandler(backend, server.WithToken(testToken)))
+		url = srv.URL
+		servers[path] = url
+	}
+	opt = append(opt, WithToken(testToken))
+	return NewStore(url, opt...)
+}
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, newTestStore, storagetest.WithRestore(Restore))
+}
+
+func TestStore_Unauthorized(t *testing.T) {
+	backend := bolt.NewStore(t.TempDir())
+	assert.NoError(t, backend.Open())
+	defer backend.Close()
+	srv := httptest.NewServer(server.NewHandler(backend, server.WithToken(testToken)))
+	defer srv.Close()
+	store := NewStore(srv.URL, WithToken("bad-token"), WithRetries(0, 0))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	err := store.Put("a", []byte("b"), []byte("c"))
+	assert.Error(t, err)
+	_, err = store.ListAll()
+	assert.Error(t, err)
+}
+
+func TestStore_Retries(t *testing.T) {
+	backend := bolt.NewStore(t.TempDir())
+	assert.NoError(t, backend.Open())
+	defer backend.Close()
+	handler := server.NewHandler(backend)
+	var failures int32 = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != server.HealthPath && atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	store := NewStore(srv.URL, WithRetries(2, time.Millisecond))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("a", []byte("b"), []byte("c")))
+	atomic.StoreInt32(&failures, 3)
+	assert.Error(t, store.Put("a", []byte("b"), []byte("c")))
+	// requests which are not idempotent are not retried
+	atomic.StoreInt32(&failures, 1)
+	assert.Error(t, store.RenameNamespace("a", "b"))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&failures))
+	assert.NoError(t, store.RenameNamespace("a", "b"))
+}
+
+func TestStore_Batch(t *testing.T) {
+	const name = "batch"
+	store := newTestStore(t.TempDir(), WithBatchLimit(3))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	b := store.(Batcher).NewBatch()
+	assert.Error(t, b.Put("", []byte("a"), []byte("a")))
+	assert.Error(t, b.Put(name, []byte("a"), nil))
+	assert.Error(t, b.Delete(name, nil))
+	keys := []string{"a", "b", "c/c", ".d", "e", "f", "g"}
+	for _, k := range keys {
+		assert.NoError(t, b.Put(name, []byte(k), []byte(k)))
+	}
+	assert.NoError(t, b.Delete(name, []byte("g")))
+	assert.Equal(t, len(keys)+1, b.Len())
+	assert.NoError(t, b.Commit())
+	assert.Equal(t, 0, b.Len())
+	list, err := store.List(name)
+	assert.NoError(t, err)
+	assert.Len(t, list, len(keys)-1)
+	for _, k := range keys[:len(keys)-1] {
+		v, err := store.Get(name, []byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, k, string(v))
+	}
+	has, err := store.Has(name, []byte("g"))
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
@@ -0,0 +1,539 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// ArchiveExportName is the name of a store's export in an export archive.
+// A store may export to files next to the path it is given, such as
+// ArchiveExportName.db, those are archived too.
+const ArchiveExportName = "export"
+
+// archiveManifestName is the name of the manifest of checksums in an export
+// archive. It is written after the files it lists.
+const archiveManifestName = "MANIFEST.json"
+
+const archiveManifestVersion = 1
+
+// archiveManifest lists the size and SHA-256 checksum of each file in an
+// export archive, so a restore can check nothing was lost or changed.
+type archiveManifest struct {
+	Version int                    `json:"version"`
+	Files   map[string]archiveFile `json:"files"`
+}
+
+type archiveFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveWriter writes an export to a gzipped tarball, followed by a
+// manifest of the checksums of the files in it, SEE: RestoreArchive.
+type ArchiveWriter struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest archiveManifest
+}
+
+// NewArchiveWriter returns an ArchiveWriter which writes to w. The archive
+// is not complete until the writer is closed.
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	gz := gzip.NewWriter(w)
+	return &ArchiveWriter{
+		gz:       gz,
+		tw:       tar.NewWriter(gz),
+		manifest: archiveManifest{Version: archiveManifestVersion, Files: map[string]archiveFile{}},
+	}
+}
+
+// WriteFile adds the file or directory with info to the archive as name,
+// which is a slash separated path. The contents of a file are read from r.
+func (a *ArchiveWriter) WriteFile(name string, info iofs.FileInfo, r io.Reader) error {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("unsupported file: %s", name)
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+		return a.tw.WriteHeader(hdr)
+	}
+	return a.writeEntry(hdr, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// WriteStream adds a file of size bytes to the archive as name, which is
+// a slash separated path. The contents of the file are written by write.
+func (a *ArchiveWriter) WriteStream(name string, size int64, write func(w io.Writer) error) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  time.Now(),
+	}
+	return a.writeEntry(hdr, write)
+}
+
+// writeEntry writes the header and the file written by write to the
+// archive, and adds the file to the manifest.
+func (a *ArchiveWriter) writeEntry(hdr *tar.Header, write func(w io.Writer) error) error {
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(a.tw, h)}
+	if err := write(cw); err != nil {
+		return err
+	}
+	if cw.n != hdr.Size {
+		return fmt.Errorf("%s: wrote %d of %d bytes", hdr.Name, cw.n, hdr.Size)
+	}
+	a.manifest.Files[hdr.Name] = archiveFile{Size: cw.n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	return nil
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteDir adds the files in dir to the archive. Each file is named by its
+// path relative to dir, under prefix if it is not empty.
+func (a *ArchiveWriter) WriteDir(dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return a.WriteFile(name, info, nil)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return a.WriteFile(name, info, f)
+	})
+}
+
+// Close writes the manifest and completes the archive. It does not
+// close the underlying writer.
+func (a *ArchiveWriter) Close() error {
+	b, err := jsoniter.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: archiveManifestName, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(b))}
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = a.tw.Write(b); err != nil {
+		return err
+	}
+	if err = a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// RestoreOptions provides the configuration for a restore.
+type RestoreOptions struct {
+	overwrite bool
+	decrypt   func(r io.Reader) (io.Reader, error)
+}
+
+// RestoreOption sets options for a restore.
+type RestoreOption func(*RestoreOptions)
+
+// WithOverwrite replaces the files or directories at the restore path, by
+// default a restore fails if they exist and are not empty.
+func WithOverwrite() RestoreOption {
+	return func(o *RestoreOptions) {
+		o.overwrite = true
+	}
+}
+
+// WithDecrypter reads an encrypted archive, decrypt returns a reader of the
+// plaintext of the archive read from r. The whole archive is read, so an
+// authenticated format can check the last of it.
+func WithDecrypter(decrypt func(r io.Reader) (io.Reader, error)) RestoreOption {
+	return func(o *RestoreOptions) {
+		o.decrypt = decrypt
+	}
+}
+
+// VerifyArchive reads the export archive at path, and checks every file
+// in it against its manifest without restoring anything.
+func VerifyArchive(path string, opt ...RestoreOption) error {
+	_, err := extractArchive(path, "", applyRestoreOptions(opt))
+	return err
+}
+
+// RestoreArchive restores the export in the archive at archivePath to
+// destPath, as if the store had been exported to destPath. The archive is
+// extracted next to destPath and checked against its manifest before
+// anything at destPath is changed. An entry outside of the export, or one
+// which is not a directory or regular file, is an error wrapping ErrCorrupt.
+// If destPath has data in it the error wraps ErrPathExists, unless
+// WithOverwrite is set.
+func RestoreArchive(archivePath, destPath string, opt ...RestoreOption) error {
+	return restoreArchive(archivePath, destPath, false, applyRestoreOptions(opt))
+}
+
+// RestoreArchiveFile restores the export in the archive at archivePath to
+// the file at filePath, for stores which export a single file. The export
+// in the archive must be one file, whatever its name. SEE: RestoreArchive.
+func RestoreArchiveFile(archivePath, filePath string, opt ...RestoreOption) error {
+	return restoreArchive(archivePath, filePath, true, applyRestoreOptions(opt))
+}
+
+// Restorer is implemented by stores which restore an export archive into
+// the open store, rather than to a path, such as a store on a server.
+type Restorer interface {
+	Storage
+
+	// Restore restores the export in the archive at archivePath into the
+	// store. SEE: RestoreArchiveTo.
+	Restore(archivePath string, opt ...RestoreOption) error
+}
+
+// RestoreArchiveTo restores the export in the archive at archivePath into
+// the open store dst. The archive is restored to a temporary directory,
+// which is opened with open, then every entry in it is put in dst. If dst
+// has data in it the error wraps ErrPathExists, unless WithOverwrite is
+// set, which drops the namespaces in dst once the archive is restored.
+func RestoreArchiveTo(dst Storage, archivePath string, open func(path string) Storage, opt ...RestoreOption) (err error) {
+	opts := applyRestoreOptions(opt)
+	names, err := dst.ListNamespaces()
+	if err != nil {
+		return err
+	} else if len(names) > 0 && !opts.overwrite {
+		return fmt.Errorf("%w: store has data", ErrPathExists)
+	}
+	tmp, err := os.MkdirTemp("", ".chestnut-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// the export, and any files next to it, are restored inside tmp
+	path := filepath.Join(tmp, ArchiveExportName)
+	if err = restoreArchive(archivePath, path, false, opts); err != nil {
+		return err
+	}
+	src := open(path)
+	if err = src.Open(); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := src.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	all, err := src.ListAll()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = dst.DropNamespace(name); err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+			return err
+		}
+	}
+	for name, keys := range all {
+		for _, key := range keys {
+			value, err := src.Get(name, key)
+			if err != nil {
+				return err
+			}
+			if err = dst.Put(name, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyRestoreOptions(opt []RestoreOption) RestoreOptions {
+	var opts RestoreOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+	return opts
+}
+
+func restoreArchive(archivePath, destPath string, file bool, opts RestoreOptions) error {
+	if destPath == "" {
+		return fmt.Errorf("invalid path: %s", destPath)
+	}
+	destPath = filepath.Clean(destPath)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(destPath), ".chestnut-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	roots, err := extractArchive(archivePath, tmp, opts)
+	if err != nil {
+		return err
+	}
+	targets := make(map[string]string, len(roots))
+	for _, root := range roots {
+		targets[root] = destPath + strings.TrimPrefix(root, ArchiveExportName)
+	}
+	if file {
+		if len(roots) != 1 {
+			return fmt.Errorf("%w: archive export is not a single file", ErrCorrupt)
+		}
+		if info, err := os.Lstat(filepath.Join(tmp, roots[0])); err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			return fmt.Errorf("%w: archive export is not a single file", ErrCorrupt)
+		}
+		targets[roots[0]] = destPath
+	}
+	// check every target before any is replaced
+	for _, root := range roots {
+		if err = checkRestorePath(targets[root], opts.overwrite); err != nil {
+			return err
+		}
+	}
+	for _, root := range roots {
+		target := targets[root]
+		if err = os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err = os.Rename(filepath.Join(tmp, root), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRestorePath returns an error wrapping ErrPathExists if path has
+// data in it, unless it can be overwritten. An empty file or directory,
+// such as one created by a store which was never written, has no data.
+func checkRestorePath(path string, overwrite bool) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) || overwrite {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		} else if len(entries) == 0 {
+			return nil
+		}
+	} else if info.Mode().IsRegular() && info.Size() == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrPathExists, path)
+}
+
+// extractArchive extracts the export archive at path to dir, checks the
+// files against the manifest, and returns the sorted names of the
+// entries at the root of the archive. If dir is empty nothing is written.
+func extractArchive(path, dir string, opts RestoreOptions) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if opts.decrypt != nil {
+		if r, err = opts.decrypt(f); err != nil {
+			return nil, err
+		}
+	}
+	r = sourceReader{r}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, archiveError(err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]archiveFile{}
+	roots := map[string]bool{}
+	var manifest *archiveManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, archiveError(err)
+		}
+		if hdr.Name == archiveManifestName {
+			if manifest != nil {
+				return nil, fmt.Errorf("%w: duplicate archive manifest", ErrCorrupt)
+			}
+			manifest = &archiveManifest{}
+			if err = jsoniter.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, archiveError(err)
+			}
+			continue
+		}
+		name, err := archiveEntryName(hdr)
+		if err != nil {
+			return nil, err
+		}
+		roots[strings.SplitN(name, "/", 2)[0]] = true
+		var target string
+		if dir != "" {
+			target = filepath.Join(dir, filepath.FromSlash(name))
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if target == "" {
+				continue
+			}
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate archive path: %q", ErrCorrupt, hdr.Name)
+		}
+		if files[name], err = extractFile(tr, target); err != nil {
+			return nil, archiveError(err)
+		}
+	}
+	// read to the end of the stream, so the last of it is authenticated
+	if _, err = io.Copy(io.Discard, gz); err != nil {
+		return nil, archiveError(err)
+	}
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		return nil, archiveError(err)
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: archive manifest not found", ErrCorrupt)
+	}
+	if len(manifest.Files) != len(files) {
+		return nil, fmt.Errorf("%w: archive has %d files, manifest lists %d", ErrCorrupt, len(files), len(manifest.Files))
+	}
+	for name, want := range manifest.Files {
+		if got, ok := files[name]; !ok {
+			return nil, fmt.Errorf("%w: archive file not found: %q", ErrCorrupt, name)
+		} else if got != want {
+			return nil, fmt.Errorf("%w: archive file checksum mismatch: %q", ErrCorrupt, name)
+		}
+	}
+	names := make([]string, 0, len(roots))
+	for root := range roots {
+		names = append(names, root)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// extractFile writes the file read from r to path, and returns its size
+// and checksum. If path is empty the file is only read.
+func extractFile(r io.Reader, path string) (archiveFile, error) {
+	h := sha256.New()
+	if path == "" {
+		n, err := io.Copy(h, r)
+		return archiveFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return archiveFile{}, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return archiveFile{}, err
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return archiveFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
+}
+
+// archiveEntryName returns the cleaned name of an archive entry. Only
+// directories and regular files in the export can be restored.
+func archiveEntryName(hdr *tar.Header) (string, error) {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	if !iofs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("%w: invalid archive path: %q", ErrCorrupt, hdr.Name)
+	}
+	if root := strings.SplitN(name, "/", 2)[0]; root != ArchiveExportName && !strings.HasPrefix(root, ArchiveExportName+".") {
+		return "", fmt.Errorf("%w: archive path is outside of the export: %q", ErrCorrupt, hdr.Name)
+	}
+	if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+		return "", fmt.Errorf("%w: unsupported archive entry: %q", ErrCorrupt, hdr.Name)
+	}
+	return name, nil
+}
+
+// sourceReader marks the errors reading the archive file, or from the
+// decrypter, so they are not mistaken for a corrupt archive.
+type sourceReader struct {
+	r io.Reader
+}
+
+type sourceError struct {
+	err error
+}
+
+func (e sourceError) Error() string { return e.err.Error() }
+
+func (s sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
+
+// archiveError marks errors reading the archive as corrupt, unless they
+// are errors reading the archive file, or from the decrypter, or file
+// system errors.
+func archiveError(err error) error {
+	var srcErr sourceError
+	var pathErr *iofs.PathError
+	if errors.As(err, &srcErr) {
+		return srcErr.err
+	} else if errors.Is(err, ErrCorrupt) || errors.As(err, &pathErr) {
+		return err
+	}
+	return WrapError(ErrCorrupt, err)
+}
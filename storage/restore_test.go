@@ -0,0 +1,135 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// writeTestArchive writes an archive of the files in dir to path.
+func writeTestArchive(t *testing.T, dir, path string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	aw := storage.NewArchiveWriter(f)
+	assert.NoError(t, aw.WriteDir(dir, ""))
+	assert.NoError(t, aw.Close())
+}
+
+func TestRestoreArchive(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "export", "ns"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "export", "ns", "key"), []byte("value"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "export.db"), []byte("db"), 0600))
+	path := filepath.Join(dir, "export.tar.gz")
+	writeTestArchive(t, src, path)
+	assert.NoError(t, storage.VerifyArchive(path))
+	dest := filepath.Join(dir, "restored")
+	assert.NoError(t, storage.RestoreArchive(path, dest))
+	b, err := os.ReadFile(filepath.Join(dest, "ns", "key"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(b))
+	b, err = os.ReadFile(dest + ".db")
+	assert.NoError(t, err)
+	assert.Equal(t, "db", string(b))
+	// existing data is only replaced when asked
+	assert.NoError(t, os.WriteFile(filepath.Join(dest, "stale"), nil, 0600))
+	assert.ErrorIs(t, storage.RestoreArchive(path, dest), storage.ErrPathExists)
+	assert.NoError(t, storage.RestoreArchive(path, dest, storage.WithOverwrite()))
+	_, err = os.Stat(filepath.Join(dest, "stale"))
+	assert.True(t, os.IsNotExist(err))
+	// an empty directory is not data
+	empty := filepath.Join(dir, "empty")
+	assert.NoError(t, os.Mkdir(empty, 0700))
+	assert.NoError(t, storage.RestoreArchive(path, empty))
+	// the export is not a single file
+	err = storage.RestoreArchiveFile(path, filepath.Join(dir, "file.db"))
+	assert.ErrorIs(t, err, storage.ErrCorrupt)
+	// the restore leaves nothing behind next to the restore path
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Name(), ".chestnut-restore-")
+	}
+}
+
+func TestRestoreArchiveFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, os.MkdirAll(src, 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "export.db"), []byte("db"), 0600))
+	path := filepath.Join(dir, "export.tar.gz")
+	writeTestArchive(t, src, path)
+	dest := filepath.Join(dir, "store", "chest.sqlite")
+	assert.NoError(t, storage.RestoreArchiveFile(path, dest))
+	b, err := os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "db", string(b))
+	assert.ErrorIs(t, storage.RestoreArchiveFile(path, dest), storage.ErrPathExists)
+}
+
+func TestRestoreArchive_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	type entry struct {
+		hdr  *tar.Header
+		body string
+	}
+	write := func(name string, entries ...entry) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		assert.NoError(t, err)
+		defer f.Close()
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			e.hdr.Size = int64(len(e.body))
+			assert.NoError(t, tw.WriteHeader(e.hdr))
+			_, err = tw.Write([]byte(e.body))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, gz.Close())
+		return path
+	}
+	file := func(name, body string) entry {
+		return entry{&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600}, body}
+	}
+	// sha256 of "a"
+	const sum = "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+	manifest := func(files string) entry {
+		return file("MANIFEST.json", `{"version":1,"files":{`+files+`}}`)
+	}
+	tests := []string{
+		write("traversal", file("export/../../escaped", "a")),
+		write("absolute", file("/export", "a")),
+		write("outside", file("other/file", "a")),
+		write("symlink", entry{&tar.Header{Name: "export", Typeflag: tar.TypeSymlink, Linkname: "/"}, ""}),
+		write("no-manifest", file("export/a", "a")),
+		write("checksum", file("export/a", "b"), manifest(`"export/a":{"size":1,"sha256":"`+sum+`"}`)),
+		write("missing", manifest(`"export/a":{"size":1,"sha256":"`+sum+`"}`)),
+		write("unlisted", file("export/a", "a"), file("export/b", "a"),
+			manifest(`"export/a":{"size":1,"sha256":"`+sum+`"}`)),
+		write("duplicate", file("export/a", "a"), file("export/a", "a"),
+			manifest(`"export/a":{"size":1,"sha256":"`+sum+`"}`)),
+		write("late", file("export/a", "a"), file("export/../b", "a")),
+	}
+	for _, path := range tests {
+		dest := filepath.Join(dir, "restored")
+		assert.ErrorIs(t, storage.VerifyArchive(path), storage.ErrCorrupt, path)
+		err := storage.RestoreArchive(path, dest)
+		assert.ErrorIs(t, err, storage.ErrCorrupt, path)
+		_, err = os.Stat(dest)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped"))
+	assert.True(t, os.IsNotExist(err))
+	valid := write("valid", file("export/a", "a"), manifest(`"export/a":{"size":1,"sha256":"`+sum+`"}`))
+	assert.NoError(t, storage.RestoreArchive(valid, filepath.Join(dir, "restored")))
+}
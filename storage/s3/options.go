@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// options are the s3 store specific options.
+type options struct {
+	endpoint string
+	secure   bool
+	creds    *credentials.Credentials
+	region   string
+	pageSize int
+	tuning   func(*minio.Options)
+}
+
+var defaultOptions = options{
+	endpoint: "s3.amazonaws.com",
+	secure:   true,
+	pageSize: 1000,
+}
+
+// s3Option is implemented by StoreOptions that configure the s3 store.
+type s3Option interface {
+	storage.StoreOption
+	applyS3(*options)
+}
+
+// s3FuncOption embeds storage.EmptyStoreOption so it can be passed
+// to NewStore alongside the common storage options.
+type s3FuncOption struct {
+	storage.EmptyStoreOption
+	f func(*options)
+}
+
+func (o s3FuncOption) applyS3(opts *options) {
+	o.f(opts)
+}
+
+func newS3Option(f func(*options)) storage.StoreOption {
+	return s3FuncOption{f: f}
+}
+
+// applyS3Options applies the s3 store specific options in opt.
+func applyS3Options(opts options, opt ...storage.StoreOption) options {
+	for _, o := range opt {
+		if so, ok := o.(s3Option); ok {
+			so.applyS3(&opts)
+		}
+	}
+	return opts
+}
+
+// WithEndpoint returns a StoreOption which sets the host (and port) of the
+// S3 compatible service, and whether to connect to it with TLS. The
+// default is AWS S3 with TLS.
+func WithEndpoint(endpoint string, secure bool) storage.StoreOption {
+	return newS3Option(func(o *options) {
+		o.endpoint = endpoint
+		o.secure = secure
+	})
+}
+
+// WithCredentials returns a StoreOption which sets static credentials for
+// the service. By default credentials are read from the AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY, or MINIO_ROOT_USER and MINIO_ROOT_PASSWORD
+// environment variables.
+func WithCredentials(accessKey, secretKey string) storage.StoreOption {
+	return newS3Option(func(o *options) {
+		o.creds = credentials.NewStaticV4(accessKey, secretKey, "")
+	})
+}
+
+// WithRegion returns a StoreOption which sets the region of the bucket.
+// The region is also used when the store creates the bucket.
+func WithRegion(region string) storage.StoreOption {
+	return newS3Option(func(o *options) {
+		o.region = region
+	})
+}
+
+// WithPageSize returns a StoreOption which sets how many objects are
+// requested per page when listing keys. S3 returns at most 1000.
+func WithPageSize(size int) storage.StoreOption {
+	return newS3Option(func(o *options) {
+		if size > 0 {
+			o.pageSize = size
+		}
+	})
+}
+
+// WithMinioOptions returns a StoreOption which tunes the options used to
+// create the S3 client. The function is passed the options after the store
+// has set its defaults.
+func WithMinioOptions(fn func(*minio.Options)) storage.StoreOption {
+	return newS3Option(func(o *options) {
+		o.tuning = fn
+	})
+}
@@ -0,0 +1,588 @@
+// Package s3 provides an implementation of the storage.Storage interface
+// for S3 compatible object storage. Each record is an object named
+// bucket/namespace/key, so chests can be kept in object storage while
+// values are encrypted on the client.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+)
+
+const logName = "s3"
+
+// s3Store is an implementation the Storage interface for S3.
+type s3Store struct {
+	opts   storage.StoreOptions
+	sopts  options
+	path   string
+	bucket string
+	prefix string
+	client *minio.Client
+	log    log.Logger
+}
+
+var (
+	_ storage.Storage      = (*s3Store)(nil)
+	_ storage.StatsStorage = (*s3Store)(nil)
+	_ storage.Restorer     = (*s3Store)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by S3. The path is
+// the bucket name, optionally followed by a prefix for the objects in the
+// bucket, e.g. "bucket" or "bucket/chests/app". The bucket is created on
+// Open if it does not exist.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	sopts := applyS3Options(defaultOptions, opt...)
+	bucket, prefix, _ := strings.Cut(strings.Trim(path, "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		path:   path,
+		bucket: bucket,
+		prefix: prefix,
+		opts:   opts,
+		sopts:  sopts,
+		log:    logger,
+	}
+}
+
+// Options returns the configuration options for the store.
+func (s *s3Store) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open connects to the service and creates the bucket if needed.
+func (s *s3Store) Open() error {
+	s.log.Debugf("opening store at path: %s", s.path)
+	creds := s.sopts.creds
+	if creds == nil {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		})
+	}
+	opts := &minio.Options{
+		Creds:  creds,
+		Secure: s.sopts.secure,
+		Region: s.sopts.region,
+	}
+	if s.sopts.tuning != nil {
+		s.sopts.tuning(opts)
+	}
+	client, err := minio.New(s.sopts.endpoint, opts)
+	if err != nil {
+		return s.logError("open", err)
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return s.logError("open", wrapError(err))
+	}
+	if !exists {
+		s.log.Infof("creating bucket: %s", s.bucket)
+		err = client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{Region: s.sopts.region})
+		if err != nil {
+			return s.logError("open", wrapError(err))
+		}
+	}
+	s.client = client
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store.
+func (s *s3Store) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("put", err)
+	} else if len(value) <= 0 {
+		err = errors.New("value cannot be empty")
+		return s.logError("put", err)
+	} else if s.client == nil {
+		return s.logError("put", storage.ErrClosed)
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(name, key),
+		bytes.NewReader(value), int64(len(value)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return s.logError("put", wrapError(err))
+}
+
+// Get a value from the store.
+func (s *s3Store) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, s.logError("get", err)
+	} else if s.client == nil {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	value, err := s.getObject(s.objectName(name, key))
+	if isNotFound(err) {
+		err = fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+		return nil, s.logError("get", err)
+	} else if err != nil {
+		return nil, s.logError("get", wrapError(err))
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+func (s *s3Store) getObject(objectName string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	// errors for the object are returned by the first read
+	return io.ReadAll(obj)
+}
+
+// Save the value in v and store the result at key.
+func (s *s3Store) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *s3Store) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *s3Store) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	} else if s.client == nil {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	_, err := s.client.StatObject(context.Background(), s.bucket, s.objectName(name, key),
+		minio.StatObjectOptions{})
+	if isNotFound(err) {
+		s.log.Debugf("has: found key %s: %t", key, false)
+		return false, nil
+	} else if err != nil {
+		return false, s.logError("has", wrapError(err))
+	}
+	s.log.Debugf("has: found key %s: %t", key, true)
+	return true, nil
+}
+
+// Delete removes a key from the store.
+func (s *s3Store) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return s.logError("delete", err)
+	} else if s.client == nil {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	err := s.client.RemoveObject(context.Background(), s.bucket, s.objectName(name, key),
+		minio.RemoveObjectOptions{})
+	return s.logError("delete", wrapError(err))
+}
+
+// List returns a list of all keys in the namespace. The keys are
+// listed a page at a time, see WithPageSize.
+func (s *s3Store) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	var keys [][]byte
+	err := s.iterate(s.namespacePrefix(name), func(_, key []byte, _ minio.ObjectInfo) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, s.logError("list", err)
+	} else if len(keys) <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	sortKeys(keys)
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store. The keys are
+// listed a page at a time, see WithPageSize.
+func (s *s3Store) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	var total int
+	allKeys := map[string][][]byte{}
+	err := s.iterate(s.prefix, func(name, key []byte, _ minio.ObjectInfo) error {
+		allKeys[string(name)] = append(allKeys[string(name)], key)
+		total++
+		return nil
+	})
+	if err != nil {
+		return nil, s.logError("list", err)
+	}
+	for _, keys := range allKeys {
+		sortKeys(keys)
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store,
+// from the common prefixes of the objects.
+func (s *s3Store) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	if s.client == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:  s.prefix,
+		MaxKeys: s.sopts.pageSize,
+	})
+	names := []string{}
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, s.logError("list", wrapError(obj.Err))
+		}
+		escName := strings.TrimPrefix(obj.Key, s.prefix)
+		if !strings.HasSuffix(escName, "/") {
+			continue
+		}
+		name, err := unescapeName(strings.TrimSuffix(escName, "/"))
+		if err != nil {
+			s.log.Warnf("list: skipping prefix: %s", err)
+			continue
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace removes every object in the namespace.
+func (s *s3Store) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	} else if s.client == nil {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	if err := s.hasNamespace(name); err != nil {
+		return s.logError("drop", err)
+	}
+	return s.logError("drop", s.dropNamespace(name))
+}
+
+// RenameNamespace copies every object in namespace from to namespace to,
+// then removes them. S3 cannot rename objects, so the rename is not atomic.
+func (s *s3Store) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	if err := s.copyNamespace(from, to); err != nil {
+		return s.logError("rename", err)
+	}
+	return s.logError("rename", s.dropNamespace(from))
+}
+
+// CopyNamespace copies every object in namespace from to namespace to on
+// the server, without downloading them. The copy is not atomic.
+func (s *s3Store) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return s.logError("copy", s.copyNamespace(from, to))
+}
+
+func (s *s3Store) copyNamespace(from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	} else if s.client == nil {
+		return storage.ErrClosed
+	}
+	if err := s.hasNamespace(from); err != nil {
+		return err
+	}
+	if err := s.hasNamespace(to); err == nil {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	} else if !errors.Is(err, storage.ErrNamespaceNotFound) {
+		return err
+	}
+	return s.iterate(s.namespacePrefix(from), func(_, key []byte, obj minio.ObjectInfo) error {
+		_, err := s.client.CopyObject(context.Background(),
+			minio.CopyDestOptions{Bucket: s.bucket, Object: s.objectName(to, key)},
+			minio.CopySrcOptions{Bucket: s.bucket, Object: obj.Key})
+		return wrapError(err)
+	})
+}
+
+// dropNamespace removes every object in the namespace.
+func (s *s3Store) dropNamespace(name string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.namespacePrefix(name),
+		Recursive: true,
+		MaxKeys:   s.sopts.pageSize,
+	})
+	for err := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		return wrapError(err.Err)
+	}
+	return nil
+}
+
+// hasNamespace returns nil if the namespace has at least one object,
+// otherwise the error wraps ErrNamespaceNotFound.
+func (s *s3Store) hasNamespace(name string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.namespacePrefix(name),
+		Recursive: true,
+		MaxKeys:   1,
+	})
+	obj, ok := <-objects
+	if !ok {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+	}
+	return wrapError(obj.Err)
+}
+
+// Stats returns the statistics of the store from the sizes in the object
+// listing, without reading the objects. The store has no local files, so
+// the disk size is zero.
+func (s *s3Store) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	if s.client == nil {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	err := s.iterate(s.prefix, func(name, _ []byte, obj minio.ObjectInfo) error {
+		stats.Add(string(name), storage.NamespaceStats{Keys: 1, ValueBytes: obj.Size})
+		return nil
+	})
+	if err != nil {
+		return storage.Stats{}, s.logError("stats", err)
+	}
+	return stats, nil
+}
+
+// Count returns the number of objects in the namespace. S3 cannot count
+// objects, so the objects are listed, but the keys are not kept.
+func (s *s3Store) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	if s.client == nil {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	var count int64
+	err := s.iterate(s.namespacePrefix(name), func(_, _ []byte, _ minio.ObjectInfo) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, s.logError("count", err)
+	} else if count <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
+// iterate calls fn with the namespace, key, and object info of every
+// record with an object name that starts with prefix.
+func (s *s3Store) iterate(prefix string, fn func(name, key []byte, obj minio.ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+		MaxKeys:   s.sopts.pageSize,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return wrapError(obj.Err)
+		}
+		name, key, err := s.splitObjectName(obj.Key)
+		if err != nil {
+			s.log.Warnf("list: skipping object: %s", err)
+			continue
+		}
+		if err = fn(name, key, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export copies the objects in the store to the directory at path. The
+// directory is written in the layout of the fs store, so an export can be
+// opened with fs.NewStore. Export will not write to a path that has data.
+func (s *s3Store) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if filepath.Clean(s.path) == filepath.Clean(path) {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	} else if s.client == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		err = fmt.Errorf("path is not empty: %s", path)
+		return s.logError("export", err)
+	} else if err != nil && !os.IsNotExist(err) {
+		return s.logError("export", err)
+	}
+	dst := fs.NewStore(path, storage.WithLogger(s.opts.Logger()))
+	if err := dst.Open(); err != nil {
+		return s.logError("export", err)
+	}
+	err := s.iterate(s.prefix, func(name, key []byte, obj minio.ObjectInfo) error {
+		value, err := s.getObject(obj.Key)
+		if err != nil {
+			return wrapError(err)
+		}
+		return dst.Put(string(name), key, value)
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s.logError("export", err)
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// Restore restores the export archive at archivePath into the store. An
+// export is written in the layout of the fs store, which is opened to put
+// its entries in the store. SEE: storage.RestoreArchiveTo.
+func (s *s3Store) Restore(archivePath string, opt ...storage.RestoreOption) error {
+	open := func(path string) storage.Storage {
+		return fs.NewStore(path, storage.WithLogger(s.opts.Logger()))
+	}
+	return s.logError("restore", storage.RestoreArchiveTo(s, archivePath, open, opt...))
+}
+
+// Close closes the store.
+func (s *s3Store) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	if s.client == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
+	s.client = nil
+	s.log.Info("store closed")
+	return nil
+}
+
+// objectName returns the name of the object for a key.
+func (s *s3Store) objectName(name string, key []byte) string {
+	return s.namespacePrefix(name) + escapeName(key)
+}
+
+// namespacePrefix returns the prefix of the object names in a namespace.
+func (s *s3Store) namespacePrefix(name string) string {
+	return s.prefix + escapeName([]byte(name)) + "/"
+}
+
+// splitObjectName returns the namespace and key for an object name.
+func (s *s3Store) splitObjectName(objectName string) (name, key []byte, err error) {
+	rest := strings.TrimPrefix(objectName, s.prefix)
+	escName, escKey, ok := strings.Cut(rest, "/")
+	if !ok || escName == "" || escKey == "" {
+		return nil, nil, fmt.Errorf("invalid object name: %s", objectName)
+	}
+	if name, err = unescapeName(escName); err != nil {
+		return nil, nil, err
+	}
+	if key, err = unescapeName(escKey); err != nil {
+		return nil, nil, err
+	}
+	return name, key, nil
+}
+
+// escapeName escapes a namespace or key so that it is a single segment of
+// an object name. A leading '.' is escaped so that a key is never a "." or
+// ".." path segment, which some services and tools treat specially.
+func escapeName(b []byte) string {
+	s := url.PathEscape(string(b))
+	if strings.HasPrefix(s, ".") {
+		s = "%2E" + s[1:]
+	}
+	return s
+}
+
+func unescapeName(s string) ([]byte, error) {
+	name, err := url.PathUnescape(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object name: %w", err)
+	}
+	return []byte(name), nil
+}
+
+func sortKeys(keys [][]byte) {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
+
+// isNotFound returns true if err is an S3 error for a missing object.
+func isNotFound(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// wrapError maps S3 errors to the storage errors.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return storage.WrapError(storage.ErrNotFound, err)
+	case "InvalidObjectName", "KeyTooLongError":
+		return storage.WrapError(storage.ErrInvalidKey, err)
+	default:
+		return err
+	}
+}
+
+func (s *s3Store) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestServer starts an in-process S3 stand-in and returns the
+// options which connect a store to it.
+func newTestServer(t *testing.T) []storage.StoreOption {
+	faker := gofakes3.New(s3mem.New())
+	handler := faker.Server()
+	// S3 treats an empty delimiter as no delimiter, the stand-in does not
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Has("delimiter") && q.Get("delimiter") == "" {
+			q.Del("delimiter")
+			r.URL.RawQuery = q.Encode()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return []storage.StoreOption{
+		WithEndpoint(strings.TrimPrefix(srv.URL, "http://"), false),
+		WithCredentials("chestnut", "chestnut"),
+	}
+}
+
+// newTestFactory returns a factory for stores on the test server. The
+// conformance suite opens exports with the factory, so an exported
+// directory is uploaded to the store before it is returned.
+func newTestFactory(t *testing.T) storagetest.Factory {
+	srvOpts := newTestServer(t)
+	return func(path string, opt ...storage.StoreOption) storage.Storage {
+		store := NewStore(path, append(opt, srvOpts...)...)
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			assert.NoError(t, upload(path, store))
+		}
+		return store
+	}
+}
+
+// upload puts the records from the fs store at path in store.
+func upload(path string, store storage.Storage) error {
+	src := fs.NewStore(path)
+	if err := src.Open(); err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := store.Open(); err != nil {
+		return err
+	}
+	defer store.Close()
+	all, err := src.ListAll()
+	if err != nil {
+		return err
+	}
+	for name, keys := range all {
+		for _, key := range keys {
+			value, err := src.Get(name, key)
+			if err != nil {
+				return err
+			}
+			if err = store.Put(name, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, newTestFactory(t), storagetest.WithRestorer())
+}
+
+func TestStore_Pagination(t *testing.T) {
+	opts := append(newTestServer(t), WithPageSize(2))
+	store := NewStore("chestnut/paged", opts...)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		assert.NoError(t, store.Put("ns", []byte(key), []byte(key)))
+	}
+	assert.NoError(t, store.Put("other", []byte("a"), []byte("a")))
+	got, err := store.List("ns")
+	assert.NoError(t, err)
+	assert.Len(t, got, len(keys))
+	all, err := store.ListAll()
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Len(t, all["ns"], len(keys))
+	// stores with a different prefix in the same bucket do not share keys
+	store2 := NewStore("chestnut", opts...)
+	assert.NoError(t, store2.Open())
+	defer store2.Close()
+	_, err = store2.List("ns")
+	assert.ErrorIs(t, err, storage.ErrNamespaceNotFound)
+}
+
+func TestEscapeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		escaped string
+	}{
+		{"a", "a"},
+		{"c/c", "c%2Fc"},
+		{".d", "%2Ed"},
+		{"..", "%2E."},
+		{"%", "%25"},
+	}
+	for _, test := range tests {
+		escaped := escapeName([]byte(test.name))
+		assert.Equal(t, test.escaped, escaped)
+		name, err := unescapeName(escaped)
+		assert.NoError(t, err)
+		assert.Equal(t, test.name, string(name))
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Serializer encodes the values saved by a store's Save, and decodes the
+// values read by its Load. The default is JSON, SEE: WithSerializer.
+type Serializer interface {
+	// Name returns the name of the encoding.
+	Name() string
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data and stores the result in the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON serializes values as JSON with jsoniter.
+	JSON Serializer = jsonSerializer{}
+
+	// Gob serializes values with encoding/gob.
+	Gob Serializer = gobSerializer{}
+)
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Name() string {
+	return "json"
+}
+
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return jsoniter.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return jsoniter.Unmarshal(data, v)
+}
+
+type gobSerializer struct{}
+
+func (gobSerializer) Name() string {
+	return "gob"
+}
+
+func (gobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/encoding/cbor"
+	"git.tcp.direct/kayos/chestnut/encoding/msgpack"
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+)
+
+type serializerValue struct {
+	Name   string
+	Count  int
+	Tags   []string
+	Scores map[string]float64
+}
+
+func TestSerializers(t *testing.T) {
+	in := serializerValue{
+		Name:   "value",
+		Count:  3,
+		Tags:   []string{"a", "b"},
+		Scores: map[string]float64{"a": 0.5},
+	}
+	serializers := []storage.Serializer{storage.JSON, storage.Gob, msgpack.Serializer, cbor.Serializer}
+	for _, s := range serializers {
+		t.Run(s.Name(), func(t *testing.T) {
+			b, err := s.Marshal(in)
+			assert.NoError(t, err)
+			var out serializerValue
+			assert.NoError(t, s.Unmarshal(b, &out))
+			assert.Equal(t, in, out)
+			assert.Error(t, s.Unmarshal([]byte{0xff, 0x00}, &out))
+			// the store saves and loads values with the serializer
+			store := memory.NewStore(storage.WithSerializer(s))
+			assert.NoError(t, store.Open())
+			defer store.Close()
+			assert.NoError(t, store.Save("ns", []byte("key"), in))
+			stored, err := store.Get("ns", []byte("key"))
+			assert.NoError(t, err)
+			assert.Equal(t, b, stored)
+			out = serializerValue{}
+			assert.NoError(t, store.Load("ns", []byte("key"), &out))
+			assert.Equal(t, in, out)
+		})
+	}
+	assert.Equal(t, storage.JSON, storage.StoreOptions{}.Serializer())
+}
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// shardVirtualNodes is the number of points each shard has on the
+	// hash ring. More points spread the keys more evenly.
+	shardVirtualNodes = 128
+
+	shardManifestName    = "manifest.json"
+	shardManifestVersion = 1
+)
+
+// ShardedStorage is a Storage which spreads its entries across several
+// stores, SEE: Shard.
+type ShardedStorage interface {
+	Storage
+
+	// Rebalance moves every entry which is not in the store it is routed to,
+	// e.g. after shards are added. Rebalance returns the number of entries
+	// moved. Entries which have not been moved yet are not found, so the
+	// store should not be used while it is rebalanced.
+	Rebalance() (int, error)
+}
+
+// shardManifest describes the layout of an export of a sharded store.
+type shardManifest struct {
+	Version      int      `json:"version"`
+	VirtualNodes int      `json:"virtual_nodes"`
+	Shards       []string `json:"shards"`
+}
+
+// shardStore is an implementation of the Storage interface which routes
+// each entry to one of its stores by consistent hashing.
+type shardStore struct {
+	stores []Storage
+	points []uint64
+	owners []int
+}
+
+var (
+	_ ShardedStorage = (*shardStore)(nil)
+	_ StatsStorage   = (*shardStore)(nil)
+)
+
+// Shard returns a store which routes each namespace and key to one of the
+// stores by consistent hashing. A shard is identified by its position, so
+// shards must always be passed in the same order. Shards can be added to
+// the end of the list, which moves about 1/n of the entries to the new
+// shard; call Rebalance to move them. Listing merges the keys of every
+// shard, and Export exports every shard with a manifest.
+func Shard(backends ...Storage) ShardedStorage {
+	s := &shardStore{stores: backends}
+	for i := range backends {
+		for v := 0; v < shardVirtualNodes; v++ {
+			s.points = append(s.points, mix64(hashString(strconv.Itoa(i)+":"+strconv.Itoa(v))))
+			s.owners = append(s.owners, i)
+		}
+	}
+	sort.Sort(ring{s})
+	return s
+}
+
+// ring sorts the points of the hash ring with their owners.
+type ring struct {
+	s *shardStore
+}
+
+func (r ring) Len() int {
+	return len(r.s.points)
+}
+
+func (r ring) Less(i, j int) bool {
+	return r.s.points[i] < r.s.points[j]
+}
+
+func (r ring) Swap(i, j int) {
+	r.s.points[i], r.s.points[j] = r.s.points[j], r.s.points[i]
+	r.s.owners[i], r.s.owners[j] = r.s.owners[j], r.s.owners[i]
+}
+
+// shardFor returns the index of the store for a namespace and key.
+func (s *shardStore) shardFor(name string, key []byte) int {
+	h := fnv.New64a()
+	var n [binary.MaxVarintLen64]byte
+	_, _ = h.Write(n[:binary.PutUvarint(n[:], uint64(len(name)))])
+	_, _ = h.Write([]byte(name))
+	_, _ = h.Write(key)
+	point := mix64(h.Sum64())
+	i := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i] >= point
+	})
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.owners[i]
+}
+
+// store returns the store for a namespace and key.
+func (s *shardStore) store(name string, key []byte) (Storage, error) {
+	if len(s.stores) <= 0 {
+		return nil, errors.New("no shards")
+	}
+	return s.stores[s.shardFor(name, key)], nil
+}
+
+// Open opens every shard. If a shard cannot be opened,
+// the shards that were opened are closed.
+func (s *shardStore) Open() error {
+	for i, st := range s.stores {
+		if err := st.Open(); err != nil {
+			for _, opened := range s.stores[:i] {
+				_ = opened.Close()
+			}
+			return shardError(i, err)
+		}
+	}
+	return nil
+}
+
+// Put an entry in its shard.
+func (s *shardStore) Put(name string, key []byte, value []byte) error {
+	st, err := s.store(name, key)
+	if err != nil {
+		return err
+	}
+	return st.Put(name, key, value)
+}
+
+// Get a value from its shard.
+func (s *shardStore) Get(name string, key []byte) ([]byte, error) {
+	st, err := s.store(name, key)
+	if err != nil {
+		return nil, err
+	}
+	return st.Get(name, key)
+}
+
+// Has checks for a key in its shard.
+func (s *shardStore) Has(name string, key []byte) (bool, error) {
+	st, err := s.store(name, key)
+	if err != nil {
+		return false, err
+	}
+	return st.Has(name, key)
+}
+
+// Save the value in v and store the result at key in its shard.
+func (s *shardStore) Save(name string, key []byte, v interface{}) error {
+	st, err := s.store(name, key)
+	if err != nil {
+		return err
+	}
+	return st.Save(name, key, v)
+}
+
+// Load the value at key from its shard and stores the result in v.
+func (s *shardStore) Load(name string, key []byte, v interface{}) error {
+	st, err := s.store(name, key)
+	if err != nil {
+		return err
+	}
+	return st.Load(name, key, v)
+}
+
+// Delete removes a key from its shard.
+func (s *shardStore) Delete(name string, key []byte) error {
+	st, err := s.store(name, key)
+	if err != nil {
+		return err
+	}
+	return st.Delete(name, key)
+}
+
+// List returns the keys in the namespace from every shard.
+func (s *shardStore) List(name string) ([][]byte, error) {
+	var keys [][]byte
+	for i, st := range s.stores {
+		shardKeys, err := st.List(name)
+		if errors.Is(err, ErrNamespaceNotFound) {
+			continue
+		} else if err != nil {
+			return nil, shardError(i, err)
+		}
+		keys = append(keys, shardKeys...)
+	}
+	if len(keys) <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of the keys in every shard.
+func (s *shardStore) ListAll() (map[string][][]byte, error) {
+	allKeys := map[string][][]byte{}
+	for i, st := range s.stores {
+		shardKeys, err := st.ListAll()
+		if err != nil {
+			return nil, shardError(i, err)
+		}
+		for name, keys := range shardKeys {
+			allKeys[name] = append(allKeys[name], keys...)
+		}
+	}
+	for _, keys := range allKeys {
+		sortKeys(keys)
+	}
+	return allKeys, nil
+}
+
+// ListNamespaces returns the namespaces in every shard.
+func (s *shardStore) ListNamespaces() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	for i, st := range s.stores {
+		shardNames, err := st.ListNamespaces()
+		if err != nil {
+			return nil, shardError(i, err)
+		}
+		for _, name := range shardNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DropNamespace drops the namespace in every shard which has it.
+func (s *shardStore) DropNamespace(name string) error {
+	if err := ValidNamespace(name); err != nil {
+		return err
+	}
+	var dropped bool
+	for i, st := range s.stores {
+		err := st.DropNamespace(name)
+		if errors.Is(err, ErrNamespaceNotFound) {
+			continue
+		} else if err != nil {
+			return shardError(i, err)
+		}
+		dropped = true
+	}
+	if !dropped {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	return nil
+}
+
+// RenameNamespace copies the namespace, then drops it. Entries are routed
+// by namespace as well as key, so they are moved to the shard they belong
+// to in the new namespace. If the rename fails part way through, the keys
+// copied so far are left in both namespaces.
+func (s *shardStore) RenameNamespace(from, to string) error {
+	if err := s.CopyNamespace(from, to); err != nil {
+		return err
+	}
+	return s.DropNamespace(from)
+}
+
+// CopyNamespace copies every entry in namespace from to the shard
+// it belongs to in namespace to.
+func (s *shardStore) CopyNamespace(from, to string) error {
+	if err := ValidNamespace(from); err != nil {
+		return err
+	} else if err = ValidNamespace(to); err != nil {
+		return err
+	}
+	if _, err := s.List(to); err == nil {
+		return fmt.Errorf("%w: %s", ErrNamespaceExists, to)
+	} else if !errors.Is(err, ErrNamespaceNotFound) {
+		return err
+	}
+	var copied bool
+	for i, st := range s.stores {
+		keys, err := st.List(from)
+		if errors.Is(err, ErrNamespaceNotFound) {
+			continue
+		} else if err != nil {
+			return shardError(i, err)
+		}
+		for _, key := range keys {
+			value, err := st.Get(from, key)
+			if err != nil {
+				return shardError(i, err)
+			}
+			dst := s.shardFor(to, key)
+			if err = s.stores[dst].Put(to, key, value); err != nil {
+				return shardError(dst, err)
+			}
+			copied = true
+		}
+	}
+	if !copied {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotFound, from)
+	}
+	return nil
+}
+
+// Stats returns the sum of the statistics of every shard. The dead space
+// is weighted by the disk size of each shard, and the backend counters of
+// each shard are prefixed with the shard, as in "shard0_".
+func (s *shardStore) Stats() (Stats, error) {
+	stats := Stats{Namespaces: map[string]NamespaceStats{}, Backend: map[string]int64{}}
+	var deadBytes float64
+	for i, st := range s.stores {
+		shardStats, err := CollectStats(st)
+		if err != nil {
+			return Stats{}, shardError(i, err)
+		}
+		for name, ns := range shardStats.Namespaces {
+			stats.Add(name, ns)
+		}
+		stats.DiskBytes += shardStats.DiskBytes
+		deadBytes += shardStats.DeadSpace * float64(shardStats.DiskBytes)
+		for name, n := range shardStats.Backend {
+			stats.Backend[fmt.Sprintf("shard%d_%s", i, name)] = n
+		}
+	}
+	if stats.DiskBytes > 0 {
+		stats.DeadSpace = deadBytes / float64(stats.DiskBytes)
+	}
+	return stats, nil
+}
+
+// Count returns the sum of the number of keys in the namespace in every shard.
+func (s *shardStore) Count(name string) (int64, error) {
+	var count int64
+	for i, st := range s.stores {
+		n, err := CountKeys(st, name)
+		if errors.Is(err, ErrNamespaceNotFound) {
+			continue
+		} else if err != nil {
+			return 0, shardError(i, err)
+		}
+		count += n
+	}
+	if count <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	return count, nil
+}
+
+// Close closes every shard, and returns the first error.
+func (s *shardStore) Close() error {
+	var first error
+	for i, st := range s.stores {
+		if err := st.Close(); err != nil && first == nil {
+			first = shardError(i, err)
+		}
+	}
+	return first
+}
+
+// Export exports each shard to the directory shard-N in path, and writes
+// a manifest of the shards to manifest.json in path. The export can be
+// opened by sharding stores opened at the shard directories, in order.
+func (s *shardStore) Export(path string) error {
+	if path == "" {
+		return fmt.Errorf("invalid path: %s", path)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	manifest := shardManifest{
+		Version:      shardManifestVersion,
+		VirtualNodes: shardVirtualNodes,
+	}
+	for i, st := range s.stores {
+		dir := "shard-" + strconv.Itoa(i)
+		if err := st.Export(filepath.Join(path, dir)); err != nil {
+			return shardError(i, err)
+		}
+		manifest.Shards = append(manifest.Shards, dir)
+	}
+	b, err := jsoniter.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(path, shardManifestName), b, 0600)
+}
+
+// Rebalance moves every entry which is not in the store it is routed to.
+func (s *shardStore) Rebalance() (int, error) {
+	var moved int
+	for i, st := range s.stores {
+		allKeys, err := st.ListAll()
+		if err != nil {
+			return moved, shardError(i, err)
+		}
+		for name, keys := range allKeys {
+			for _, key := range keys {
+				to := s.shardFor(name, key)
+				if to == i {
+					continue
+				}
+				value, err := st.Get(name, key)
+				if err != nil {
+					return moved, shardError(i, err)
+				}
+				if err = s.stores[to].Put(name, key, value); err != nil {
+					return moved, shardError(to, err)
+				}
+				if err = st.Delete(name, key); err != nil {
+					return moved, shardError(i, err)
+				}
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+// shardError adds the shard which returned err to the message.
+func shardError(i int, err error) error {
+	return fmt.Errorf("shard %d: %w", i, err)
+}
+
+func sortKeys(keys [][]byte) {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix64 is the splitmix64 finalizer, which spreads the
+// bits of FNV hashes of similar inputs across the ring.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestShards shards fs stores in the directories of a sharded export.
+func newTestShards(path string, opt ...storage.StoreOption) storage.Storage {
+	if path == "" {
+		panic("store path required")
+	}
+	var shards []storage.Storage
+	for i := 0; i < 3; i++ {
+		shards = append(shards, fs.NewStore(filepath.Join(path, "shard-"+strconv.Itoa(i)), opt...))
+	}
+	return storage.Shard(shards...)
+}
+
+func TestShard(t *testing.T) {
+	storagetest.RunConformance(t, newTestShards)
+}
+
+func TestShard_Distribution(t *testing.T) {
+	shards := []storage.Storage{memory.NewStore(), memory.NewStore(), memory.NewStore()}
+	store := storage.Shard(shards...)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	const n = 3000
+	for i := 0; i < n; i++ {
+		assert.NoError(t, store.Put("a", []byte(strconv.Itoa(i)), []byte("v")))
+	}
+	for i, shard := range shards {
+		keys, err := shard.List("a")
+		assert.NoError(t, err)
+		assert.InDelta(t, n/len(shards), len(keys), n/10, "shard %d", i)
+	}
+	keys, err := store.List("a")
+	assert.NoError(t, err)
+	assert.Len(t, keys, n)
+}
+
+func TestShard_Rebalance(t *testing.T) {
+	shards := []storage.Storage{memory.NewStore(), memory.NewStore()}
+	store := storage.Shard(shards...)
+	assert.NoError(t, store.Open())
+	const n = 500
+	for i := 0; i < n; i++ {
+		key := []byte(strconv.Itoa(i))
+		assert.NoError(t, store.Put("a", key, key))
+	}
+	// add a shard
+	added := memory.NewStore()
+	assert.NoError(t, added.Open())
+	store = storage.Shard(append(shards, added)...)
+	moved, err := store.Rebalance()
+	assert.NoError(t, err)
+	assert.Greater(t, moved, 0)
+	assert.Less(t, moved, n/2)
+	keys, err := added.List("a")
+	assert.NoError(t, err)
+	assert.Len(t, keys, moved)
+	for i := 0; i < n; i++ {
+		key := []byte(strconv.Itoa(i))
+		v, err := store.Get("a", key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, v)
+	}
+	all, err := store.ListAll()
+	assert.NoError(t, err)
+	assert.Len(t, all["a"], n)
+	// the entries are balanced
+	moved, err = store.Rebalance()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+	assert.NoError(t, store.Close())
+}
+
+func TestShard_Export(t *testing.T) {
+	store := newTestShards(t.TempDir())
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, store.Put("a", []byte(fmt.Sprint(i)), []byte("v")))
+	}
+	path := t.TempDir()
+	assert.NoError(t, store.Export(path))
+	b, err := os.ReadFile(filepath.Join(path, "manifest.json"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"virtual_nodes": 128,
+		"shards": ["shard-0", "shard-1", "shard-2"]
+	}`, string(b))
+}
@@ -0,0 +1,603 @@
+// Package sqlite provides an implementation of the storage.Storage interface
+// for SQLite, using the pure Go driver https://modernc.org/sqlite so cgo is
+// not required. The chest is a single file which can be inspected with the
+// standard sqlite tools, values stay encrypted.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+const (
+	logName   = "sqlite"
+	storeName = "chest.db"
+	storeExt  = ".db"
+
+	driverName = "sqlite"
+)
+
+// every entry is kept in a single table ordered by namespace and key.
+const (
+	createTable = `CREATE TABLE IF NOT EXISTS chest (
+	namespace TEXT NOT NULL,
+	key       BLOB NOT NULL,
+	value     BLOB NOT NULL,
+	PRIMARY KEY (namespace, key)
+) WITHOUT ROWID`
+	putEntry = `INSERT INTO chest (namespace, key, value) VALUES (?, ?, ?)
+ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value`
+	getEntry        = `SELECT value FROM chest WHERE namespace = ? AND key = ?`
+	hasEntry        = `SELECT EXISTS (SELECT 1 FROM chest WHERE namespace = ? AND key = ?)`
+	deleteEntry     = `DELETE FROM chest WHERE namespace = ? AND key = ?`
+	listKeys        = `SELECT key FROM chest WHERE namespace = ? ORDER BY key`
+	listAllKeys     = `SELECT namespace, key FROM chest ORDER BY namespace, key`
+	vacuumInto      = `VACUUM INTO ?`
+	countKeys       = `SELECT COUNT(*) FROM chest WHERE namespace = ?`
+	hasNamespace    = `SELECT EXISTS (SELECT 1 FROM chest WHERE namespace = ?)`
+	listNamespaces  = `SELECT DISTINCT namespace FROM chest ORDER BY namespace`
+	dropNamespace   = `DELETE FROM chest WHERE namespace = ?`
+	renameNamespace = `UPDATE chest SET namespace = ? WHERE namespace = ?`
+	copyNamespace   = `INSERT INTO chest (namespace, key, value)
+SELECT ?, key, value FROM chest WHERE namespace = ?`
+	sumEntries = `SELECT namespace, COUNT(*), SUM(LENGTH(value)) FROM chest GROUP BY namespace`
+	pageStats  = `SELECT p.page_count, s.page_size, f.freelist_count, d.file
+FROM pragma_page_count() p, pragma_page_size() s, pragma_freelist_count() f,
+	pragma_database_list() d WHERE d.name = 'main'`
+)
+
+// sqliteStore is an implementation the Storage interface for SQLite.
+type sqliteStore struct {
+	opts storage.StoreOptions
+	path string
+	db   *sql.DB
+	log  log.Logger
+}
+
+var (
+	_ storage.Storage              = (*sqliteStore)(nil)
+	_ storage.TransactionalStorage = (*sqliteStore)(nil)
+	_ storage.StatsStorage         = (*sqliteStore)(nil)
+)
+
+// NewStore is used to instantiate a datastore backed by SQLite.
+func NewStore(path string, opt ...storage.StoreOption) storage.Storage {
+	opts := storage.ApplyOptions(storage.DefaultStoreOptions, opt...)
+	logger := log.Named(opts.Logger(), logName)
+	if path == "" {
+		logger.Panic("store path required")
+	}
+	return &sqliteStore{path: path, opts: opts, log: logger}
+}
+
+// Options returns the configuration options for the store.
+func (s *sqliteStore) Options() storage.StoreOptions {
+	return s.opts
+}
+
+// Open opens the store.
+func (s *sqliteStore) Open() error {
+	s.log.Debugf("opening store at path: %s", s.path)
+	path, err := ensureDBPath(s.path)
+	if err != nil {
+		return s.logError("open", err)
+	}
+	db, err := sql.Open(driverName, dsn(path))
+	if err != nil {
+		return s.logError("open", wrapError(err))
+	}
+	if _, err = db.Exec(createTable); err != nil {
+		_ = db.Close()
+		return s.logError("open", wrapError(err))
+	}
+	s.db = db
+	s.log.Infof("opened store at path: %s", s.path)
+	return nil
+}
+
+// Put an entry in the store.
+func (s *sqliteStore) Put(name string, key []byte, value []byte) error {
+	s.log.Debugf("put: %d value bytes to key: %s", len(value), key)
+	if s.db == nil {
+		return s.logError("put", storage.ErrClosed)
+	}
+	return s.logError("put", put(s.db, name, key, value))
+}
+
+// Get a value from the store.
+func (s *sqliteStore) Get(name string, key []byte) ([]byte, error) {
+	s.log.Debugf("get: value at key: %s", key)
+	if s.db == nil {
+		return nil, s.logError("get", storage.ErrClosed)
+	}
+	value, err := get(s.db, name, key)
+	if err != nil {
+		return nil, s.logError("get", err)
+	}
+	s.log.Debugf("get: key: %s.%s value (%d bytes)", name, key, len(value))
+	return value, nil
+}
+
+// Save the value in v and store the result at key.
+func (s *sqliteStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.opts.Serializer().Marshal(v)
+	if err != nil {
+		return s.logError("save", err)
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *sqliteStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return s.logError("load", err)
+	}
+	return s.logError("load", s.opts.Serializer().Unmarshal(b, v))
+}
+
+// Has checks for a key in the store.
+func (s *sqliteStore) Has(name string, key []byte) (bool, error) {
+	s.log.Debugf("has: key: %s", key)
+	if err := storage.ValidKey(name, key); err != nil {
+		return false, s.logError("has", err)
+	} else if s.db == nil {
+		return false, s.logError("has", storage.ErrClosed)
+	}
+	var has bool
+	if err := s.db.QueryRow(hasEntry, name, key).Scan(&has); err != nil {
+		return false, s.logError("has", wrapError(err))
+	}
+	s.log.Debugf("has: found key %s: %t", key, has)
+	return has, nil
+}
+
+// Delete removes a key from the store.
+func (s *sqliteStore) Delete(name string, key []byte) error {
+	s.log.Debugf("delete: key: %s", key)
+	if s.db == nil {
+		return s.logError("delete", storage.ErrClosed)
+	}
+	return s.logError("delete", del(s.db, name, key))
+}
+
+// List returns a list of all keys in the namespace, in key order. Empty
+// namespaces are not kept, so a namespace without any keys is not found.
+func (s *sqliteStore) List(name string) ([][]byte, error) {
+	s.log.Debugf("list: keys in namespace: %s", name)
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	rows, err := s.db.Query(listKeys, name)
+	if err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	defer rows.Close()
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err = rows.Scan(&key); err != nil {
+			return nil, s.logError("list", wrapError(err))
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	if len(keys) <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return nil, s.logError("list", err)
+	}
+	s.log.Debugf("list: found %d keys: %s", len(keys), keys)
+	return keys, nil
+}
+
+// ListAll returns a mapped list of all keys in the store.
+func (s *sqliteStore) ListAll() (map[string][][]byte, error) {
+	s.log.Debugf("list: all keys")
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	rows, err := s.db.Query(listAllKeys)
+	if err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	defer rows.Close()
+	var total int
+	allKeys := map[string][][]byte{}
+	for rows.Next() {
+		var (
+			name string
+			key  []byte
+		)
+		if err = rows.Scan(&name, &key); err != nil {
+			return nil, s.logError("list", wrapError(err))
+		}
+		allKeys[name] = append(allKeys[name], key)
+		total++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	s.log.Debugf("list: found %d keys: %s", total, allKeys)
+	return allKeys, nil
+}
+
+// ListNamespaces returns the sorted names of the namespaces in the store.
+func (s *sqliteStore) ListNamespaces() ([]string, error) {
+	s.log.Debugf("list: all namespaces")
+	if s.db == nil {
+		return nil, s.logError("list", storage.ErrClosed)
+	}
+	rows, err := s.db.Query(listNamespaces)
+	if err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, s.logError("list", wrapError(err))
+		}
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, s.logError("list", wrapError(err))
+	}
+	s.log.Debugf("list: found %d namespaces: %s", len(names), names)
+	return names, nil
+}
+
+// DropNamespace deletes every entry in the namespace.
+func (s *sqliteStore) DropNamespace(name string) error {
+	s.log.Debugf("drop: namespace: %s", name)
+	if err := storage.ValidNamespace(name); err != nil {
+		return s.logError("drop", err)
+	} else if s.db == nil {
+		return s.logError("drop", storage.ErrClosed)
+	}
+	res, err := s.db.Exec(dropNamespace, name)
+	if err != nil {
+		return s.logError("drop", wrapError(err))
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return s.logError("drop", wrapError(err))
+	} else if n <= 0 {
+		err = fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return s.logError("drop", err)
+	}
+	return nil
+}
+
+// RenameNamespace updates the namespace of every entry in namespace from.
+func (s *sqliteStore) RenameNamespace(from, to string) error {
+	s.log.Debugf("rename: namespace: %s to: %s", from, to)
+	return s.logError("rename", s.moveNamespace(renameNamespace, from, to))
+}
+
+// CopyNamespace inserts a copy of every entry in namespace from in namespace to.
+func (s *sqliteStore) CopyNamespace(from, to string) error {
+	s.log.Debugf("copy: namespace: %s to: %s", from, to)
+	return s.logError("copy", s.moveNamespace(copyNamespace, from, to))
+}
+
+// moveNamespace runs the rename or copy query in a transaction, after
+// checking that namespace from is found and namespace to is not.
+func (s *sqliteStore) moveNamespace(query string, from, to string) error {
+	if err := storage.ValidNamespace(from); err != nil {
+		return err
+	} else if err = storage.ValidNamespace(to); err != nil {
+		return err
+	} else if s.db == nil {
+		return storage.ErrClosed
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return wrapError(err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var hasFrom, hasTo bool
+	if err = tx.QueryRow(hasNamespace, from).Scan(&hasFrom); err != nil {
+		return wrapError(err)
+	} else if !hasFrom {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, from)
+	}
+	if err = tx.QueryRow(hasNamespace, to).Scan(&hasTo); err != nil {
+		return wrapError(err)
+	} else if hasTo {
+		return fmt.Errorf("%w: %s", storage.ErrNamespaceExists, to)
+	}
+	if _, err = tx.Exec(query, to, from); err != nil {
+		return wrapError(err)
+	}
+	return wrapError(tx.Commit())
+}
+
+// Stats returns the statistics of the store. The backend counters are
+// the page counts of the database file.
+func (s *sqliteStore) Stats() (storage.Stats, error) {
+	s.log.Debugf("stats: all namespaces")
+	if s.db == nil {
+		return storage.Stats{}, s.logError("stats", storage.ErrClosed)
+	}
+	rows, err := s.db.Query(sumEntries)
+	if err != nil {
+		return storage.Stats{}, s.logError("stats", wrapError(err))
+	}
+	defer rows.Close()
+	stats := storage.Stats{Namespaces: map[string]storage.NamespaceStats{}}
+	for rows.Next() {
+		var (
+			name string
+			ns   storage.NamespaceStats
+		)
+		if err = rows.Scan(&name, &ns.Keys, &ns.ValueBytes); err != nil {
+			return storage.Stats{}, s.logError("stats", wrapError(err))
+		}
+		stats.Add(name, ns)
+	}
+	if err = rows.Err(); err != nil {
+		return storage.Stats{}, s.logError("stats", wrapError(err))
+	}
+	var (
+		pages, pageSize, freePages int64
+		path                       string
+	)
+	err = s.db.QueryRow(pageStats).Scan(&pages, &pageSize, &freePages, &path)
+	if err != nil {
+		return storage.Stats{}, s.logError("stats", wrapError(err))
+	}
+	// the write ahead log is part of the database until it is checkpointed
+	for _, file := range []string{path, path + "-wal"} {
+		size, err := storage.DirSize(file)
+		if err != nil {
+			return storage.Stats{}, s.logError("stats", err)
+		}
+		stats.DiskBytes += size
+	}
+	if pages > 0 {
+		stats.DeadSpace = float64(freePages) / float64(pages)
+	}
+	stats.Backend = map[string]int64{
+		"pages":      pages,
+		"page_size":  pageSize,
+		"free_pages": freePages,
+	}
+	return stats, nil
+}
+
+// Count returns the number of keys in the namespace.
+func (s *sqliteStore) Count(name string) (int64, error) {
+	s.log.Debugf("count: keys in namespace: %s", name)
+	if s.db == nil {
+		return 0, s.logError("count", storage.ErrClosed)
+	}
+	var count int64
+	if err := s.db.QueryRow(countKeys, name).Scan(&count); err != nil {
+		return 0, s.logError("count", wrapError(err))
+	}
+	if count <= 0 {
+		err := fmt.Errorf("%w: %s", storage.ErrNamespaceNotFound, name)
+		return 0, s.logError("count", err)
+	}
+	return count, nil
+}
+
+// Update runs fn in a read-write transaction. If fn returns an
+// error the transaction is rolled back, otherwise it is committed.
+func (s *sqliteStore) Update(fn func(tx storage.Tx) error) error {
+	s.log.Debug("update: begin transaction")
+	if s.db == nil {
+		return s.logError("update", storage.ErrClosed)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return s.logError("update", wrapError(err))
+	}
+	if err = fn(&sqliteTx{tx}); err != nil {
+		s.log.Debugf("update: rollback transaction: %s", err)
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.log.Warnf("update: rollback: %s", rbErr)
+		}
+		return s.logError("update", err)
+	}
+	s.log.Debug("update: commit transaction")
+	return s.logError("update", wrapError(tx.Commit()))
+}
+
+// Export copies the datastore to a new database file at path using
+// VACUUM INTO. If path is a directory the file is created in it.
+func (s *sqliteStore) Export(path string) error {
+	s.log.Debugf("export: to path: %s", path)
+	if path == "" {
+		err := fmt.Errorf("invalid path: %s", path)
+		return s.logError("export", err)
+	} else if s.path == path {
+		err := fmt.Errorf("path cannot be store path: %s", path)
+		return s.logError("export", err)
+	} else if s.db == nil {
+		return s.logError("export", storage.ErrClosed)
+	}
+	var err error
+	path, err = ensureDBPath(path)
+	if err != nil {
+		return s.logError("export", err)
+	}
+	// vacuum into will not overwrite a database that has data in it
+	if _, err = s.db.Exec(vacuumInto, path); err != nil {
+		return s.logError("export", wrapError(err))
+	}
+	s.log.Debugf("export: to path complete: %s", path)
+	return nil
+}
+
+// Restore restores an archive of a single database file for NewStore(destPath),
+// and removes the write-ahead log of the database it replaces.
+// SEE: storage.RestoreArchiveFile.
+func Restore(archivePath, destPath string, opt ...storage.RestoreOption) error {
+	path, err := ensureDBPath(destPath)
+	if err != nil {
+		return err
+	}
+	if err = storage.RestoreArchiveFile(archivePath, path, opt...); err != nil {
+		return err
+	}
+	// a write-ahead log left by the replaced database must not be
+	// replayed into the restored one.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err = os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the datastore and releases all db resources.
+func (s *sqliteStore) Close() error {
+	s.log.Debugf("closing store at path: %s", s.path)
+	if s.db == nil {
+		return s.logError("close", storage.ErrClosed)
+	}
+	err := s.db.Close()
+	s.db = nil
+	s.log.Info("store closed")
+	return s.logError("close", wrapError(err))
+}
+
+// sqliteTx is a storage transaction for an sql transaction.
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t *sqliteTx) Put(name string, key []byte, value []byte) error {
+	return put(t.tx, name, key, value)
+}
+
+func (t *sqliteTx) Get(name string, key []byte) ([]byte, error) {
+	return get(t.tx, name, key)
+}
+
+func (t *sqliteTx) Delete(name string, key []byte) error {
+	return del(t.tx, name, key)
+}
+
+// execQueryer is implemented by both *sql.DB and *sql.Tx.
+type execQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func put(db execQueryer, name string, key []byte, value []byte) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	} else if len(value) <= 0 {
+		return errors.New("value cannot be empty")
+	}
+	_, err := db.Exec(putEntry, name, key, value)
+	return wrapError(err)
+}
+
+func get(db execQueryer, name string, key []byte) ([]byte, error) {
+	if err := storage.ValidKey(name, key); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := db.QueryRow(getEntry, name, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s.%s", storage.ErrNotFound, name, key)
+	} else if err != nil {
+		return nil, wrapError(err)
+	}
+	return value, nil
+}
+
+func del(db execQueryer, name string, key []byte) error {
+	if err := storage.ValidKey(name, key); err != nil {
+		return err
+	}
+	_, err := db.Exec(deleteEntry, name, key)
+	return wrapError(err)
+}
+
+// dsn returns the data source name for the database at path. Transactions
+// take the write lock when they begin, and wait for it if the database is
+// busy, so that concurrent writers do not fail with SQLITE_BUSY.
+func dsn(path string) string {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(10000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	q.Set("_txlock", "immediate")
+	return "file:" + path + "?" + q.Encode()
+}
+
+// wrapError wraps sqlite errors with the matching storage error.
+func wrapError(err error) error {
+	var sqlErr *sqlite.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrConnDone):
+		return storage.WrapError(storage.ErrClosed, err)
+	case !errors.As(err, &sqlErr):
+		return err
+	}
+	// extended result codes keep the primary code in the low byte
+	switch sqlErr.Code() & 0xff {
+	case sqlite3.SQLITE_READONLY:
+		return storage.WrapError(storage.ErrReadOnly, err)
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+		return storage.WrapError(storage.ErrCorrupt, err)
+	default:
+		return err
+	}
+}
+
+func (s *sqliteStore) logError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if name != "" {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	s.log.Error(err)
+	return err
+}
+
+func ensureDBPath(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("path not found")
+	}
+	// does the path exist?
+	info, err := os.Stat(path)
+	exists := !os.IsNotExist(err)
+	// this is some kind of actual error
+	if err != nil && exists {
+		return "", err
+	}
+	if exists && info.Mode().IsDir() {
+		// if we have a directory, then append our default name
+		path = filepath.Join(path, storeName)
+	}
+	if filepath.Ext(path) == "" {
+		path += storeExt
+	}
+	// make sure the directory path exists
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,11 @@
+package sqlite
+
+import (
+	"testing"
+
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+func TestStore(t *testing.T) {
+	storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+}
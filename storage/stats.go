@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	iofs "io/fs"
+	"path/filepath"
+)
+
+// NamespaceStats are the statistics of a namespace in a store.
+type NamespaceStats struct {
+	// Keys is the number of keys in the namespace.
+	Keys int64 `json:"keys"`
+	// ValueBytes is the total size of the stored values in the namespace.
+	ValueBytes int64 `json:"value_bytes"`
+}
+
+// AverageValueSize returns the average size of the values in the namespace.
+func (s NamespaceStats) AverageValueSize() float64 {
+	if s.Keys <= 0 {
+		return 0
+	}
+	return float64(s.ValueBytes) / float64(s.Keys)
+}
+
+// Stats are the statistics of a store, SEE: StatsStorage.
+type Stats struct {
+	// Namespaces has the statistics of each namespace.
+	Namespaces map[string]NamespaceStats `json:"namespaces"`
+	// Keys is the number of keys in the store.
+	Keys int64 `json:"keys"`
+	// ValueBytes is the total size of the stored values in the store.
+	ValueBytes int64 `json:"value_bytes"`
+	// DiskBytes is the size of the files of the store, or zero
+	// if the store does not keep its data in local files.
+	DiskBytes int64 `json:"disk_bytes"`
+	// DeadSpace is the fraction of the size of the store used by deleted
+	// and overwritten entries, if the store is a Compactor.
+	DeadSpace float64 `json:"dead_space"`
+	// Backend has counters specific to the backing store.
+	Backend map[string]int64 `json:"backend,omitempty"`
+}
+
+// AverageValueSize returns the average size of the values in the store.
+func (s Stats) AverageValueSize() float64 {
+	return NamespaceStats{Keys: s.Keys, ValueBytes: s.ValueBytes}.AverageValueSize()
+}
+
+// Add adds the statistics of a namespace to the store's statistics.
+func (s *Stats) Add(name string, ns NamespaceStats) {
+	if s.Namespaces == nil {
+		s.Namespaces = map[string]NamespaceStats{}
+	}
+	total := s.Namespaces[name]
+	total.Keys += ns.Keys
+	total.ValueBytes += ns.ValueBytes
+	s.Namespaces[name] = total
+	s.Keys += ns.Keys
+	s.ValueBytes += ns.ValueBytes
+}
+
+// StatsStorage is implemented by stores that can report their statistics.
+type StatsStorage interface {
+	Storage
+
+	// Stats returns the statistics of the store. It may read every entry.
+	Stats() (Stats, error)
+
+	// Count returns the number of keys in the namespace, without listing
+	// them. If the namespace is not found the error wraps ErrNamespaceNotFound.
+	Count(namespace string) (int64, error)
+}
+
+// CollectStats returns the statistics of store. If the store is not a
+// StatsStorage, they are collected by reading every value in the store.
+func CollectStats(store Storage) (Stats, error) {
+	if s, ok := store.(StatsStorage); ok {
+		return s.Stats()
+	}
+	stats := Stats{Namespaces: map[string]NamespaceStats{}}
+	allKeys, err := store.ListAll()
+	if err != nil {
+		return Stats{}, err
+	}
+	for name, keys := range allKeys {
+		ns := NamespaceStats{Keys: int64(len(keys))}
+		for _, key := range keys {
+			value, err := store.Get(name, key)
+			if errors.Is(err, ErrNotFound) {
+				// deleted since it was listed
+				ns.Keys--
+				continue
+			} else if err != nil {
+				return Stats{}, err
+			}
+			ns.ValueBytes += int64(len(value))
+		}
+		stats.Add(name, ns)
+	}
+	if c, ok := store.(Compactor); ok {
+		if stats.DeadSpace, err = c.DeadSpace(); err != nil {
+			return Stats{}, err
+		}
+	}
+	return stats, nil
+}
+
+// CountKeys returns the number of keys in the namespace of store. If the
+// store is not a StatsStorage, the keys are listed to count them.
+func CountKeys(store Storage, namespace string) (int64, error) {
+	if s, ok := store.(StatsStorage); ok {
+		return s.Count(namespace)
+	}
+	keys, err := store.List(namespace)
+	return int64(len(keys)), err
+}
+
+// DirSize returns the total size of the files in the directory at path, or
+// the size of the file at path. A path which does not exist has no size.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, iofs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if errors.Is(err, iofs.ErrNotExist) {
+		return size, nil
+	}
+	return size, err
+}
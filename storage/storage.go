@@ -1,8 +1,8 @@
 package storage
 
 import (
-	"errors"
 	"fmt"
+	"time"
 )
 
 // Storage provides a management interface for a datastore.
@@ -13,10 +13,12 @@ type Storage interface {
 	// Put a value in the store.
 	Put(namespace string, key []byte, value []byte) error
 
-	// Get a value from the store.
+	// Get a value from the store. If the key is not found
+	// the error wraps ErrNotFound.
 	Get(namespace string, key []byte) (value []byte, err error)
 
-	// Has checks for a key in the store.
+	// Has checks for a key in the store. If the key or namespace
+	// is not found, Has returns false and no error.
 	Has(namespace string, key []byte) (bool, error)
 
 	// Save the value in v and stores the result at key.
@@ -25,15 +27,34 @@ type Storage interface {
 	// Load the value at key and stores the result in v.
 	Load(namespace string, key []byte, v interface{}) error
 
-	// List returns a list of all keys in the namespace.
+	// List returns a list of all keys in the namespace. If the namespace
+	// is not found the error wraps ErrNamespaceNotFound.
 	List(namespace string) ([][]byte, error)
 
 	// ListAll returns a mapped list of all keys in the store.
 	ListAll() (map[string][][]byte, error)
 
-	// Delete removes a key from the store.
+	// Delete removes a key from the store. Deleting a key
+	// that is not found is not an error.
 	Delete(name string, key []byte) error
 
+	// ListNamespaces returns the sorted names of the namespaces in the store.
+	ListNamespaces() ([]string, error)
+
+	// DropNamespace removes a namespace and every key in it. If the
+	// namespace is not found the error wraps ErrNamespaceNotFound.
+	DropNamespace(namespace string) error
+
+	// RenameNamespace moves every key in namespace from to namespace to.
+	// If from is not found the error wraps ErrNamespaceNotFound, and if
+	// to is found the error wraps ErrNamespaceExists.
+	RenameNamespace(from, to string) error
+
+	// CopyNamespace copies every key in namespace from to namespace to.
+	// If from is not found the error wraps ErrNamespaceNotFound, and if
+	// to is found the error wraps ErrNamespaceExists.
+	CopyNamespace(from, to string) error
+
 	// Close closes the store.
 	Close() error
 
@@ -41,14 +62,70 @@ type Storage interface {
 	Export(path string) error
 }
 
-// ErrInvalidKey the storage key is invalid.
-var ErrInvalidKey = errors.New("invalid storage key")
+// ExpiringStorage is implemented by stores that can expire entries.
+type ExpiringStorage interface {
+	Storage
 
-// ValidKey returns nil if the key is valid, otherwise ErrInvalidKey.
-func ValidKey(name string, key []byte) error {
+	// PutTTL puts a value in the store which expires after ttl.
+	PutTTL(namespace string, key []byte, value []byte, ttl time.Duration) error
+}
+
+// Tx is a transaction on a store, SEE: TransactionalStorage.
+type Tx interface {
+	// Put a value in the transaction.
+	Put(namespace string, key []byte, value []byte) error
+
+	// Get a value from the transaction. Values put in the transaction
+	// are visible to Get before it is committed.
+	Get(namespace string, key []byte) (value []byte, err error)
+
+	// Delete removes a key in the transaction.
+	Delete(namespace string, key []byte) error
+}
+
+// TransactionalStorage is implemented by stores that can
+// apply a set of changes atomically.
+type TransactionalStorage interface {
+	Storage
+
+	// Update runs fn in a read-write transaction. If fn returns an
+	// error the transaction is rolled back, otherwise it is committed.
+	Update(fn func(tx Tx) error) error
+}
+
+// Compactor is implemented by stores that can reclaim the space used by
+// deleted and overwritten entries.
+type Compactor interface {
+	Storage
+
+	// Compact reclaims as much of the space used by deleted and overwritten
+	// entries as the store can. It may rewrite the whole store, and other
+	// calls may wait until it is done.
+	Compact() error
+
+	// Merge merges the store's data files, which reclaims the space used by
+	// deleted and overwritten entries in them. It may reclaim less space
+	// than Compact, but it is cheaper.
+	Merge() error
+
+	// DeadSpace returns the fraction of the size of the store, from 0 to 1,
+	// used by deleted and overwritten entries.
+	DeadSpace() (float64, error)
+}
+
+// ValidNamespace returns nil if the namespace name is valid, otherwise ErrInvalidKey.
+func ValidNamespace(name string) error {
 	if name == "" {
 		return fmt.Errorf("%w namespace: %s", ErrInvalidKey, name)
 	}
+	return nil
+}
+
+// ValidKey returns nil if the key is valid, otherwise ErrInvalidKey.
+func ValidKey(name string, key []byte) error {
+	if err := ValidNamespace(name); err != nil {
+		return err
+	}
 	if len(key) <= 0 {
 		return fmt.Errorf("%w: %s", ErrInvalidKey, key)
 	}
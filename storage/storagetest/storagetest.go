@@ -0,0 +1,82 @@
+// Package storagetest provides a conformance test suite for implementations
+// of the storage.Storage interface. A store that passes the suite behaves
+// like the built-in stores, and can be used as the backing store for Chestnut.
+//
+// To test a store call RunConformance from a test in its package:
+//
+//	func TestStore(t *testing.T) {
+//		storagetest.RunConformance(t, NewStore, storagetest.WithRestore(Restore))
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+// Factory returns a new store for the path. It is called with a new
+// temporary path for each test, and with the path of an export, or of a
+// restored export archive, to check that the export can be opened. It must
+// panic if the path is empty.
+type Factory = func(path string, opt ...storage.StoreOption) storage.Storage
+
+// RestoreFunc restores the export archive at archivePath for the store the
+// factory returns for destPath, such as a store package's Restore.
+type RestoreFunc = func(archivePath, destPath string, opt ...storage.RestoreOption) error
+
+// Option configures the conformance test suite.
+type Option func(*storeTestSuite)
+
+// WithRestore restores the archives written by storage.ExportTo with
+// restore, and checks that the restored store matches the exported one.
+func WithRestore(restore RestoreFunc) Option {
+	return func(ts *storeTestSuite) {
+		ts.restore = restore
+	}
+}
+
+// WithRestorer restores the archives written by storage.ExportTo into the
+// store the factory returns for the restore path, for stores which
+// implement storage.Restorer. SEE: WithRestore.
+func WithRestorer() Option {
+	return func(ts *storeTestSuite) {
+		ts.restore = func(archivePath, destPath string, opt ...storage.RestoreOption) error {
+			store, ok := ts.factory(destPath).(storage.Restorer)
+			if !ok {
+				return fmt.Errorf("%w: store is not a storage.Restorer", storage.ErrNotSupported)
+			}
+			if err := store.Open(); err != nil {
+				return err
+			}
+			defer store.Close()
+			return store.Restore(archivePath, opt...)
+		}
+	}
+}
+
+// WithExportArchive is for stores whose Export writes an archive named name
+// in the export path, rather than a store the factory can open. The archive
+// is restored with the RestoreFunc before it is opened. SEE: WithRestore.
+func WithExportArchive(name string) Option {
+	return func(ts *storeTestSuite) {
+		ts.exportArchive = name
+	}
+}
+
+// RunConformance runs the conformance test suite against the stores
+// returned by factory.
+func RunConformance(t *testing.T, factory Factory, opt ...Option) {
+	ts := new(storeTestSuite)
+	ts.factory = factory
+	for _, o := range opt {
+		o(ts)
+	}
+	if ts.exportArchive != "" && ts.restore == nil {
+		t.Fatal("storagetest: WithExportArchive requires WithRestore")
+	}
+	suite.Run(t, ts)
+}
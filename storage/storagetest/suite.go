@@ -0,0 +1,611 @@
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"git.tcp.direct/kayos/chestnut/log"
+	"git.tcp.direct/kayos/chestnut/storage"
+)
+
+type testCase struct {
+	name  string
+	key   string
+	value string
+	err   assert.ErrorAssertionFunc
+	has   assert.BoolAssertionFunc
+}
+
+type testObject struct {
+	Value string
+}
+
+var (
+	testName  = "test-name"
+	testKey   = "test-key"
+	testValue = "test-value"
+	testObj   = &testObject{"hello"}
+)
+
+var putTests = []testCase{
+	{"", "", "", assert.Error, assert.False},
+	{"a", testKey, "", assert.Error, assert.False},
+	{"b", testKey, testValue, assert.NoError, assert.True},
+	{"c/c", testKey, testValue, assert.NoError, assert.True},
+	{".d", testKey, testValue, assert.NoError, assert.True},
+	{testName, "", "", assert.Error, assert.False},
+	{testName, "a", "", assert.Error, assert.False},
+	{testName, "b", testValue, assert.NoError, assert.True},
+	{testName, "c/c", testValue, assert.NoError, assert.True},
+	{testName, ".d", testValue, assert.NoError, assert.True},
+	{testName, testKey, testValue, assert.NoError, assert.True},
+}
+
+var tests = append(putTests,
+	testCase{testName, "not-found", "", assert.Error, assert.False},
+)
+
+type storeTestSuite struct {
+	suite.Suite
+	factory       Factory
+	restore       RestoreFunc
+	exportArchive string
+	store         storage.Storage
+	path          string
+}
+
+// SetupTest is a test hook that is run before each test.
+func (ts *storeTestSuite) SetupTest() {
+	ts.path = ts.T().TempDir()
+	ts.store = ts.factory(ts.path)
+	err := ts.store.Open()
+	ts.NoError(err)
+}
+
+// TearDownTest is a test hook that is run after each test.
+func (ts *storeTestSuite) TearDownTest() {
+	err := ts.store.Close()
+	ts.NoError(err)
+}
+
+// BeforeTest is a test hook that is run before each test.
+func (ts *storeTestSuite) BeforeTest(_, testName string) {
+	switch testName {
+	case "TestStorePut",
+		"TestStoreSave",
+		"TestStoreLoad",
+		"TestStoreList",
+		"TestStoreListAll",
+		"TestStoreNamespaces",
+		"TestStoreNamespaceManagement",
+		"TestStoreConcurrency",
+		"TestStoreLargeValues",
+		"TestStoreStats",
+		"TestStoreUpdate",
+		"TestStoreWithLogger":
+		break
+	default:
+		ts.TestStorePut()
+	}
+}
+
+func (ts *storeTestSuite) TestInvalidPath() {
+	ts.Panics(func() {
+		ts.factory("")
+	})
+}
+
+// TestStorePut tests putting a key/value into the store.
+func (ts *storeTestSuite) TestStorePut() {
+	for i, test := range putTests {
+		err := ts.store.Put(test.name, []byte(test.key), []byte(test.value))
+		test.err(ts.T(), err, "%d test name: %s key: %s", i, test.name, test.key)
+	}
+}
+
+// TestStoreSave tests saving an object.
+func (ts *storeTestSuite) TestStoreSave() {
+	err := ts.store.Save(testName, []byte(testKey), testObj)
+	ts.NoError(err)
+}
+
+// TestStoreLoad tests loading an object.
+func (ts *storeTestSuite) TestStoreLoad() {
+	ts.T().Run("Setup", func(t *testing.T) {
+		ts.TestStoreSave()
+	})
+	to := &testObject{}
+	err := ts.store.Load(testName, []byte(testKey), to)
+	ts.NoError(err)
+	ts.Equal(testObj, to)
+}
+
+// TestStoreGet tests getting the value of a key.
+func (ts *storeTestSuite) TestStoreGet() {
+	for i, test := range tests {
+		value, err := ts.store.Get(test.name, []byte(test.key))
+		test.err(ts.T(), err, "%d test name: %s key: %s", i, test.name, test.key)
+		ts.Equal(test.value, string(value),
+			"%d test key: %s", i, test.key)
+	}
+}
+
+// TestStoreHas tests checking for a key's existence.
+func (ts *storeTestSuite) TestStoreHas() {
+	for i, test := range tests {
+		has, _ := ts.store.Has(test.name, []byte(test.key))
+		test.has(ts.T(), has, "%d test key: %s", i, test.key)
+	}
+}
+
+// TestStoreList tests listing keys.
+func (ts *storeTestSuite) TestStoreList() {
+	const listLen = 100
+	list := make([]string, listLen)
+	for i := 0; i < listLen; i++ {
+		list[i] = uuid.New().String()
+		err := ts.store.Put(testName, []byte(list[i]), []byte(testValue))
+		ts.NoError(err)
+	}
+	keys, err := ts.store.List(testName)
+	ts.NoError(err)
+	ts.Len(keys, listLen)
+	// put both lists in the same order so we can compare them
+	strKeys := make([]string, len(keys))
+	for i, k := range keys {
+		strKeys[i] = string(k)
+	}
+	sort.Strings(list)
+	sort.Strings(strKeys)
+	ts.Equal(list, strKeys)
+}
+
+// TestStoreListAll tests listing all keys in the store.
+func (ts *storeTestSuite) TestStoreListAll() {
+	const listLen = 100
+	list := make([]string, listLen)
+	for i := 0; i < listLen; i++ {
+		list[i] = uuid.New().String()
+		ns := fmt.Sprintf("%s%d", testName, i)
+		err := ts.store.Put(ns, []byte(list[i]), []byte(testValue))
+		ts.NoError(err)
+	}
+	keyMap, err := ts.store.ListAll()
+	ts.NoError(err)
+	var keys []string
+	for _, ks := range keyMap {
+		for _, k := range ks {
+			keys = append(keys, string(k))
+		}
+	}
+	ts.Len(keys, listLen)
+	sort.Strings(list)
+	sort.Strings(keys)
+	ts.Equal(list, keys)
+}
+
+// TestStoreNamespaces tests that namespaces do not share keys.
+func (ts *storeTestSuite) TestStoreNamespaces() {
+	names := []string{"a", "b", "c/c", ".d", testName}
+	for _, name := range names {
+		err := ts.store.Put(name, []byte(testKey), []byte(name))
+		ts.NoError(err)
+		err = ts.store.Put(name, []byte(name), []byte(testValue))
+		ts.NoError(err)
+	}
+	for _, name := range names {
+		value, err := ts.store.Get(name, []byte(testKey))
+		ts.NoError(err)
+		ts.Equal(name, string(value))
+		keys, err := ts.store.List(name)
+		ts.NoError(err)
+		ts.ElementsMatch([][]byte{[]byte(testKey), []byte(name)}, keys, name)
+	}
+	// deleting a key only removes it from its own namespace
+	err := ts.store.Delete(names[0], []byte(testKey))
+	ts.NoError(err)
+	has, err := ts.store.Has(names[0], []byte(testKey))
+	ts.NoError(err)
+	ts.False(has)
+	for _, name := range names[1:] {
+		has, err = ts.store.Has(name, []byte(testKey))
+		ts.NoError(err)
+		ts.True(has, name)
+	}
+	keyMap, err := ts.store.ListAll()
+	ts.NoError(err)
+	ts.Len(keyMap, len(names))
+}
+
+// TestStoreNamespaceManagement tests listing, dropping,
+// renaming and copying namespaces.
+func (ts *storeTestSuite) TestStoreNamespaceManagement() {
+	names := []string{"a", "ab", "c/c", ".d"}
+	keys := []string{"k1", "k2"}
+	for _, name := range names {
+		for _, key := range keys {
+			err := ts.store.Put(name, []byte(key), []byte(name+key))
+			ts.NoError(err)
+		}
+	}
+	list, err := ts.store.ListNamespaces()
+	ts.NoError(err)
+	ts.Equal([]string{".d", "a", "ab", "c/c"}, list)
+	// a copy leaves the source namespace
+	err = ts.store.CopyNamespace("a", "copied")
+	ts.NoError(err)
+	for _, key := range keys {
+		value, err := ts.store.Get("copied", []byte(key))
+		ts.NoError(err)
+		ts.Equal("a"+key, string(value))
+		value, err = ts.store.Get("a", []byte(key))
+		ts.NoError(err)
+		ts.Equal("a"+key, string(value))
+	}
+	// a rename removes it
+	err = ts.store.RenameNamespace("ab", "renamed")
+	ts.NoError(err)
+	_, err = ts.store.List("ab")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	for _, key := range keys {
+		value, err := ts.store.Get("renamed", []byte(key))
+		ts.NoError(err)
+		ts.Equal("ab"+key, string(value))
+	}
+	// dropping a namespace does not drop the namespaces it is a prefix of
+	err = ts.store.Put("ab", []byte("k1"), []byte("ab"))
+	ts.NoError(err)
+	err = ts.store.DropNamespace("a")
+	ts.NoError(err)
+	_, err = ts.store.List("a")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	has, err := ts.store.Has("a", []byte("k1"))
+	ts.NoError(err)
+	ts.False(has)
+	list, err = ts.store.ListNamespaces()
+	ts.NoError(err)
+	ts.Equal([]string{".d", "ab", "c/c", "copied", "renamed"}, list)
+	errTests := []struct {
+		err error
+		fn  func() error
+	}{
+		{storage.ErrNamespaceNotFound, func() error { return ts.store.DropNamespace("a") }},
+		{storage.ErrNamespaceNotFound, func() error { return ts.store.RenameNamespace("a", "x") }},
+		{storage.ErrNamespaceNotFound, func() error { return ts.store.CopyNamespace("a", "x") }},
+		{storage.ErrNamespaceExists, func() error { return ts.store.RenameNamespace("copied", "renamed") }},
+		{storage.ErrNamespaceExists, func() error { return ts.store.CopyNamespace("copied", "renamed") }},
+		{storage.ErrNamespaceExists, func() error { return ts.store.CopyNamespace("copied", "copied") }},
+		{storage.ErrInvalidKey, func() error { return ts.store.DropNamespace("") }},
+		{storage.ErrInvalidKey, func() error { return ts.store.RenameNamespace("copied", "") }},
+		{storage.ErrInvalidKey, func() error { return ts.store.CopyNamespace("", "x") }},
+	}
+	for i, test := range errTests {
+		ts.ErrorIs(test.fn(), test.err, "%d", i)
+	}
+	// a failed rename or copy changes nothing
+	for _, name := range []string{"copied", "renamed"} {
+		list, err := ts.store.List(name)
+		ts.NoError(err)
+		ts.Len(list, len(keys), name)
+	}
+	_, err = ts.store.List("x")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	for _, name := range []string{".d", "ab", "c/c", "copied", "renamed"} {
+		err = ts.store.DropNamespace(name)
+		ts.NoError(err)
+	}
+	list, err = ts.store.ListNamespaces()
+	ts.NoError(err)
+	ts.Empty(list)
+}
+
+// TestStoreConcurrency tests using the store from multiple goroutines.
+func (ts *storeTestSuite) TestStoreConcurrency() {
+	const (
+		workers = 8
+		keysLen = 25
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*keysLen*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysLen; i++ {
+				key := []byte(fmt.Sprintf("%d-%d", w, i))
+				if err := ts.store.Put(testName, key, key); err != nil {
+					errs <- err
+					continue
+				}
+				value, err := ts.store.Get(testName, key)
+				if err != nil {
+					errs <- err
+				} else if !bytes.Equal(key, value) {
+					errs <- fmt.Errorf("key %s: unexpected value %s", key, value)
+				}
+				if _, err = ts.store.List(testName); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ts.NoError(err)
+	}
+	keys, err := ts.store.List(testName)
+	ts.NoError(err)
+	ts.Len(keys, workers*keysLen)
+}
+
+// TestStoreLargeValues tests putting and getting large values.
+func (ts *storeTestSuite) TestStoreLargeValues() {
+	sizes := []int{64 << 10, 1 << 20, 4 << 20}
+	for _, size := range sizes {
+		value := bytes.Repeat([]byte{0xc5, 0x7e, 0x57}, size/3+1)[:size]
+		key := []byte(fmt.Sprintf("large-%d", size))
+		err := ts.store.Put(testName, key, value)
+		ts.NoError(err, "size: %d", size)
+		got, err := ts.store.Get(testName, key)
+		ts.NoError(err, "size: %d", size)
+		ts.True(bytes.Equal(value, got), "size: %d", size)
+	}
+}
+
+// TestStoreStats tests the statistics of the store, which are collected
+// from the entries if the store is not a storage.StatsStorage.
+func (ts *storeTestSuite) TestStoreStats() {
+	puts := []struct {
+		name, key, value string
+	}{
+		{"stats-a", "a1", "overwritten"},
+		{"stats-a", "a1", "abc"},
+		{"stats-a", "a2", "de"},
+		{"stats-a", "a3", "deleted"},
+		{"stats-b", "b1", "fghi"},
+	}
+	for _, put := range puts {
+		err := ts.store.Put(put.name, []byte(put.key), []byte(put.value))
+		ts.NoError(err)
+	}
+	err := ts.store.Delete("stats-a", []byte("a3"))
+	ts.NoError(err)
+	stats, err := storage.CollectStats(ts.store)
+	ts.NoError(err)
+	ts.Equal(map[string]storage.NamespaceStats{
+		"stats-a": {Keys: 2, ValueBytes: 5},
+		"stats-b": {Keys: 1, ValueBytes: 4},
+	}, stats.Namespaces)
+	ts.Equal(int64(3), stats.Keys)
+	ts.Equal(int64(9), stats.ValueBytes)
+	ts.Equal(3.0, stats.AverageValueSize())
+	ts.GreaterOrEqual(stats.DeadSpace, 0.0)
+	ts.LessOrEqual(stats.DeadSpace, 1.0)
+	count, err := storage.CountKeys(ts.store, "stats-a")
+	ts.NoError(err)
+	ts.Equal(int64(2), count)
+	_, err = storage.CountKeys(ts.store, "not-found")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+}
+
+// TestStoreDelete tests removing an object from the store.
+func (ts *storeTestSuite) TestStoreDelete() {
+	var deleteTests = []struct {
+		key string
+		err assert.ErrorAssertionFunc
+	}{
+		{"", assert.Error},
+		{"a", assert.NoError},
+		{"b", assert.NoError},
+		{"c/c", assert.NoError},
+		{".d", assert.NoError},
+		{"eee", assert.NoError},
+		{"not-found", assert.NoError},
+	}
+	for i, test := range deleteTests {
+		err := ts.store.Delete(testName, []byte(test.key))
+		test.err(ts.T(), err, "%d test key: %s", i, test.key)
+	}
+}
+
+// TestStoreErrors tests the errors returned by the store.
+func (ts *storeTestSuite) TestStoreErrors() {
+	_, err := ts.store.Get(testName, []byte("not-found"))
+	ts.ErrorIs(err, storage.ErrNotFound)
+	ts.NotErrorIs(err, storage.ErrNamespaceNotFound)
+	_, err = ts.store.Get("not-found", []byte(testKey))
+	ts.ErrorIs(err, storage.ErrNotFound)
+	_, err = ts.store.List("not-found")
+	ts.ErrorIs(err, storage.ErrNamespaceNotFound)
+	has, err := ts.store.Has("not-found", []byte(testKey))
+	ts.NoError(err)
+	ts.False(has)
+	err = ts.store.Put(testName, nil, []byte(testValue))
+	ts.ErrorIs(err, storage.ErrInvalidKey)
+	err = ts.store.Delete("not-found", []byte(testKey))
+	ts.NoError(err)
+	// a closed store returns ErrClosed until it is opened again
+	err = ts.store.Close()
+	ts.NoError(err)
+	_, err = ts.store.Get(testName, []byte(testKey))
+	ts.ErrorIs(err, storage.ErrClosed)
+	err = ts.store.Put(testName, []byte(testKey), []byte(testValue))
+	ts.ErrorIs(err, storage.ErrClosed)
+	err = ts.store.Open()
+	ts.NoError(err)
+	_, err = ts.store.Get(testName, []byte(testKey))
+	ts.NoError(err)
+}
+
+// TestStoreUpdate tests transactions on stores which support them.
+func (ts *storeTestSuite) TestStoreUpdate() {
+	txStore, ok := ts.store.(storage.TransactionalStorage)
+	if !ok {
+		ts.T().Skip("store does not support transactions")
+	}
+	err := txStore.Update(func(tx storage.Tx) error {
+		if err := tx.Put("a", []byte("b"), []byte("c")); err != nil {
+			return err
+		}
+		v, err := tx.Get("a", []byte("b"))
+		ts.NoError(err)
+		ts.Equal("c", string(v))
+		return tx.Put("a", []byte("d"), []byte("e"))
+	})
+	ts.NoError(err)
+	// a failed transaction is rolled back
+	errRollback := errors.New("rollback")
+	err = txStore.Update(func(tx storage.Tx) error {
+		ts.NoError(tx.Delete("a", []byte("b")))
+		ts.NoError(tx.Put("a", []byte("f"), []byte("g")))
+		_, err := tx.Get("a", []byte("b"))
+		ts.ErrorIs(err, storage.ErrNotFound)
+		ts.Error(tx.Put("a", nil, []byte("g")))
+		return errRollback
+	})
+	ts.ErrorIs(err, errRollback)
+	keys, err := ts.store.List("a")
+	ts.NoError(err)
+	ts.Equal([][]byte{[]byte("b"), []byte("d")}, keys)
+}
+
+// TestStoreExport tests exporting the store to a file.
+func (ts *storeTestSuite) TestStoreExport() {
+	exTests := []struct {
+		path string
+		Err  assert.ErrorAssertionFunc
+	}{
+		{"", assert.Error},
+		{ts.path, assert.Error},
+		{ts.T().TempDir(), assert.NoError},
+	}
+	for _, test := range exTests {
+		err := ts.store.Export(test.path)
+		test.Err(ts.T(), err)
+		if err != nil {
+			continue
+		}
+		// the store must still work after an export
+		has, err := ts.store.Has(testName, []byte(testKey))
+		ts.NoError(err)
+		ts.True(has)
+		path := test.path
+		if ts.exportArchive != "" {
+			path = filepath.Join(ts.T().TempDir(), "restored")
+			err = ts.restore(filepath.Join(test.path, ts.exportArchive), path)
+			ts.NoError(err)
+		}
+		// open the export and compare it with the store
+		ts.compareStore(path)
+	}
+}
+
+// TestStoreExportTo tests streaming an export archive of the store.
+func (ts *storeTestSuite) TestStoreExportTo() {
+	path := filepath.Join(ts.T().TempDir(), "export.tar.gz")
+	f, err := os.Create(path)
+	ts.NoError(err)
+	err = storage.ExportTo(ts.store, f)
+	ts.NoError(err)
+	ts.NoError(f.Close())
+	err = storage.VerifyArchive(path)
+	ts.NoError(err)
+	// the store must still work after an export
+	has, err := ts.store.Has(testName, []byte(testKey))
+	ts.NoError(err)
+	ts.True(has)
+	if ts.restore == nil {
+		return
+	}
+	// restore the archive and compare it with the store
+	dest := filepath.Join(ts.T().TempDir(), "restored")
+	err = ts.restore(path, dest)
+	ts.NoError(err)
+	ts.compareStore(dest)
+	// a restore does not replace data unless asked to
+	err = ts.restore(path, dest)
+	ts.ErrorIs(err, storage.ErrPathExists)
+	err = ts.restore(path, dest, storage.WithOverwrite())
+	ts.NoError(err)
+	ts.compareStore(dest)
+}
+
+// compareStore opens the store the factory returns for path, and checks
+// it holds the same records as the store under test.
+func (ts *storeTestSuite) compareStore(path string) {
+	want, err := ts.store.ListAll()
+	ts.NoError(err)
+	ts.NotEmpty(want)
+	s2 := ts.factory(path)
+	ts.NotNil(s2)
+	err = s2.Open()
+	ts.NoError(err)
+	defer func() {
+		ts.NoError(s2.Close())
+	}()
+	got, err := s2.ListAll()
+	ts.NoError(err)
+	ts.Equal(sortKeys(want), sortKeys(got))
+	for name, keys := range want {
+		for _, key := range keys {
+			v1, err := ts.store.Get(name, key)
+			ts.NoError(err)
+			v2, err := s2.Get(name, key)
+			ts.NoError(err, "restored name: %s key: %s", name, key)
+			ts.Equal(v1, v2, "restored name: %s key: %s", name, key)
+		}
+	}
+}
+
+// TestStoreWithLogger tests the store with a logger.
+func (ts *storeTestSuite) TestStoreWithLogger() {
+	levels := []log.Level{
+		log.DebugLevel,
+		log.InfoLevel,
+		log.WarnLevel,
+		log.ErrorLevel,
+		log.PanicLevel,
+	}
+	type LoggerOpt func(log.Level) storage.StoreOption
+	logOpts := []LoggerOpt{
+		storage.WithZerologLogger,
+		storage.WithStdLogger,
+	}
+	path := ts.T().TempDir()
+	for _, level := range levels {
+		for _, logOpt := range logOpts {
+			opt := logOpt(level)
+			store := ts.factory(path, opt)
+			ts.NotNil(store)
+			err := store.Open()
+			ts.NoError(err)
+			err = store.Close()
+			ts.NoError(err)
+		}
+	}
+}
+
+// sortKeys returns the keys in the map as sorted strings.
+func sortKeys(keyMap map[string][][]byte) map[string][]string {
+	sorted := make(map[string][]string, len(keyMap))
+	for name, keys := range keyMap {
+		strKeys := make([]string, len(keys))
+		for i, k := range keys {
+			strKeys[i] = string(k)
+		}
+		sort.Strings(strKeys)
+		sorted[name] = strKeys
+	}
+	return sorted
+}
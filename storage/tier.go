@@ -0,0 +1,670 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.tcp.direct/kayos/chestnut/log"
+)
+
+// TieredStorage is a Storage which keeps records in a hot and a cold
+// store, SEE: Tiered.
+type TieredStorage interface {
+	Storage
+
+	// Demote applies the demotion policy now, moving records which are
+	// idle, or over the hot record limit, to the cold store. Demote returns
+	// the number of records moved.
+	Demote() (int, error)
+
+	// TierStats returns the number of records in each tier, and
+	// counters for the reads served and the records moved.
+	TierStats() (TierStats, error)
+}
+
+// TierStats are the residency and access statistics of a tiered store.
+type TierStats struct {
+	// HotRecords is the number of records in the hot store.
+	HotRecords int
+	// ColdRecords is the number of records in the cold store.
+	ColdRecords int
+	// HotReads is the number of reads served by the hot store.
+	HotReads int64
+	// ColdReads is the number of reads served by the cold store.
+	ColdReads int64
+	// Misses is the number of reads for records not in either store.
+	Misses int64
+	// Promotions is the number of records moved to the hot store.
+	Promotions int64
+	// Demotions is the number of records moved to the cold store.
+	Demotions int64
+}
+
+// tierOptions are the tiered store policy options.
+type tierOptions struct {
+	promoteAfter int
+	demoteAfter  time.Duration
+	maxHot       int
+	interval     time.Duration
+}
+
+var defaultTierOptions = tierOptions{
+	promoteAfter: 1,
+}
+
+// tierOption is implemented by StoreOptions that configure a tiered store.
+type tierOption interface {
+	StoreOption
+	applyTier(*tierOptions)
+}
+
+// tierFuncOption embeds EmptyStoreOption so it can be passed
+// to Tiered alongside the common storage options.
+type tierFuncOption struct {
+	EmptyStoreOption
+	f func(*tierOptions)
+}
+
+func (o tierFuncOption) applyTier(opts *tierOptions) {
+	o.f(opts)
+}
+
+func newTierOption(f func(*tierOptions)) StoreOption {
+	return tierFuncOption{f: f}
+}
+
+// applyTierOptions applies the tiered store options in opt.
+func applyTierOptions(opts tierOptions, opt ...StoreOption) tierOptions {
+	for _, o := range opt {
+		if to, ok := o.(tierOption); ok {
+			to.applyTier(&opts)
+		}
+	}
+	return opts
+}
+
+// WithPromoteAfter returns a StoreOption which promotes a cold record to
+// the hot store after it has been read n times. The default is to promote
+// a record the first time it is read, and zero disables promotion.
+func WithPromoteAfter(n int) StoreOption {
+	return newTierOption(func(o *tierOptions) {
+		o.promoteAfter = n
+	})
+}
+
+// WithDemoteAfter returns a StoreOption which demotes hot records that
+// have not been read or written for idle. The default of zero keeps
+// records in the hot store until they are demoted by WithMaxHot.
+func WithDemoteAfter(idle time.Duration) StoreOption {
+	return newTierOption(func(o *tierOptions) {
+		o.demoteAfter = idle
+	})
+}
+
+// WithMaxHot returns a StoreOption which limits the hot store to n
+// records. When a put or a promotion goes over the limit the least
+// recently used records are demoted. The default of zero is no limit.
+func WithMaxHot(n int) StoreOption {
+	return newTierOption(func(o *tierOptions) {
+		o.maxHot = n
+	})
+}
+
+// WithDemoteInterval returns a StoreOption which applies the demotion
+// policy every interval while the store is open. By default the policy
+// is only applied when Demote is called.
+func WithDemoteInterval(interval time.Duration) StoreOption {
+	return newTierOption(func(o *tierOptions) {
+		o.interval = interval
+	})
+}
+
+// tierRecord is a record in the hot store.
+type tierRecord struct {
+	name       string
+	key        []byte
+	lastAccess time.Time
+}
+
+// tierStore is an implementation of the Storage interface which keeps
+// recently used records in a hot store and the rest in a cold store.
+type tierStore struct {
+	hot        Storage
+	cold       Storage
+	topts      tierOptions
+	serializer Serializer
+	log        log.Logger
+
+	// mu guards the residency of records and the maps below.
+	mu        sync.Mutex
+	hotIndex  map[string]*tierRecord
+	coldReads map[string]int
+	stop      chan struct{}
+	done      chan struct{}
+
+	hotReads   int64
+	coldHits   int64
+	misses     int64
+	promotions int64
+	demotions  int64
+}
+
+var _ TieredStorage = (*tierStore)(nil)
+
+// Tiered returns a store which keeps recently used records in the hot
+// store, e.g. memory or bolt, and demotes the rest to the cold store, e.g.
+// the file system or object storage. Records are written to the hot store,
+// read from the hot store and then the cold store, and promoted back to the
+// hot store when they are read. The promotion and demotion policies are set
+// with WithPromoteAfter, WithDemoteAfter, WithMaxHot and WithDemoteInterval.
+//
+// The store keeps an index of the records in the hot store, and a count of
+// the reads of cold records which have not been promoted, in memory.
+func Tiered(hot, cold Storage, opt ...StoreOption) TieredStorage {
+	opts := ApplyOptions(DefaultStoreOptions, opt...)
+	return &tierStore{
+		hot:        hot,
+		cold:       cold,
+		topts:      applyTierOptions(defaultTierOptions, opt...),
+		serializer: opts.Serializer(),
+		log:        log.Named(opts.Logger(), "tier"),
+	}
+}
+
+// Open opens both stores, and indexes the records in the hot store.
+func (s *tierStore) Open() error {
+	if err := s.hot.Open(); err != nil {
+		return fmt.Errorf("hot: %w", err)
+	}
+	if err := s.cold.Open(); err != nil {
+		_ = s.hot.Close()
+		return fmt.Errorf("cold: %w", err)
+	}
+	allKeys, err := s.hot.ListAll()
+	if err != nil {
+		_ = s.hot.Close()
+		_ = s.cold.Close()
+		return fmt.Errorf("hot: %w", err)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hotIndex = map[string]*tierRecord{}
+	s.coldReads = map[string]int{}
+	for name, keys := range allKeys {
+		for _, key := range keys {
+			s.hotIndex[recordID(name, key)] = &tierRecord{name: name, key: key, lastAccess: now}
+		}
+	}
+	if s.topts.interval > 0 {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.demoteEvery(s.topts.interval, s.stop, s.done)
+	}
+	return nil
+}
+
+// demoteEvery applies the demotion policy every interval until stop is closed.
+func (s *tierStore) demoteEvery(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if n, err := s.Demote(); err != nil {
+				s.log.Errorf("demote: %s", err)
+			} else if n > 0 {
+				s.log.Debugf("demote: moved %d records to the cold store", n)
+			}
+		}
+	}
+}
+
+// Put an entry in the hot store, and remove it from the cold store.
+func (s *tierStore) Put(name string, key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.hot.Put(name, key, value); err != nil {
+		return err
+	}
+	s.touch(name, key)
+	if err := s.cold.Delete(name, key); err != nil {
+		return fmt.Errorf("cold: %w", err)
+	}
+	delete(s.coldReads, recordID(name, key))
+	_, err := s.demoteOverLimit()
+	return err
+}
+
+// Get a value from the hot store, or from the cold store if it has
+// been demoted. A cold record is promoted by the promotion policy.
+func (s *tierStore) Get(name string, key []byte) ([]byte, error) {
+	value, hotErr := s.hot.Get(name, key)
+	if hotErr == nil {
+		atomic.AddInt64(&s.hotReads, 1)
+		s.mu.Lock()
+		s.touch(name, key)
+		s.mu.Unlock()
+		return value, nil
+	} else if !errors.Is(hotErr, ErrNotFound) {
+		return nil, hotErr
+	}
+	value, err := s.cold.Get(name, key)
+	if errors.Is(err, ErrNotFound) {
+		atomic.AddInt64(&s.misses, 1)
+		// the namespace is only missing if it is missing from both stores
+		if errors.Is(hotErr, ErrNamespaceNotFound) {
+			return nil, err
+		}
+		return nil, hotErr
+	} else if err != nil {
+		return nil, fmt.Errorf("cold: %w", err)
+	}
+	atomic.AddInt64(&s.coldHits, 1)
+	if err = s.promote(name, key, value); err != nil {
+		s.log.Errorf("promote: %s", err)
+	}
+	return value, nil
+}
+
+// promote moves a cold record which was read to the hot store
+// if the promotion policy allows it.
+func (s *tierStore) promote(name string, key []byte, value []byte) error {
+	if s.topts.promoteAfter <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := recordID(name, key)
+	if s.coldReads[id]++; s.coldReads[id] < s.topts.promoteAfter {
+		return nil
+	}
+	delete(s.coldReads, id)
+	// the record may have been written or deleted since it was read
+	if _, ok := s.hotIndex[id]; ok {
+		return nil
+	} else if has, err := s.cold.Has(name, key); err != nil || !has {
+		return err
+	}
+	if err := s.hot.Put(name, key, value); err != nil {
+		return err
+	}
+	s.touch(name, key)
+	if err := s.cold.Delete(name, key); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.promotions, 1)
+	_, err := s.demoteOverLimit()
+	return err
+}
+
+// Has checks for a key in either store.
+func (s *tierStore) Has(name string, key []byte) (bool, error) {
+	has, err := s.hot.Has(name, key)
+	if err != nil || has {
+		return has, err
+	}
+	return s.cold.Has(name, key)
+}
+
+// Save the value in v and store the result at key.
+func (s *tierStore) Save(name string, key []byte, v interface{}) error {
+	b, err := s.serializer.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(name, key, b)
+}
+
+// Load the value at key and stores the result in v.
+func (s *tierStore) Load(name string, key []byte, v interface{}) error {
+	b, err := s.Get(name, key)
+	if err != nil {
+		return err
+	}
+	return s.serializer.Unmarshal(b, v)
+}
+
+// List returns the keys in the namespace in both stores.
+func (s *tierStore) List(name string) ([][]byte, error) {
+	hotKeys, err := s.hot.List(name)
+	if err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+		return nil, err
+	}
+	coldKeys, err := s.cold.List(name)
+	if err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+		return nil, fmt.Errorf("cold: %w", err)
+	}
+	keys := mergeKeys(hotKeys, coldKeys)
+	if len(keys) <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	return keys, nil
+}
+
+// ListAll returns a mapped list of the keys in both stores.
+func (s *tierStore) ListAll() (map[string][][]byte, error) {
+	allKeys, err := s.hot.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	coldKeys, err := s.cold.ListAll()
+	if err != nil {
+		return nil, fmt.Errorf("cold: %w", err)
+	}
+	for name, keys := range coldKeys {
+		allKeys[name] = mergeKeys(allKeys[name], keys)
+	}
+	return allKeys, nil
+}
+
+// Delete removes a key from both stores.
+func (s *tierStore) Delete(name string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.hot.Delete(name, key); err != nil {
+		return err
+	}
+	id := recordID(name, key)
+	delete(s.hotIndex, id)
+	delete(s.coldReads, id)
+	if err := s.cold.Delete(name, key); err != nil {
+		return fmt.Errorf("cold: %w", err)
+	}
+	return nil
+}
+
+// ListNamespaces returns the namespaces in both stores.
+func (s *tierStore) ListNamespaces() ([]string, error) {
+	hotNames, err := s.hot.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	coldNames, err := s.cold.ListNamespaces()
+	if err != nil {
+		return nil, fmt.Errorf("cold: %w", err)
+	}
+	names := hotNames
+	for _, name := range coldNames {
+		if i := sort.SearchStrings(hotNames, name); i >= len(hotNames) || hotNames[i] != name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DropNamespace removes a namespace from both stores.
+func (s *tierStore) DropNamespace(name string) error {
+	if err := ValidNamespace(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.eachTier(func(st Storage) error {
+		return st.DropNamespace(name)
+	})
+	if errors.Is(err, ErrNamespaceNotFound) {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	} else if err != nil {
+		return err
+	}
+	s.reindex(name, "", false)
+	return nil
+}
+
+// RenameNamespace renames a namespace in both stores. The records keep
+// their residency, but the reads of cold records are counted from zero.
+func (s *tierStore) RenameNamespace(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkNamespaces(from, to); err != nil {
+		return err
+	}
+	err := s.eachTier(func(st Storage) error {
+		return st.RenameNamespace(from, to)
+	})
+	if err != nil {
+		return err
+	}
+	s.reindex(from, to, false)
+	return nil
+}
+
+// CopyNamespace copies a namespace in both stores. The copied records
+// have the same residency as the records they were copied from.
+func (s *tierStore) CopyNamespace(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkNamespaces(from, to); err != nil {
+		return err
+	}
+	err := s.eachTier(func(st Storage) error {
+		return st.CopyNamespace(from, to)
+	})
+	if err != nil {
+		return err
+	}
+	s.reindex(from, to, true)
+	return nil
+}
+
+// checkNamespaces returns an error if namespace from cannot be
+// renamed or copied to namespace to.
+func (s *tierStore) checkNamespaces(from, to string) error {
+	if err := ValidNamespace(from); err != nil {
+		return err
+	} else if err = ValidNamespace(to); err != nil {
+		return err
+	}
+	if _, err := s.List(to); err == nil {
+		return fmt.Errorf("%w: %s", ErrNamespaceExists, to)
+	} else if !errors.Is(err, ErrNamespaceNotFound) {
+		return err
+	}
+	_, err := s.List(from)
+	return err
+}
+
+// eachTier calls fn with the hot store and then the cold store. A store
+// which does not have the namespace is skipped, if neither store has it
+// the error wraps ErrNamespaceNotFound.
+func (s *tierStore) eachTier(fn func(st Storage) error) error {
+	err := fn(s.hot)
+	found := err == nil
+	if err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+		return err
+	}
+	err = fn(s.cold)
+	if err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+		return fmt.Errorf("cold: %w", err)
+	} else if err != nil && !found {
+		return err
+	}
+	return nil
+}
+
+// reindex moves the index of the hot records in namespace from to
+// namespace to, or copies it if keep is true. If to is empty the
+// records are removed from the index. The caller must hold the lock.
+func (s *tierStore) reindex(from, to string, keep bool) {
+	for id, r := range s.hotIndex {
+		if r.name != from {
+			continue
+		}
+		if !keep {
+			delete(s.hotIndex, id)
+		}
+		if to != "" {
+			s.hotIndex[recordID(to, r.key)] = &tierRecord{name: to, key: r.key, lastAccess: r.lastAccess}
+		}
+	}
+	if keep {
+		return
+	}
+	prefix := fmt.Sprintf("%q.", from)
+	for id := range s.coldReads {
+		if strings.HasPrefix(id, prefix) {
+			delete(s.coldReads, id)
+		}
+	}
+}
+
+// Close stops the demotion policy and closes both stores.
+func (s *tierStore) Close() error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	err := s.hot.Close()
+	if coldErr := s.cold.Close(); err == nil && coldErr != nil {
+		err = fmt.Errorf("cold: %w", coldErr)
+	}
+	return err
+}
+
+// Export exports the hot store to the directory hot in path, and the
+// cold store to the directory cold in path.
+func (s *tierStore) Export(path string) error {
+	if path == "" {
+		return fmt.Errorf("invalid path: %s", path)
+	}
+	if err := s.hot.Export(filepath.Join(path, "hot")); err != nil {
+		return err
+	}
+	if err := s.cold.Export(filepath.Join(path, "cold")); err != nil {
+		return fmt.Errorf("cold: %w", err)
+	}
+	return nil
+}
+
+// Demote applies the demotion policy now.
+func (s *tierStore) Demote() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var demoted int
+	if s.topts.demoteAfter > 0 {
+		idle := time.Now().Add(-s.topts.demoteAfter)
+		for _, r := range s.lruRecords() {
+			if !r.lastAccess.Before(idle) {
+				break
+			}
+			if err := s.demote(r); err != nil {
+				return demoted, err
+			}
+			demoted++
+		}
+	}
+	n, err := s.demoteOverLimit()
+	return demoted + n, err
+}
+
+// demoteOverLimit demotes the least recently used records
+// while the hot store has more than the maximum records.
+func (s *tierStore) demoteOverLimit() (int, error) {
+	if s.topts.maxHot <= 0 || len(s.hotIndex) <= s.topts.maxHot {
+		return 0, nil
+	}
+	var demoted int
+	for _, r := range s.lruRecords()[:len(s.hotIndex)-s.topts.maxHot] {
+		if err := s.demote(r); err != nil {
+			return demoted, err
+		}
+		demoted++
+	}
+	return demoted, nil
+}
+
+// demote moves a record from the hot store to the cold store.
+func (s *tierStore) demote(r *tierRecord) error {
+	value, err := s.hot.Get(r.name, r.key)
+	if errors.Is(err, ErrNotFound) {
+		delete(s.hotIndex, recordID(r.name, r.key))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = s.cold.Put(r.name, r.key, value); err != nil {
+		return fmt.Errorf("cold: %w", err)
+	}
+	if err = s.hot.Delete(r.name, r.key); err != nil {
+		return err
+	}
+	delete(s.hotIndex, recordID(r.name, r.key))
+	atomic.AddInt64(&s.demotions, 1)
+	return nil
+}
+
+// lruRecords returns the hot records, least recently used first.
+func (s *tierStore) lruRecords() []*tierRecord {
+	records := make([]*tierRecord, 0, len(s.hotIndex))
+	for _, r := range s.hotIndex {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].lastAccess.Before(records[j].lastAccess)
+	})
+	return records
+}
+
+// touch records an access to a record in the hot store.
+func (s *tierStore) touch(name string, key []byte) {
+	id := recordID(name, key)
+	if r, ok := s.hotIndex[id]; ok {
+		r.lastAccess = time.Now()
+		return
+	}
+	s.hotIndex[id] = &tierRecord{name: name, key: key, lastAccess: time.Now()}
+}
+
+// TierStats returns the residency and access statistics of the store.
+// The cold records are counted by listing the cold store.
+func (s *tierStore) TierStats() (TierStats, error) {
+	coldKeys, err := s.cold.ListAll()
+	if err != nil {
+		return TierStats{}, fmt.Errorf("cold: %w", err)
+	}
+	stats := TierStats{
+		HotReads:   atomic.LoadInt64(&s.hotReads),
+		ColdReads:  atomic.LoadInt64(&s.coldHits),
+		Misses:     atomic.LoadInt64(&s.misses),
+		Promotions: atomic.LoadInt64(&s.promotions),
+		Demotions:  atomic.LoadInt64(&s.demotions),
+	}
+	for _, keys := range coldKeys {
+		stats.ColdRecords += len(keys)
+	}
+	s.mu.Lock()
+	stats.HotRecords = len(s.hotIndex)
+	s.mu.Unlock()
+	return stats, nil
+}
+
+// mergeKeys returns the sorted union of two lists of keys.
+func mergeKeys(a, b [][]byte) [][]byte {
+	seen := make(map[string]bool, len(a)+len(b))
+	keys := make([][]byte, 0, len(a)+len(b))
+	for _, list := range [][][]byte{a, b} {
+		for _, key := range list {
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	sortKeys(keys)
+	return keys
+}
@@ -0,0 +1,109 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.tcp.direct/kayos/chestnut/storage"
+	"git.tcp.direct/kayos/chestnut/storage/fs"
+	"git.tcp.direct/kayos/chestnut/storage/memory"
+	"git.tcp.direct/kayos/chestnut/storage/storagetest"
+)
+
+// newTestTiers tiers fs stores in the directories of a tiered export.
+func newTestTiers(path string, opt ...storage.StoreOption) storage.Storage {
+	if path == "" {
+		panic("store path required")
+	}
+	hot := fs.NewStore(filepath.Join(path, "hot"), opt...)
+	cold := fs.NewStore(filepath.Join(path, "cold"), opt...)
+	return storage.Tiered(hot, cold, append(opt, storage.WithMaxHot(10))...)
+}
+
+func TestTiered(t *testing.T) {
+	storagetest.RunConformance(t, newTestTiers)
+}
+
+func TestTiered_MaxHot(t *testing.T) {
+	hot, cold := memory.NewStore(), memory.NewStore()
+	store := storage.Tiered(hot, cold, storage.WithMaxHot(2))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, store.Put("n", []byte(key), []byte(key)))
+	}
+	// the least recently used record is demoted
+	keys, err := cold.List("n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, keys)
+	// and promoted when it is read, demoting the next record
+	v, err := store.Get("n", []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	keys, err = cold.List("n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b")}, keys)
+	keys, err = store.List("n")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	_, err = store.Get("n", []byte("d"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	stats, err := store.TierStats()
+	assert.NoError(t, err)
+	assert.Equal(t, storage.TierStats{
+		HotRecords:  2,
+		ColdRecords: 1,
+		ColdReads:   1,
+		Misses:      1,
+		Promotions:  1,
+		Demotions:   2,
+	}, stats)
+}
+
+func TestTiered_DemoteAfter(t *testing.T) {
+	hot, cold := memory.NewStore(), memory.NewStore()
+	store := storage.Tiered(hot, cold,
+		storage.WithDemoteAfter(50*time.Millisecond),
+		storage.WithPromoteAfter(2))
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.NoError(t, store.Put("n", []byte("a"), []byte("a")))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, store.Put("n", []byte("b"), []byte("b")))
+	demoted, err := store.Demote()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, demoted)
+	has, err := cold.Has("n", []byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+	// the record is promoted on the second read
+	for i := 0; i < 2; i++ {
+		_, err = store.Get("n", []byte("a"))
+		assert.NoError(t, err)
+	}
+	has, err = hot.Has("n", []byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, has)
+	stats, err := store.TierStats()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.HotRecords)
+	assert.Equal(t, 0, stats.ColdRecords)
+	assert.Equal(t, int64(2), stats.ColdReads)
+}
+
+func TestTiered_DemoteInterval(t *testing.T) {
+	hot, cold := memory.NewStore(), memory.NewStore()
+	store := storage.Tiered(hot, cold,
+		storage.WithDemoteAfter(time.Millisecond),
+		storage.WithDemoteInterval(10*time.Millisecond))
+	assert.NoError(t, store.Open())
+	assert.NoError(t, store.Put("n", []byte("a"), []byte("a")))
+	assert.Eventually(t, func() bool {
+		has, err := cold.Has("n", []byte("a"))
+		return err == nil && has
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, store.Close())
+}